@@ -0,0 +1,120 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDenied    = errors.New("address is not allowed to connect")
+	ErrBannedIP  = errors.New("address is temporarily banned")
+	ErrBadPrefix = errors.New("invalid IP address or CIDR")
+)
+
+// Ban is a timed block on an address or network.
+type Ban struct {
+	Prefix  netip.Prefix
+	Expires time.Time
+}
+
+// List is a snapshot of the allow list, deny list and active bans. If the
+// allow list is empty every address not denied or banned is allowed,
+// otherwise only addresses inside one of the allowed networks are.
+type List struct {
+	mu    sync.RWMutex
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	bans  []Ban
+}
+
+// ParsePrefix parses a single IPv4 or IPv6 address or CIDR. A bare address is
+// turned into a single host prefix.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%w: %s", ErrBadPrefix, s)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: %s", ErrBadPrefix, s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParsePrefixes parses every entry with ParsePrefix, stopping at the first
+// invalid one.
+func ParsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		prefix, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// Update replaces the contents of the list.
+func (l *List) Update(allow, deny []netip.Prefix, bans []Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.allow = allow
+	l.deny = deny
+	l.bans = bans
+}
+
+// Check returns nil if the address may connect, ErrBannedIP if it falls in an
+// active ban and ErrDenied if it is denied or not on a non-empty allow list.
+// Bans and denials take precedence over the allow list.
+func (l *List) Check(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadPrefix, ip)
+	}
+	addr = addr.Unmap()
+	now := time.Now()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, ban := range l.bans {
+		if ban.Prefix.Contains(addr) && now.Before(ban.Expires) {
+			return ErrBannedIP
+		}
+	}
+
+	if contains(l.deny, addr) {
+		return ErrDenied
+	}
+
+	if len(l.allow) > 0 && !contains(l.allow, addr) {
+		return ErrDenied
+	}
+	return nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
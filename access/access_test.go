@@ -0,0 +1,60 @@
+package access
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestListCheck covers allow lists, deny lists, bans and IPv6 networks.
+func TestListCheck(t *testing.T) {
+	allow, err := ParsePrefixes([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deny, err := ParsePrefixes([]string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list List
+	list.Update(allow, deny, []Ban{
+		{Prefix: netip.MustParsePrefix("10.2.0.1/32"), Expires: time.Now().Add(time.Minute)},
+		{Prefix: netip.MustParsePrefix("10.3.0.1/32"), Expires: time.Now().Add(-time.Minute)},
+	})
+
+	cases := map[string]error{
+		"10.0.0.1":        nil,
+		"::ffff:10.0.0.1": nil,
+		"2001:db8::1":     nil,
+		"10.1.2.3":        ErrDenied,
+		"192.168.1.1":     ErrDenied,
+		"2001:db9::1":     ErrDenied,
+		"10.2.0.1":        ErrBannedIP,
+		"10.3.0.1":        nil,
+	}
+
+	for ip, expected := range cases {
+		if err := list.Check(ip); err != expected {
+			t.Errorf("%s: expected %v, got %v", ip, expected, err)
+		}
+	}
+}
+
+// TestParsePrefix checks that bare addresses become host prefixes and that
+// garbage is rejected.
+func TestParsePrefix(t *testing.T) {
+	prefix, err := ParsePrefix("192.168.1.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prefix.String() != "192.168.1.7/32" {
+		t.Errorf("Expected 192.168.1.7/32, got %s", prefix)
+	}
+
+	if _, err := ParsePrefix("not-an-ip"); err == nil {
+		t.Error("Expected an error for an invalid address")
+	}
+}
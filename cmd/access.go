@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"darkchat/access"
+	"darkchat/database"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var accessCmd = &cobra.Command{
+	Use:   "access",
+	Short: "Manage the shared IP allow list, deny list and bans",
+	Long:  "Manage the IP allow list, deny list and temporary bans stored in Redis. Changes are picked up by every running server within a few seconds.",
+}
+
+var accessListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show the allow list, deny list and active bans",
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, list := range []string{database.AllowList, database.DenyList} {
+			entries, err := database.AccessEntries(list)
+			if err != nil {
+				cmd.PrintErrln(err.Error())
+				os.Exit(1)
+			}
+			sort.Strings(entries)
+
+			for _, entry := range entries {
+				cmd.Printf("%s\t%s\n", list, entry)
+			}
+		}
+
+		bans, err := database.ActiveBans()
+		if err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+
+		for entry, expires := range bans {
+			cmd.Printf("ban\t%s\tuntil %s\n", entry, expires.Format(time.RFC3339))
+		}
+	},
+}
+
+var accessAllowCmd = &cobra.Command{
+	Use:   "allow <ip|cidr>",
+	Short: "Add or remove an entry on the allow list",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateAccessList(cmd, database.AllowList, args[0])
+	},
+}
+
+var accessDenyCmd = &cobra.Command{
+	Use:   "deny <ip|cidr>",
+	Short: "Add or remove an entry on the deny list",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateAccessList(cmd, database.DenyList, args[0])
+	},
+}
+
+var accessBanCmd = &cobra.Command{
+	Use:   "ban <ip|cidr>",
+	Short: "Ban an address or network for a limited time",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		prefix := parsePrefixArg(cmd, args[0])
+		duration, _ := cmd.Flags().GetDuration("for")
+
+		if err := database.BanAddress(prefix, duration); err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+		cmd.Printf("Banned %s for %s\n", prefix, duration)
+	},
+}
+
+var accessUnbanCmd = &cobra.Command{
+	Use:   "unban <ip|cidr>",
+	Short: "Lift a ban before it expires",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		prefix := parsePrefixArg(cmd, args[0])
+
+		if err := database.LiftBan(prefix); err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+		cmd.Printf("Lifted ban on %s\n", prefix)
+	},
+}
+
+// updateAccessList adds the entry to the named list, or removes it when the
+// --remove flag is set.
+func updateAccessList(cmd *cobra.Command, list string, entry string) {
+	prefix := parsePrefixArg(cmd, entry)
+	remove, _ := cmd.Flags().GetBool("remove")
+
+	var err error
+
+	if remove {
+		err = database.RemoveAccessEntry(list, prefix)
+	} else {
+		err = database.AddAccessEntry(list, prefix)
+	}
+
+	if err != nil {
+		cmd.PrintErrln(err.Error())
+		os.Exit(1)
+	}
+
+	if remove {
+		cmd.Printf("Removed %s from the %s list\n", prefix, list)
+	} else {
+		cmd.Printf("Added %s to the %s list\n", prefix, list)
+	}
+}
+
+// parsePrefixArg normalizes an address or CIDR argument, exiting on invalid
+// input.
+func parsePrefixArg(cmd *cobra.Command, arg string) string {
+	prefix, err := access.ParsePrefix(arg)
+	if err != nil {
+		cmd.PrintErrln(err.Error())
+		os.Exit(1)
+	}
+	return prefix.String()
+}
+
+func init() {
+	rootCmd.AddCommand(accessCmd)
+
+	accessCmd.AddCommand(accessListCmd, accessAllowCmd, accessDenyCmd, accessBanCmd, accessUnbanCmd)
+
+	accessAllowCmd.Flags().Bool("remove", false, "Remove the entry instead of adding it")
+	accessDenyCmd.Flags().Bool("remove", false, "Remove the entry instead of adding it")
+	accessBanCmd.Flags().Duration("for", time.Hour, "How long the ban lasts")
+}
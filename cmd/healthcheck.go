@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"darkchat/health"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var healthcheckCmd = &cobra.Command{
+	Use:   "healthcheck",
+	Short: "Probe the health endpoint of a running server",
+	Long:  "Probe the health endpoint of a running server and exit non-zero if it is unhealthy. Suitable for a Docker HEALTHCHECK.",
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		ready, _ := cmd.Flags().GetBool("ready")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+
+		if host == "" {
+			host = "localhost"
+		}
+
+		path := "/healthz"
+		if ready {
+			path = "/readyz"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := health.Probe(ctx, fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), path)); err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(healthcheckCmd)
+
+	healthcheckCmd.Flags().String("address", health.DEFAULTADDRESS, "Address of the health listener")
+	healthcheckCmd.Flags().Bool("ready", false, "Check readiness instead of liveness")
+	healthcheckCmd.Flags().Duration("timeout", 3*time.Second, "How long to wait for an answer")
+}
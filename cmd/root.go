@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"darkchat/monitor"
 	"log"
 	"os"
 
@@ -12,14 +13,75 @@ var rootCmd = &cobra.Command{
 	Short: "This is a chat server",
 	Long:  "This is a chat server",
 
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if format, _ := cmd.Flags().GetString("log-format"); format != "" {
+			monitor.SetFormat(format)
+		}
+
+		config := logConfig(cmd)
+
+		if err := monitor.ValidOverflow(config.Overflow); err != nil {
+			return err
+		}
+
+		monitor.Configure(config)
+		return nil
+	},
+
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Fatal("Please use a subcommand")
 	},
 }
 
+func init() {
+	rootCmd.PersistentFlags().String("log-format", "", "Log output format: text, logfmt or json (defaults to LOG_FORMAT)")
+	rootCmd.PersistentFlags().String("log-level", "", "Minimum log level: debug, info, warning or error (defaults to LOG_LEVEL)")
+	rootCmd.PersistentFlags().StringToString("log-levels", nil, "Minimum log level per logger, e.g. server=info,database=warning")
+	rootCmd.PersistentFlags().StringSlice("log-sinks", []string{monitor.SinkFile}, "Where logs are written: file, stderr and/or syslog")
+	rootCmd.PersistentFlags().String("log-dir", "", "Directory for log files (defaults to the working directory)")
+	rootCmd.PersistentFlags().Int64("log-max-size", 0, "Rotate log files larger than this many megabytes (0 disables)")
+	rootCmd.PersistentFlags().Duration("log-rotate-every", 0, "Rotate log files older than this (0 disables)")
+	rootCmd.PersistentFlags().Int("log-max-backups", 0, "Number of rotated log files to keep (0 keeps all)")
+	rootCmd.PersistentFlags().Duration("log-max-age", 0, "Delete rotated log files older than this (0 keeps all)")
+	rootCmd.PersistentFlags().Bool("log-compress", false, "Gzip rotated log files")
+	rootCmd.PersistentFlags().Bool("log-async", false, "Write logs from a background goroutine through a bounded buffer")
+	rootCmd.PersistentFlags().Int("log-buffer", monitor.DEFAULTBUFFERSIZE, "Number of lines the async log buffer holds")
+	rootCmd.PersistentFlags().String("log-overflow", monitor.OverflowBlock, "What to do when the async log buffer is full: block, drop or sample")
+	rootCmd.PersistentFlags().Int("log-sample-rate", monitor.DEFAULTSAMPLERATE, "Keep one line in this many when sampling a nearly full log buffer")
+}
+
+// logConfig builds the logging configuration from the persistent log flags.
+func logConfig(cmd *cobra.Command) monitor.Config {
+	config := monitor.DefaultConfig()
+
+	if level, _ := cmd.Flags().GetString("log-level"); level != "" {
+		config.Level = level
+	}
+	config.Levels, _ = cmd.Flags().GetStringToString("log-levels")
+	config.Sinks, _ = cmd.Flags().GetStringSlice("log-sinks")
+	config.Dir, _ = cmd.Flags().GetString("log-dir")
+	maxSize, _ := cmd.Flags().GetInt64("log-max-size")
+	config.MaxSize = maxSize * 1024 * 1024
+	config.RotateEvery, _ = cmd.Flags().GetDuration("log-rotate-every")
+	config.MaxBackups, _ = cmd.Flags().GetInt("log-max-backups")
+	config.MaxAge, _ = cmd.Flags().GetDuration("log-max-age")
+	config.Compress, _ = cmd.Flags().GetBool("log-compress")
+	config.Async, _ = cmd.Flags().GetBool("log-async")
+	config.BufferSize, _ = cmd.Flags().GetInt("log-buffer")
+	config.Overflow, _ = cmd.Flags().GetString("log-overflow")
+	config.SampleRate, _ = cmd.Flags().GetInt("log-sample-rate")
+
+	return config
+}
+
 func Execute() {
 
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+
+	// Async loggers may still hold lines, write them out before exiting.
+	monitor.Flush()
+
+	if err != nil {
 		log.Fatalln(err)
 		os.Exit(1)
 	}
@@ -2,7 +2,18 @@ package cmd
 
 import (
 	"context"
+	"darkchat/database"
+	"darkchat/health"
+	"darkchat/metrics"
+	"darkchat/monitor"
+	"darkchat/privacy"
+	"darkchat/ratelimit"
 	"darkchat/server"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -12,16 +23,131 @@ var runCmd = &cobra.Command{
 	Short: "Run the server and listen for incoming connections",
 	Long:  "This command starts the server and listens for incoming connections. It takes optional flags for the address and port to listen on.",
 
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 
 		serverAddress, _ := cmd.Flags().GetString("address")
 		serverPort, _ := cmd.Flags().GetString("port")
-		serverctx := context.Background()
+		serverctx, cancel := context.WithCancel(context.Background())
 
-		connectionBuilder := server.ConnectionBuilder{ConnectionType: "tcp", Address: serverAddress, Port: serverPort}
+		defer cancel()
+
+		if privacyMode, _ := cmd.Flags().GetBool("privacy"); privacyMode {
+			logging := logConfig(cmd)
+
+			// Debug is only the default for development, privacy mode starts
+			// at info unless a level was chosen, which Validate then checks.
+			if level, _ := cmd.Flags().GetString("log-level"); level == "" && os.Getenv("LOG_LEVEL") == "" {
+				logging.Level = "INFO"
+			}
+
+			err := privacy.Validate(privacy.Options{
+				LogLevel:  logging.Level,
+				LogLevels: logging.Levels,
+				LogSinks:  logging.Sinks,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			monitor.Configure(logging)
+
+			privacyConfig := privacy.Config{}
+			privacyConfig.Hash, _ = cmd.Flags().GetBool("privacy-hash")
+			privacyConfig.SaltRotation, _ = cmd.Flags().GetDuration("privacy-salt-rotation")
+			privacyConfig.PadBucket, _ = cmd.Flags().GetInt("privacy-pad")
+
+			privacy.Enable(privacyConfig)
+
+			fmt.Fprintln(os.Stderr, privacy.Banner())
+		}
+
+		rateLimit := ratelimit.DefaultConfig()
+		rateLimit.MessageRate, _ = cmd.Flags().GetFloat64("rate-messages")
+		rateLimit.MessageBurst, _ = cmd.Flags().GetInt("rate-messages-burst")
+		rateLimit.ByteRate, _ = cmd.Flags().GetFloat64("rate-bytes")
+		rateLimit.ByteBurst, _ = cmd.Flags().GetInt("rate-bytes-burst")
+		rateLimit.MaxStrikes, _ = cmd.Flags().GetInt("rate-max-strikes")
+		rateLimit.BanDuration, _ = cmd.Flags().GetDuration("rate-ban")
+
+		signalRateLimit := server.DefaultSignalRateLimit()
+		signalRateLimit.MessageRate, _ = cmd.Flags().GetFloat64("rate-signals")
+		signalRateLimit.MessageBurst, _ = cmd.Flags().GetInt("rate-signals-burst")
+
+		connectionBuilder := server.ConnectionBuilder{
+			ConnectionType: "tcp",
+			Address:        serverAddress,
+			Port:           serverPort,
+			RateLimit:      rateLimit,
+		}
+		connectionBuilder.SignalRateLimit = signalRateLimit
+		connectionBuilder.MaxConnections, _ = cmd.Flags().GetInt("max-connections")
+		connectionBuilder.MaxConnectionsPerIP, _ = cmd.Flags().GetInt("max-connections-per-ip")
+		connectionBuilder.HandshakeTimeout, _ = cmd.Flags().GetDuration("handshake-timeout")
+		connectionBuilder.MaxFrameSize, _ = cmd.Flags().GetInt("max-frame-size")
+		connectionBuilder.MaxMessageSize, _ = cmd.Flags().GetInt("max-message-size")
+		connectionBuilder.Allow, _ = cmd.Flags().GetStringSlice("allow")
+		connectionBuilder.Deny, _ = cmd.Flags().GetStringSlice("deny")
+		connectionBuilder.DeliveryTokenTTL, _ = cmd.Flags().GetDuration("delivery-token-ttl")
+		connectionBuilder.SessionGrace, _ = cmd.Flags().GetDuration("session-grace")
+		connectionBuilder.EditWindow, _ = cmd.Flags().GetDuration("edit-window")
+
+		if shapeTraffic, _ := cmd.Flags().GetBool("shape-traffic"); shapeTraffic {
+			connectionBuilder.Traffic.PadBuckets, _ = cmd.Flags().GetIntSlice("pad-buckets")
+			connectionBuilder.Traffic.HeartbeatJitter, _ = cmd.Flags().GetFloat64("heartbeat-jitter")
+			connectionBuilder.Traffic.CoverRate, _ = cmd.Flags().GetFloat64("cover-rate")
+		}
+
+		// A listener that fails shuts the server down the normal way, so
+		// connections are closed and buffered logs written before exiting.
+		listenerErrs := make(chan error, 2)
+
+		if metricsAddress, _ := cmd.Flags().GetString("metrics-address"); metricsAddress != "" {
+			go func() {
+				if err := metrics.Serve(serverctx, metricsAddress); err != nil {
+					listenerErrs <- fmt.Errorf("metrics listener: %w", err)
+					cancel()
+				}
+			}()
+		}
+
+		drainToken, _ := cmd.Flags().GetString("drain-token")
+		if drainToken == "" {
+			drainToken = os.Getenv("DRAIN_TOKEN")
+		}
+
+		if healthAddress, _ := cmd.Flags().GetString("health-address"); healthAddress != "" {
+			go func() {
+				if err := health.Serve(serverctx, healthAddress, drainToken); err != nil {
+					listenerErrs <- fmt.Errorf("health listener: %w", err)
+					cancel()
+				}
+			}()
+		}
+
+		drainDelay, _ := cmd.Flags().GetDuration("drain-delay")
+
+		// On SIGTERM or SIGINT readiness is turned off first, giving load
+		// balancers drainDelay to stop sending clients here before the
+		// listener closes.
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+			<-signals
+			health.SetDraining(true)
+			time.Sleep(drainDelay)
+			cancel()
+		}()
 
 		server.ServerStart(serverctx, connectionBuilder)
 
+		select {
+		case err := <-listenerErrs:
+			return err
+		default:
+			return nil
+		}
 	},
 }
 
@@ -29,4 +155,34 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 	runCmd.Flags().String("address", "localhost", "The address to listen on")
 	runCmd.Flags().String("port", "8080", "The port to listen on")
+	runCmd.Flags().String("health-address", health.DEFAULTADDRESS, "Address to serve /healthz, /readyz and /drain on (disabled when empty)")
+	runCmd.Flags().String("drain-token", "", "Bearer token required by /drain (defaults to DRAIN_TOKEN, without one /drain only answers localhost)")
+	runCmd.Flags().Duration("drain-delay", 5*time.Second, "How long to report not ready before shutting down on SIGTERM")
+	runCmd.Flags().String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. :9090 (disabled when empty)")
+	runCmd.Flags().Int("max-connections", server.DEFAULTMAXCONNECTIONS, "Maximum number of concurrent connections (0 for unlimited)")
+	runCmd.Flags().Int("max-connections-per-ip", server.DEFAULTMAXCONNECTIONSPERIP, "Maximum number of concurrent connections from one IP (0 for unlimited)")
+	runCmd.Flags().Duration("handshake-timeout", server.DEFAULTHANDSHAKETIMEOUT, "How long a new connection may stay silent before it is dropped")
+	runCmd.Flags().Int("max-frame-size", server.DEFAULTMAXFRAMESIZE, "Maximum size of a frame payload in bytes")
+	runCmd.Flags().Int("max-message-size", server.DEFAULTMAXMESSAGESIZE, "Maximum size of a message text in bytes")
+	runCmd.Flags().StringSlice("allow", nil, "IP addresses or CIDRs allowed to connect, added to the shared allow list")
+	runCmd.Flags().StringSlice("deny", nil, "IP addresses or CIDRs refused, added to the shared deny list")
+	runCmd.Flags().Float64("rate-messages", ratelimit.DEFAULTMESSAGERATE, "Messages per second allowed per connection, chat and IP (0 disables)")
+	runCmd.Flags().Int("rate-messages-burst", ratelimit.DEFAULTMESSAGEBURST, "Burst of messages allowed above the message rate")
+	runCmd.Flags().Float64("rate-bytes", ratelimit.DEFAULTBYTERATE, "Bytes per second allowed per connection, chat and IP (0 disables)")
+	runCmd.Flags().Int("rate-bytes-burst", ratelimit.DEFAULTBYTEBURST, "Burst of bytes allowed above the byte rate")
+	runCmd.Flags().Int("rate-max-strikes", ratelimit.DEFAULTMAXSTRIKES, "Throttled messages per minute before a client is disconnected (0 disables)")
+	runCmd.Flags().Duration("rate-ban", ratelimit.DEFAULTBANDURATION, "How long a disconnected client is refused")
+	runCmd.Flags().Float64("rate-signals", server.DEFAULTSIGNALRATE, "Typing indicators and other signals per second allowed per connection (0 disables)")
+	runCmd.Flags().Int("rate-signals-burst", server.DEFAULTSIGNALBURST, "Burst of signals allowed above the signal rate")
+	runCmd.Flags().Duration("delivery-token-ttl", server.DEFAULTDELIVERYTOKENTTL, "Longest lifetime of a sealed sender delivery token")
+	runCmd.Flags().Duration("session-grace", database.DEFAULTSESSIONGRACE, "How long the chat of a dropped session is kept for the client to resume it")
+	runCmd.Flags().Duration("edit-window", database.DEFAULTEDITWINDOW, "How long after sending a message its sender may edit or delete it")
+	runCmd.Flags().Bool("shape-traffic", false, "Pad frames, jitter heartbeats and send cover frames to hide activity on the wire")
+	runCmd.Flags().IntSlice("pad-buckets", server.DEFAULTPADBUCKETS, "Sizes in bytes frames are padded up to when shaping traffic")
+	runCmd.Flags().Float64("heartbeat-jitter", server.DEFAULTHEARTBEATJITTER, "Fraction by which heartbeat intervals vary when shaping traffic")
+	runCmd.Flags().Float64("cover-rate", server.DEFAULTCOVERRATE, "Average cover frames per second per connection when shaping traffic (0 disables)")
+	runCmd.Flags().Bool("privacy", false, "Keep no IP addresses or chat ids in logs and no messages once delivered")
+	runCmd.Flags().Bool("privacy-hash", true, "In privacy mode log salted hashes of identifiers instead of removing them")
+	runCmd.Flags().Duration("privacy-salt-rotation", privacy.DEFAULTSALTROTATION, "How often the salt used to hash identifiers is replaced")
+	runCmd.Flags().Int("privacy-pad", privacy.DEFAULTPADBUCKET, "In privacy mode pad stored entries to a multiple of this many bytes")
 }
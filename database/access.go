@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	AccessPrefix = "access"
+	AllowList    = "allow"
+	DenyList     = "deny"
+	bansKey      = "bans"
+)
+
+// AddAccessEntry adds a normalized IP or CIDR to the named access list
+// (AllowList or DenyList). The lists are shared by every server node.
+func AddAccessEntry(list string, prefix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.SAdd(ctx, fmt.Sprintf("%s:%s", AccessPrefix, list), prefix).Err()
+}
+
+// RemoveAccessEntry removes an IP or CIDR from the named access list.
+func RemoveAccessEntry(list string, prefix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.SRem(ctx, fmt.Sprintf("%s:%s", AccessPrefix, list), prefix).Err()
+}
+
+// AccessEntries returns every entry of the named access list.
+func AccessEntries(list string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.SMembers(ctx, fmt.Sprintf("%s:%s", AccessPrefix, list)).Result()
+}
+
+// BanAddress bans an IP or CIDR for the given duration. Banning an address
+// that is already banned replaces the expiry.
+func BanAddress(prefix string, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.ZAdd(ctx, fmt.Sprintf("%s:%s", AccessPrefix, bansKey), redis.Z{
+		Score:  float64(time.Now().Add(duration).UnixMilli()),
+		Member: prefix,
+	}).Err()
+}
+
+// LiftBan removes a ban before it expires.
+func LiftBan(prefix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.ZRem(ctx, fmt.Sprintf("%s:%s", AccessPrefix, bansKey), prefix).Err()
+}
+
+// ActiveBans returns every ban that has not expired yet, keyed by IP or CIDR,
+// with its expiry time. Expired bans are removed from the store on the way.
+func ActiveBans() (map[string]time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	key := fmt.Sprintf("%s:%s", AccessPrefix, bansKey)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	if err := redisClient.ZRemRangeByScore(ctx, key, "-inf", now).Err(); err != nil {
+		return nil, err
+	}
+
+	entries, err := redisClient.ZRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	bans := make(map[string]time.Time, len(entries))
+
+	for _, entry := range entries {
+		prefix, ok := entry.Member.(string)
+		if !ok {
+			continue
+		}
+		bans[prefix] = time.UnixMilli(int64(entry.Score))
+	}
+	return bans, nil
+}
@@ -2,15 +2,17 @@ package database
 
 import (
 	"context"
+	"darkchat/metrics"
 	"darkchat/monitor"
+	"darkchat/privacy"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
-	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
 )
@@ -25,10 +27,76 @@ const (
 	ConsumerNamePrefix = "consumer"
 )
 
+// Kinds of entries stored in a chat stream.
+const (
+	KindMessage = "message"
+	KindError   = "error"
+	KindEvent   = "event"
+)
+
+// Delivery is a message read from a chat stream together with the id the
+// stream assigned to it. The id is included in the frame sent to the client
+// so it can refer to the message later, clients that do not know about it
+// ignore the extra field. Expires is when a disappearing message expires, in
+// unix milliseconds, so clients can remove it locally too. String returns
+// the message without the extra fields so it compares equal to what was
+// posted.
+type Delivery struct {
+	protocol.Message
+	ID      string `json:"id"`
+	Expires int64  `json:"expires,omitempty"`
+
+	// ReplyTo and Thread are set on replies: the message replied to and the
+	// first message of the thread. Quote is an excerpt of the message
+	// replied to, as it reads when the reply is delivered.
+	ReplyTo *MessageRef `json:"reply_to,omitempty"`
+	Thread  *MessageRef `json:"thread,omitempty"`
+	Quote   string      `json:"quote,omitempty"`
+
+	stream string
+	posted time.Time
+}
+
+// Posted returns when the message was posted to the chat stream. It reports
+// false when that is not known, as in privacy mode where it is not stored.
+func (d *Delivery) Posted() (time.Time, bool) {
+	return d.posted, !d.posted.IsZero()
+}
+
+// Byte returns the JSON encoding of the message including its id.
+func (d *Delivery) Byte() []byte {
+	b, _ := json.Marshal(d)
+	return b
+}
+
+// Event is a notification for a client that is not a chat message, such as a
+// relayed ciphertext envelope. It is sent to the client as a control frame.
+// ID is the stream id of the entry it was read from and Expires, as for a
+// Delivery, when it disappears.
+type Event struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	Expires int64           `json:"expires,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+
+	stream string
+}
+
+// Byte returns the JSON encoding of the event.
+func (e *Event) Byte() []byte {
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// String returns the JSON encoding of the event as a string.
+func (e *Event) String() string {
+	return string(e.Byte())
+}
+
 // init loads the .env file, sets up a Redis client with the specified host and port from
 // the environment variables REDIS_HOST and REDIS_PORT. If these variables are not set,
-// the client defaults to localhost:6379. The function logs an error if there is an error
-// loading the .env file, and logs the result of the Redis PING command.
+// the client defaults to localhost:6379. The function prints an error if there is an error
+// loading the .env file. Whether Redis answers is logged by CheckConnection.
 func init() {
 
 	err := godotenv.Load()
@@ -51,15 +119,22 @@ func init() {
 		DB:       0,
 	})
 
-	databaseMonitor = monitor.New("database.log")
+	redisClient.AddHook(metricsHook{})
 
-	_, err = redisClient.Ping(context.Background()).Result()
+	databaseMonitor = monitor.New("database.log")
+}
 
-	if err != nil {
+// CheckConnection pings Redis and logs whether it answered. It is called once
+// the logging configuration is applied, rather than from init, so the line
+// goes where the configuration says.
+func CheckConnection(ctx context.Context) error {
+	if err := Ping(ctx); err != nil {
 		databaseMonitor.Error(err.Error())
+		return err
 	}
 
 	databaseMonitor.Info("Connected to Redis")
+	return nil
 }
 
 // RegisterClientChat creates a Redis Stream and Consumer Group for the given chatId
@@ -81,7 +156,7 @@ func RegisterClientChat(chatId string) error {
 	).Err()
 
 	if err != nil && strings.Contains(err.Error(), "BUSYGROUP Consumer Group name already exists") {
-		databaseMonitor.Info(fmt.Sprintf("Stream already exists: %s", chatId))
+		databaseMonitor.Info("Stream already exists", monitor.F(monitor.KeyChatID, chatId))
 		return err
 	}
 
@@ -132,7 +207,8 @@ func DeleteClientChat(chatId string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return deleteChatKeys(ctx, chatId)
 }
 
 // StreamChat reads messages from Redis streams and sends them to the given channel. It subscribes to
@@ -140,7 +216,12 @@ func DeleteClientChat(chatId string) error {
 // returns. If there is an error communicating with Redis, the error is logged to the database log.
 // The function will continue to run until the subscribe channel is closed or there is an error
 // communicating with Redis. The function times out after 100 milliseconds if there are no messages
-// in any of the streams.
+// in any of the streams. Log lines carry the connection id found in the context.
+//
+// Messages and events stay pending in the chat's consumer group until they
+// are passed to Acknowledge, and the consumer is named after the chat, so a
+// later StreamChat for the same chat first replays whatever an earlier one
+// read but never acknowledged. Error frames are acknowledged straight away.
 func StreamChat(ctx context.Context, chatChannel chan<- protocol.Payload, subscribe <-chan string, chatId string) {
 	databaseCTX, cancel := context.WithCancel(context.Background())
 	defer func() {
@@ -148,17 +229,25 @@ func StreamChat(ctx context.Context, chatChannel chan<- protocol.Payload, subscr
 		cancel()
 	}()
 
-	activeStreams := make(map[string]bool)
-	consumerName := fmt.Sprintf("%s:%s", ConsumerNamePrefix, uuid.NewString())
+	// activeStreams maps each stream to the id to read from: the last
+	// pending entry replayed, starting at "0", until the replay is done and
+	// it becomes ">" for new entries.
+	activeStreams := make(map[string]string)
+	consumerName := fmt.Sprintf("%s:%s", ConsumerNamePrefix, chatId)
 	groupName := fmt.Sprintf("%s:%s", GroupNamePrefix, chatId)
+	logger := databaseMonitor.Ctx(ctx).With(monitor.F(monitor.KeyChatID, chatId))
 
 	for {
 
 		select {
-		case newSub := <-subscribe:
+		case newSub, ok := <-subscribe:
+			if !ok {
+				return
+			}
+
 			streamName := fmt.Sprintf("%s:%s", StreamNamePrefix, newSub)
-			if !activeStreams[streamName] {
-				activeStreams[streamName] = true
+			if _, active := activeStreams[streamName]; !active {
+				activeStreams[streamName] = "0"
 			}
 
 		case <-ctx.Done():
@@ -167,9 +256,11 @@ func StreamChat(ctx context.Context, chatChannel chan<- protocol.Payload, subscr
 		default:
 
 			streams := make([]string, 0, len(activeStreams))
+			ids := make([]string, 0, len(activeStreams))
 
-			for stream := range activeStreams {
-				streams = append(streams, stream, ">")
+			for stream, id := range activeStreams {
+				streams = append(streams, stream)
+				ids = append(ids, id)
 			}
 
 			if len(streams) == 0 {
@@ -180,72 +271,356 @@ func StreamChat(ctx context.Context, chatChannel chan<- protocol.Payload, subscr
 			args := &redis.XReadGroupArgs{
 				Group:    groupName,
 				Consumer: consumerName,
-				Streams:  streams,
+				Streams:  append(streams, ids...),
+				Count:    1,
 				Block:    100 * time.Millisecond,
 			}
 
 			result, err := redisClient.XReadGroup(databaseCTX, args).Result()
 
-			if err != nil && err != redis.Nil {
-				databaseMonitor.Error(err.Error())
-				continue
+			if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+				// The group was destroyed under us: the chat was deleted or
+				// the device reading it was revoked.
+				logger.Warning("Consumer group is gone", monitor.F(monitor.KeyError, err))
+				return
 			}
-			if len(result) == 0 || len(result[0].Messages) == 0 {
+
+			if err != nil && err != redis.Nil {
+				logger.Error(err.Error())
 				continue
 			}
 
-			messageString, ok := result[0].Messages[0].Values["message"].(string)
-			if !ok {
-				databaseMonitor.Error("Expected message to be a string")
-				continue
+			// Every stream with something to read comes back, each with up
+			// to Count entries.
+			for _, stream := range result {
+				// Reading pending entries returns the stream with nothing
+				// in it once the replay is over.
+				if len(stream.Messages) == 0 {
+					activeStreams[stream.Stream] = ">"
+					continue
+				}
+
+				for _, entry := range stream.Messages {
+					if activeStreams[stream.Stream] != ">" {
+						activeStreams[stream.Stream] = entry.ID
+					}
+
+					payload, ok := readEntry(stream.Stream, entry, logger)
+
+					if !ok {
+						// Entries that cannot be delivered would otherwise
+						// be replayed forever.
+						Acknowledge(databaseCTX, chatId, &Delivery{ID: entry.ID, stream: stream.Stream})
+						continue
+					}
+
+					metrics.OutboundQueue.Inc()
+
+					chatChannel <- payload
+
+					if _, isError := payload.(*protocol.Error_); isError {
+						Acknowledge(databaseCTX, chatId, &Delivery{ID: entry.ID, stream: stream.Stream})
+					}
+				}
 			}
+		}
+	}
 
-			var message protocol.Message
+}
 
-			err = json.Unmarshal([]byte(messageString), &message)
-			if err != nil {
-				databaseMonitor.Error(err.Error())
-				continue
-			}
+// readEntry turns a stream entry into the payload sent to the client. It
+// returns false for entries that must not be delivered: malformed ones and
+// disappearing messages that expired before they could be read.
+func readEntry(stream string, entry redis.XMessage, logger *monitor.Monitor) (protocol.Payload, bool) {
+	messageString, ok := entry.Values["message"].(string)
+	if !ok {
+		logger.Error("Expected message to be a string", monitor.F(monitor.KeyMessageID, entry.ID))
+		return nil, false
+	}
 
-			chatChannel <- &message
+	expires, expired := entryExpiry(entry.Values, time.Now())
+	if expired {
+		return nil, false
+	}
 
-			err = redisClient.XAck(databaseCTX,
-				result[0].Stream,
-				fmt.Sprintf("%s:%s", GroupNamePrefix, chatId),
-				result[0].Messages[0].ID).Err()
+	switch kind, _ := entry.Values["kind"].(string); kind {
+	case KindError:
+		e := protocol.Error_(messageString)
+		return &e, true
 
-			if err != nil {
-				databaseMonitor.Error(err.Error())
-				return
+	case KindEvent:
+		var event Event
+
+		if err := json.Unmarshal([]byte(messageString), &event); err != nil {
+			logger.Error(err.Error())
+			return nil, false
+		}
+		event.ID = entry.ID
+		event.Expires = expires
+		event.stream = stream
+
+		return &event, true
+
+	default:
+		var message protocol.Message
+
+		if err := json.Unmarshal([]byte(messageString), &message); err != nil {
+			logger.Error(err.Error())
+			return nil, false
+		}
+
+		if message.To == "" {
+			message.To = strings.TrimPrefix(stream, StreamNamePrefix+":")
+		}
+
+		delivery := &Delivery{Message: message, ID: entry.ID, Expires: expires, stream: stream}
+
+		if posted, ok := entry.Values["posted"].(string); ok {
+			if nanos, err := strconv.ParseInt(posted, 10, 64); err == nil {
+				delivery.posted = time.Unix(0, nanos)
 			}
+		}
+
+		var quoted bool
+		delivery.ReplyTo, delivery.Thread, quoted = entryReply(entry.Values)
 
+		if quoted {
+			if referenced, err := LoadReference(*delivery.ReplyTo); err == nil {
+				delivery.Quote = referenced.Excerpt()
+			}
 		}
+
+		return delivery, true
+	}
+}
+
+// Acknowledge marks a message or event read by StreamChat as delivered, so
+// it is not replayed. In privacy mode it is also deleted once every consumer
+// group of the stream has delivered it, nothing is kept once it has been
+// delivered to each device. Other payloads are ignored.
+func Acknowledge(ctx context.Context, chatId string, payload protocol.Payload) error {
+	var stream, id string
+
+	switch p := payload.(type) {
+	case *Delivery:
+		stream, id = p.stream, p.ID
+	case *Event:
+		stream, id = p.stream, p.ID
+	}
+
+	if stream == "" || id == "" {
+		return nil
+	}
+
+	err := redisClient.XAck(ctx, stream, fmt.Sprintf("%s:%s", GroupNamePrefix, chatId), id).Err()
+	if err != nil {
+		return err
 	}
 
+	if privacy.Enabled() {
+		return deleteDeliveredScript.Run(ctx, redisClient, []string{stream}, id).Err()
+	}
+	return nil
 }
 
-// PostToChat sends a message to a Redis Stream identified by the given chatId.
-// If an error occurs while communicating with Redis, the error is returned.
+// deleteDeliveredScript deletes an entry from a stream unless one of its
+// consumer groups has yet to read it or has it pending.
+var deleteDeliveredScript = redis.NewScript(`
+local function before(a, b)
+	local ams, aseq = string.match(a, '(%d+)-(%d+)')
+	local bms, bseq = string.match(b, '(%d+)-(%d+)')
+	if tonumber(ams) ~= tonumber(bms) then
+		return tonumber(ams) < tonumber(bms)
+	end
+	return tonumber(aseq) < tonumber(bseq)
+end
+
+for _, group in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+	local info = {}
+	for i = 1, #group, 2 do
+		info[group[i]] = group[i + 1]
+	end
+
+	if before(info['last-delivered-id'], ARGV[1]) then
+		return 0
+	end
+
+	if #redis.call('XPENDING', KEYS[1], info['name'], ARGV[1], ARGV[1], 1) > 0 then
+		return 0
+	end
+end
+
+return redis.call('XDEL', KEYS[1], ARGV[1])
+`)
+
+// PostToChat sends a message to a Redis Stream identified by the given chatId
+// and returns the id the stream assigned to it, which doubles as the message
+// id. If an error occurs while communicating with Redis, the error is returned.
 // If the timeout (5 seconds) is exceeded, the context is canceled and an error is returned.
-// If the message is successfully sent, the function returns nil.
-func PostToChat(message string, chatId string) error {
+func PostToChat(message string, chatId string) (string, error) {
+	return PostToChatContext(context.Background(), message, chatId, 0)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// PostToChatContext is PostToChat for a caller handling a client connection,
+// with a time to live after which the message is removed whether or not it
+// was delivered. Zero keeps it until it is delivered or the chat is closed.
+// Failures are logged with the connection id carried by the context.
+func PostToChatContext(ctx context.Context, message string, chatId string, ttl time.Duration) (string, error) {
+	return postEntry(ctx, KindMessage, message, chatId, ttl, nil)
+}
+
+// PostMessage is PostToChatContext for a message sent by a connection. The
+// chat it came from is recorded with it, which is what allows the sender,
+// and nobody else, to edit or delete it later.
+func PostMessage(ctx context.Context, message string, sender string, chatId string, ttl time.Duration) (string, error) {
+	return postEntry(ctx, KindMessage, message, chatId, ttl, map[string]interface{}{"sender": sender})
+}
+
+// PostEvent queues an event for delivery to the given chat, with a time to
+// live as for PostToChatContext. The body is encoded to JSON and passed to
+// the client as it is.
+func PostEvent(ctx context.Context, op string, body interface{}, chatId string, ttl time.Duration) (string, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	event, err := json.Marshal(&Event{Op: op, Body: encoded})
+	if err != nil {
+		return "", err
+	}
+	return postEntry(ctx, KindEvent, string(event), chatId, ttl, nil)
+}
+
+// PostErrorToChat queues an error frame text for delivery to the given chat,
+// used to relay errors reported by one client back to another.
+func PostErrorToChat(ctx context.Context, text string, chatId string) (string, error) {
+	return postEntry(ctx, KindError, text, chatId, 0, nil)
+}
+
+// postEntry adds an entry to a chat stream. Extra holds the values stored
+// along with the entry, such as who sent it.
+func postEntry(parent context.Context, kind string, message string, chatId string, ttl time.Duration, extra map[string]interface{}) (string, error) {
+
+	ctx, cancel := context.WithTimeout(parent, 30*time.Second)
 
 	defer cancel()
 
-	_, err := redisClient.XAdd(ctx, &redis.XAddArgs{
-		Stream: fmt.Sprintf("%s:%s", StreamNamePrefix, chatId),
-		Values: map[string]interface{}{
-			"message": message,
-		},
+	now := time.Now()
+
+	values := map[string]interface{}{
+		"kind":    kind,
+		"message": message,
+	}
+
+	if ttl > 0 {
+		values["expires"] = now.Add(ttl).UnixMilli()
+	}
+
+	for key, value := range extra {
+		values[key] = value
+	}
+
+	// In privacy mode nothing links the two parties: the sender, the
+	// recipient, which the stream already names, and the time the message was
+	// sent are left out, and entries are padded so their size does not give
+	// away the length of the message.
+	if privacy.Enabled() {
+		if kind == KindMessage {
+			values["message"] = withoutParties(message)
+			delete(values, "sender")
+		}
+		values["pad"] = privacy.Padding(len(values["message"].(string)))
+	} else {
+		values["posted"] = now.UnixNano()
+	}
+
+	stream := fmt.Sprintf("%s:%s", StreamNamePrefix, chatId)
+
+	id, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: values,
 	}).Result()
 
 	if err != nil {
-		return err
+		databaseMonitor.Ctx(parent).Error("Posting to chat failed", monitor.F(monitor.KeyChatID, chatId), monitor.F(monitor.KeyError, err))
+		return "", err
 	}
-	return nil
+
+	// An entry that is never scheduled is still not delivered once it has
+	// expired, it only stays in the stream until the chat is closed.
+	if expires, ok := values["expires"].(int64); ok {
+		if err := scheduleExpiry(ctx, stream, id, expires); err != nil {
+			databaseMonitor.Ctx(parent).Error("Scheduling expiry failed", monitor.F(monitor.KeyChatID, chatId), monitor.F(monitor.KeyError, err))
+		}
+	}
+
+	// Messages with a known sender count towards the conversation list and
+	// the recipient's unread messages. Privacy mode keeps no record of who
+	// talks to whom.
+	if sender, ok := values["sender"].(string); ok && kind == KindMessage && !privacy.Enabled() {
+		expires, _ := values["expires"].(int64)
+
+		if err := trackConversation(ctx, sender, chatId, id, expires); err != nil {
+			databaseMonitor.Ctx(parent).Error("Tracking conversation failed", monitor.F(monitor.KeyChatID, chatId), monitor.F(monitor.KeyError, err))
+		}
+	}
+	return id, nil
+}
+
+// withoutParties returns the message with its sender and recipient removed,
+// or the message unchanged if it cannot be decoded.
+func withoutParties(messageString string) string {
+	var message protocol.Message
+
+	if err := json.Unmarshal([]byte(messageString), &message); err != nil {
+		return messageString
+	}
+	message.From = ""
+	message.To = ""
+
+	b, err := json.Marshal(&message)
+	if err != nil {
+		return messageString
+	}
+	return string(b)
+}
+
+// MessageSender looks up a message delivered to the given chat by its id and
+// returns the chat id of whoever sent it, as recorded by the server, never
+// the From the sender wrote into the message. Only the recipient's own stream
+// is searched, so a client can only learn about messages it received.
+// Expired messages and messages with no recorded sender are not found.
+func MessageSender(chatId string, messageID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	entries, err := redisClient.XRange(
+		ctx,
+		fmt.Sprintf("%s:%s", StreamNamePrefix, chatId),
+		messageID,
+		messageID,
+	).Result()
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) == 0 {
+		return "", fmt.Errorf("message %s not found", messageID)
+	}
+
+	sender, ok := entries[0].Values["sender"].(string)
+
+	if _, expired := entryExpiry(entries[0].Values, time.Now()); expired {
+		ok = false
+	}
+
+	if !ok || sender == "" || entries[0].Values["kind"] != KindMessage {
+		return "", fmt.Errorf("message %s not found", messageID)
+	}
+	return sender, nil
 }
 
 // CheckChatExists returns true if the given chatId exists in the Redis set "chats",
@@ -270,3 +645,8 @@ func CheckChatExists(chatId string) bool {
 	return result
 
 }
+
+// Ping checks that Redis is reachable.
+func Ping(ctx context.Context) error {
+	return redisClient.Ping(ctx).Err()
+}
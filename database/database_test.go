@@ -2,8 +2,12 @@ package database
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
 	"github.com/google/uuid"
@@ -124,3 +128,904 @@ func TestStreamChat(t *testing.T) {
 	}
 	cancel()
 }
+
+// TestMessageSender posts a message to a chat and checks that the id returned
+// by PostToChat can be used by the recipient to look up the sender.
+func TestMessageSender(t *testing.T) {
+	ctx := context.Background()
+	sender := uuid.NewString()
+	recipient := uuid.NewString()
+
+	RegisterClientChat(recipient)
+
+	defer DeleteClientChat(recipient)
+
+	payload := protocol.Message{
+		Message: "Hello, world",
+		From:    sender,
+		To:      recipient,
+	}
+
+	id, err := PostMessage(ctx, payload.String(), sender, recipient, 0)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	from, err := MessageSender(recipient, id)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if from != sender {
+		t.Errorf("Expected sender %s, got %s", sender, from)
+	}
+
+	if _, err := MessageSender(sender, id); err == nil {
+		t.Error("Expected an error looking the message up in another chat")
+	}
+
+	// A From naming another chat is not who sent the message.
+	victim := uuid.NewString()
+	payload.From = victim
+
+	forged, err := PostMessage(ctx, payload.String(), sender, recipient, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if from, _ := MessageSender(recipient, forged); from != sender {
+		t.Errorf("Expected sender %s, got %s", sender, from)
+	}
+
+	unknown, err := PostToChat(payload.String(), recipient)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if from, err := MessageSender(recipient, unknown); err == nil {
+		t.Errorf("Expected a message with no recorded sender not to be found, got %s", from)
+	}
+}
+
+// TestKeyDirectory publishes keys for an identity and checks that fetching
+// the bundle hands out each one-time prekey once, that a replayed upload is
+// refused and that unbinding only applies to the chat the keys came from.
+func TestKeyDirectory(t *testing.T) {
+	identity := uuid.NewString()
+	chatId := uuid.NewString()
+	now := time.Now().UnixMilli()
+
+	defer redisClient.Del(context.Background(), fmt.Sprintf("%s:%s", KeysPrefix, identity), fmt.Sprintf("%s:%s", PrekeysPrefix, identity))
+
+	signed := SignedPrekey{ID: 1, Key: []byte("signed"), Signature: []byte("signature")}
+	prekeys := []Prekey{{ID: 1, Key: []byte("one")}, {ID: 2, Key: []byte("two")}}
+
+	if err := PublishKeys(identity, []byte("identity"), signed, prekeys, chatId, now); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := PublishKeys(identity, []byte("identity"), signed, prekeys, chatId, now); err != ErrStaleKeys {
+		t.Errorf("Expected %v, got %v", ErrStaleKeys, err)
+	}
+
+	seen := make(map[uint32]bool)
+
+	for i := 0; i < 3; i++ {
+		bundle, err := FetchKeyBundle(identity)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if string(bundle.IdentityKey) != "identity" || bundle.ChatID != chatId {
+			t.Errorf("Unexpected bundle %+v", bundle)
+		}
+
+		if bundle.OneTimePrekey == nil {
+			if i < 2 {
+				t.Errorf("Expected a one-time prekey on fetch %d", i)
+			}
+			continue
+		}
+
+		if seen[bundle.OneTimePrekey.ID] {
+			t.Errorf("Expected prekey %d to be handed out once", bundle.OneTimePrekey.ID)
+		}
+		seen[bundle.OneTimePrekey.ID] = true
+	}
+
+	if err := UnbindIdentity(identity, uuid.NewString()); err != ErrNotBound {
+		t.Errorf("Expected %v, got %v", ErrNotBound, err)
+	}
+
+	if err := UnbindIdentity(identity, chatId); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if _, err := FetchKeyBundle(uuid.NewString()); err != ErrNoKeys {
+		t.Errorf("Expected %v, got %v", ErrNoKeys, err)
+	}
+}
+
+// TestDeliveryTokens issues a token and checks that it resolves to the chat
+// it was issued for, can only be revoked by that chat and is gone afterwards.
+func TestDeliveryTokens(t *testing.T) {
+	chatId := uuid.NewString()
+
+	token, err := IssueDeliveryToken(chatId, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if got, err := RedeemDeliveryToken(token); err != nil || got != chatId {
+		t.Errorf("Expected %s, got %s (%v)", chatId, got, err)
+	}
+
+	if err := RevokeDeliveryToken(token, uuid.NewString()); err != ErrUnknownToken {
+		t.Errorf("Expected %v, got %v", ErrUnknownToken, err)
+	}
+
+	if err := RevokeDeliveryToken(token, chatId); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if _, err := RedeemDeliveryToken(token); err != ErrUnknownToken {
+		t.Errorf("Expected %v, got %v", ErrUnknownToken, err)
+	}
+}
+
+// TestDisappearingMessages sets timers on both sides of a conversation and
+// checks the shorter one applies, that an expired message is not delivered
+// and that the reaper removes it from the stream.
+func TestDisappearingMessages(t *testing.T) {
+	sender := uuid.NewString()
+	recipient := uuid.NewString()
+
+	RegisterClientChat(recipient)
+
+	defer DeleteClientChat(recipient)
+	defer SetTimer(sender, recipient, 0)
+
+	if err := SetTimer(sender, recipient, time.Hour); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := SetTimer(recipient, "", time.Minute); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if ttl, err := ConversationTTL(sender, recipient); err != nil || ttl != time.Minute {
+		t.Errorf("Expected %v, got %v (%v)", time.Minute, ttl, err)
+	}
+
+	if err := SetTimer(sender, recipient, MaxTTL+time.Second); err == nil {
+		t.Error("Expected a timer above the maximum to be refused")
+	}
+
+	payload := protocol.Message{Message: "gone soon", From: sender, To: recipient}
+
+	id, err := PostToChatContext(context.Background(), payload.String(), recipient, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := MessageSender(recipient, id); err == nil {
+		t.Error("Expected an expired message not to be found")
+	}
+
+	if _, err := reapExpired(context.Background(), time.Now()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	entries, err := redisClient.XRange(context.Background(), fmt.Sprintf("%s:%s", StreamNamePrefix, recipient), id, id).Result()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected the entry to be reaped, got %v (%v)", entries, err)
+	}
+}
+
+// TestSessionResume takes a session over from its connection, detaches it
+// and checks that it can be resumed with its state, and that a session past
+// its grace period is swept along with its chat.
+func TestSessionResume(t *testing.T) {
+	chatId := uuid.NewString()
+
+	RegisterClientChat(chatId)
+
+	token, err := CreateSession(chatId, "first")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	defer EndSession(token)
+
+	if _, previous, err := ResumeSession(token, "second"); err != nil || previous != "first" {
+		t.Errorf("Expected to take over from %v, got %v (%v)", "first", previous, err)
+	}
+
+	state := Session{ChatID: chatId, Identity: "identity", Device: "device", Present: "identity"}
+
+	if err := DetachSession(token, "first", state, time.Minute); err != ErrSessionTakenOver {
+		t.Errorf("Expected %v, got %v", ErrSessionTakenOver, err)
+	}
+
+	if err := SaveSession(token, "second", state); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := DetachSession(token, "second", state, time.Minute); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	session, previous, err := ResumeSession(token, "third")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if session != state || previous != "" {
+		t.Errorf("Expected %+v from a detached session, got %+v from %q", state, session, previous)
+	}
+
+	if err := DetachSession(token, "third", state, -time.Second); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := sweepSessions(context.Background(), time.Now(), time.Minute); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, _, err := ResumeSession(token, "fourth"); err != ErrUnknownSession {
+		t.Errorf("Expected %v, got %v", ErrUnknownSession, err)
+	}
+
+	if CheckChatExists(chatId) {
+		t.Error("Expected the chat of the swept session to be deleted")
+	}
+}
+
+// TestSessionLease checks that a session whose connection stopped renewing
+// its lease is detached by the sweep, stays resumable for the grace period
+// and is swept along with its chat after it.
+func TestSessionLease(t *testing.T) {
+	chatId := uuid.NewString()
+
+	RegisterClientChat(chatId)
+
+	token, err := CreateSession(chatId, "crashed")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	defer EndSession(token)
+
+	if err := RenewSession(token, "crashed"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := RenewSession(token, "other"); err != ErrSessionTakenOver {
+		t.Errorf("Expected %v, got %v", ErrSessionTakenOver, err)
+	}
+
+	lapsed := time.Now().Add(SessionLease + time.Second)
+
+	if err := sweepSessions(context.Background(), lapsed, time.Minute); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !CheckChatExists(chatId) {
+		t.Fatal("Expected the chat to be kept for the grace period")
+	}
+
+	if err := RenewSession(token, "crashed"); err != ErrSessionTakenOver {
+		t.Errorf("Expected the lapsed session to be detached, got %v", err)
+	}
+
+	if err := sweepSessions(context.Background(), lapsed.Add(2*time.Minute), time.Minute); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if CheckChatExists(chatId) {
+		t.Error("Expected the chat of the lapsed session to be deleted")
+	}
+}
+
+// TestStreamChatReplay reads a message without acknowledging it and checks
+// that the next StreamChat for the chat delivers it again.
+func TestStreamChatReplay(t *testing.T) {
+	chatId := uuid.NewString()
+
+	RegisterClientChat(chatId)
+
+	defer DeleteClientChat(chatId)
+
+	payload := protocol.Message{Message: "again", From: chatId, To: chatId}
+	PostToChat(payload.String(), chatId)
+
+	for i := 0; i < 2; i++ {
+		received := make(chan protocol.Payload, 1)
+		subscribe := make(chan string, 1)
+		subscribe <- chatId
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		go StreamChat(ctx, received, subscribe, chatId)
+
+		select {
+		case p := <-received:
+			if p.String() != payload.String() {
+				t.Errorf("Expected %s, got %s", payload.String(), p.String())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the message on read %d", i+1)
+		}
+
+		cancel()
+	}
+}
+
+// TestDevices links two devices to an identity and checks that each gets
+// events posted to the identity through its own consumer group, from the
+// time it was linked rather than when it first authenticated, and that a
+// revoked device is gone from the list and cannot be linked again.
+func TestDevices(t *testing.T) {
+	identity := uuid.NewString()
+	ctx := context.Background()
+
+	defer redisClient.Del(ctx, devicesKey(identity), revokedKey(identity), fmt.Sprintf("%s:%s", StreamNamePrefix, IdentityChat(identity)))
+
+	for i, id := range []string{"phone", "laptop"} {
+		device := Device{ID: id, Key: []byte(id), Name: id, Added: int64(i)}
+
+		if err := LinkDevice(identity, device); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if !HasDevices(identity) {
+		t.Error("Expected the identity to have devices")
+	}
+
+	if _, err := PostEventToIdentity(ctx, "envelope", map[string]string{"hello": "world"}, identity, 0); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, id := range []string{"phone", "laptop"} {
+		if err := AttachDevice(identity, id); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	for _, id := range []string{"phone", "laptop"} {
+		received := make(chan protocol.Payload, 1)
+		subscribe := make(chan string, 1)
+		subscribe <- IdentityChat(identity)
+
+		readCtx, cancel := context.WithCancel(ctx)
+
+		go StreamChat(readCtx, received, subscribe, DeviceReader(identity, id))
+
+		select {
+		case p := <-received:
+			if event, ok := p.(*Event); !ok || event.Op != "envelope" {
+				t.Errorf("Expected an envelope event on %s, got %v", id, p)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Expected the event on %s", id)
+		}
+
+		cancel()
+	}
+
+	if err := RevokeDevice(identity, "phone"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	devices, err := Devices(identity)
+	if err != nil || len(devices) != 1 || devices[0].ID != "laptop" {
+		t.Errorf("Expected only the laptop, got %v (%v)", devices, err)
+	}
+
+	if err := LinkDevice(identity, Device{ID: "phone", Key: []byte("phone")}); err != ErrRevokedDevice {
+		t.Errorf("Expected %v, got %v", ErrRevokedDevice, err)
+	}
+
+	if _, err := GetDevice(identity, "phone"); err != ErrRevokedDevice {
+		t.Errorf("Expected %v, got %v", ErrRevokedDevice, err)
+	}
+}
+
+// TestPresenceView checks what viewers see of a presence under each
+// visibility, and that invisible shows as offline to everyone but its owner.
+func TestPresenceView(t *testing.T) {
+	record := presenceRecord{
+		identity:   "owner",
+		state:      PresenceBusy,
+		visibility: VisibleContacts,
+		lastSeen:   42,
+		online:     true,
+		allowed:    map[string]bool{"friend": true},
+	}
+
+	if p := record.view("friend"); p.State != PresenceBusy {
+		t.Errorf("Expected %s, got %+v", PresenceBusy, p)
+	}
+
+	if p := record.view("stranger"); p.State != PresenceOffline || p.LastSeen != 0 {
+		t.Errorf("Expected offline without last seen, got %+v", p)
+	}
+
+	record.state = PresenceInvisible
+
+	if p := record.view("friend"); p.State != PresenceOffline || p.LastSeen != 42 {
+		t.Errorf("Expected offline last seen at 42, got %+v", p)
+	}
+
+	if p := record.view("owner"); p.State != PresenceInvisible {
+		t.Errorf("Expected %s, got %+v", PresenceInvisible, p)
+	}
+
+	record.visibility = VisibleNobody
+
+	if p := record.view("friend"); p.State != PresenceOffline || p.LastSeen != 0 {
+		t.Errorf("Expected offline without last seen, got %+v", p)
+	}
+}
+
+// TestPresence sets an identity's presence from a connection, checks a
+// watching chat is told about it, and that the identity goes offline with a
+// last-seen time once its connection leaves.
+func TestPresence(t *testing.T) {
+	identity := uuid.NewString()
+	watcher := uuid.NewString()
+
+	RegisterClientChat(watcher)
+
+	defer DeleteClientChat(watcher)
+	defer redisClient.Del(context.Background(), presenceKey(identity), presenceConnsKey(identity), presenceWatchersKey(identity))
+
+	if err := SetPresence(identity, "conn", PresenceAway); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if p, err := GetPresence(identity, ""); err != nil || p.State != PresenceAway {
+		t.Errorf("Expected %s, got %+v (%v)", PresenceAway, p, err)
+	}
+
+	if err := WatchPresence(identity, watcher, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	offline, err := LeavePresence(identity, "conn")
+	if err != nil || !offline {
+		t.Fatalf("Expected to go offline, got %v (%v)", offline, err)
+	}
+
+	if err := NotifyPresence(context.Background(), identity); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	entries, err := redisClient.XRange(context.Background(), fmt.Sprintf("%s:%s", StreamNamePrefix, watcher), "-", "+").Result()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one presence event, got %v (%v)", entries, err)
+	}
+
+	p, err := GetPresence(identity, "")
+	if err != nil || p.State != PresenceOffline || p.LastSeen == 0 {
+		t.Errorf("Expected offline with a last seen time, got %+v (%v)", p, err)
+	}
+}
+
+// TestCompareIDs checks that stream ids are ordered by time, then sequence.
+func TestCompareIDs(t *testing.T) {
+	if compareIDs("10-0", "9-5") != 1 || compareIDs("10-1", "10-2") != -1 || compareIDs("10-1", "10-1") != 0 {
+		t.Error("Expected stream ids to compare by time, then sequence")
+	}
+
+	if inPage("10-0", "10-0", "") || !inPage("9-0", "10-0", "") || inPage("5-0", "10-0", "6-0") {
+		t.Error("Expected tombstones to be placed between before and the oldest entry read")
+	}
+}
+
+// TestEditAndDelete edits a message twice and checks history returns its
+// latest version with its revisions, that only its sender may change it and
+// only within the window, and that a deleted message leaves a tombstone.
+func TestEditAndDelete(t *testing.T) {
+	sender := uuid.NewString()
+	recipient := uuid.NewString()
+
+	RegisterClientChat(recipient)
+
+	defer DeleteClientChat(recipient)
+
+	payload := protocol.Message{Message: "first", From: sender, To: recipient}
+
+	id, err := PostMessage(context.Background(), payload.String(), sender, recipient, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	now := time.Now()
+
+	for _, text := range []string{"second", "third"} {
+		if _, err := EditMessage(recipient, id, sender, text, time.Minute, now); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if _, err := EditMessage(recipient, id, uuid.NewString(), "forged", time.Minute, now); err != ErrNotSender {
+		t.Errorf("Expected %v, got %v", ErrNotSender, err)
+	}
+
+	if _, err := EditMessage(recipient, id, sender, "late", time.Minute, now.Add(time.Hour)); err != ErrEditWindow {
+		t.Errorf("Expected %v, got %v", ErrEditWindow, err)
+	}
+
+	history, err := History(recipient, "", 10, true)
+	if err != nil || len(history) != 1 {
+		t.Fatalf("Expected one message, got %v (%v)", history, err)
+	}
+
+	if history[0].Message != "third" || len(history[0].Revisions) != 2 || history[0].Revisions[0].Message != "first" {
+		t.Errorf("Unexpected history entry %+v", history[0])
+	}
+
+	if err := DeleteMessage(recipient, id, sender, time.Minute, now); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	history, err = History(recipient, "", 10, false)
+	if err != nil || len(history) != 1 || !history[0].Deleted || history[0].Message != "" {
+		t.Errorf("Expected a tombstone, got %v (%v)", history, err)
+	}
+
+	if _, err := EditMessage(recipient, id, sender, "again", time.Minute, now); err != ErrMessageDeleted {
+		t.Errorf("Expected %v, got %v", ErrMessageDeleted, err)
+	}
+}
+
+// TestWithoutParties checks that privacy mode stores messages without their
+// sender and recipient.
+func TestWithoutParties(t *testing.T) {
+	m := protocol.Message{Message: "hello", From: uuid.NewString(), To: uuid.NewString()}
+
+	var stored protocol.Message
+	if err := json.Unmarshal([]byte(withoutParties(m.String())), &stored); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if stored.From != "" || stored.To != "" || stored.Message != "hello" {
+		t.Errorf("Expected only the text, got %+v", stored)
+	}
+
+	if withoutParties("not json") != "not json" {
+		t.Errorf("Expected undecodable messages to be kept as they are")
+	}
+}
+
+// TestTombstoneMember checks that padded ids sort like the ids they were
+// made from and can be turned back into them.
+func TestTombstoneMember(t *testing.T) {
+	ids := []string{"9-0", "10-0", "10-2", "10-10", "1700000000000-0"}
+
+	for i, id := range ids {
+		member := tombstoneMember(id)
+
+		if tombstoneID(member) != id {
+			t.Errorf("Expected %v, got %v", id, tombstoneID(member))
+		}
+
+		if i > 0 && tombstoneMember(ids[i-1]) >= member {
+			t.Errorf("Expected %v to sort before %v", ids[i-1], id)
+		}
+	}
+}
+
+// TestExcerpt checks that quotes are cut at a rune boundary.
+func TestExcerpt(t *testing.T) {
+	short := Referenced{Text: "hello"}
+	if short.Excerpt() != "hello" {
+		t.Errorf("Expected %v, got %v", "hello", short.Excerpt())
+	}
+
+	long := Referenced{Text: strings.Repeat("a", MaxQuote-1) + "é and more"}
+	if excerpt := long.Excerpt(); excerpt != strings.Repeat("a", MaxQuote-1) {
+		t.Errorf("Expected %v bytes, got %v", MaxQuote-1, len(excerpt))
+	}
+}
+
+// TestCountReactions checks the aggregation and ordering of reactions.
+func TestCountReactions(t *testing.T) {
+	counts := CountReactions(map[string][]string{
+		"👍": {"a", "b"},
+		"🎉": {"b"},
+		"❤": {"c", "a", "d"},
+	}, "b")
+
+	expected := []ReactionCount{{"❤", 3, false}, {"👍", 2, true}, {"🎉", 1, true}}
+
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, counts)
+	}
+}
+
+// TestRepliesAndThreads replies to a message on both sides of a conversation
+// and reads the thread back.
+func TestRepliesAndThreads(t *testing.T) {
+	ctx := context.Background()
+	alice := uuid.NewString()
+	bob := uuid.NewString()
+
+	RegisterClientChat(alice)
+	RegisterClientChat(bob)
+
+	defer DeleteClientChat(alice)
+	defer DeleteClientChat(bob)
+
+	question := protocol.Message{Message: "question", From: alice, To: bob}
+
+	root, err := PostMessage(ctx, question.String(), alice, bob, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rootRef := MessageRef{Chat: bob, ID: root}
+
+	referenced, err := LoadReference(rootRef)
+	if err != nil || !referenced.Party(alice) || referenced.Other(bob) != alice || referenced.Thread != rootRef {
+		t.Fatalf("Unexpected reference %+v (%v)", referenced, err)
+	}
+
+	reply := Reply{To: rootRef, Thread: referenced.Thread, Quote: true}
+
+	payload := protocol.Message{Message: "answer", From: bob, To: alice}
+
+	answer, err := PostReply(ctx, payload.String(), bob, alice, 0, reply)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	answered, err := LoadReference(MessageRef{Chat: alice, ID: answer})
+	if err != nil || answered.Thread != rootRef {
+		t.Errorf("Expected thread %v, got %+v (%v)", rootRef, answered, err)
+	}
+
+	thread, err := Thread(rootRef, alice, "", 10)
+	if err != nil || len(thread) != 2 {
+		t.Fatalf("Expected two messages, got %v (%v)", thread, err)
+	}
+
+	if thread[0].ID != answer || thread[0].Quote != "question" || thread[0].ReplyTo == nil || *thread[0].ReplyTo != rootRef {
+		t.Errorf("Unexpected reply %+v", thread[0])
+	}
+
+	if thread, _ := Thread(rootRef, uuid.NewString(), "", 10); len(thread) != 0 {
+		t.Errorf("Expected no messages for an outsider, got %v", thread)
+	}
+}
+
+// TestReactions adds and removes reactions to a message.
+func TestReactions(t *testing.T) {
+	ctx := context.Background()
+	alice := uuid.NewString()
+	bob := uuid.NewString()
+
+	RegisterClientChat(bob)
+
+	defer DeleteClientChat(bob)
+
+	payload := protocol.Message{Message: "hi", From: alice, To: bob}
+
+	id, err := PostMessage(ctx, payload.String(), alice, bob, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	message, err := LoadReference(MessageRef{Chat: bob, ID: id})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	React(message, alice, "👍", false)
+	React(message, bob, "👍", false)
+
+	reactions, err := React(message, bob, "🎉", false)
+	if err != nil || len(reactions["👍"]) != 2 || len(reactions["🎉"]) != 1 {
+		t.Errorf("Unexpected reactions %v (%v)", reactions, err)
+	}
+
+	reactions, err = React(message, bob, "👍", true)
+	if err != nil || len(reactions["👍"]) != 1 || reactions["👍"][0] != alice {
+		t.Errorf("Unexpected reactions %v (%v)", reactions, err)
+	}
+}
+
+// TestReadMarkers sends messages both ways, marks some read and checks the
+// conversation list on both sides.
+func TestReadMarkers(t *testing.T) {
+	ctx := context.Background()
+	alice := uuid.NewString()
+	bob := uuid.NewString()
+
+	RegisterClientChat(alice)
+	RegisterClientChat(bob)
+
+	defer DeleteClientChat(alice)
+	defer DeleteClientChat(bob)
+
+	var ids []string
+
+	for _, text := range []string{"one", "two", "three"} {
+		payload := protocol.Message{Message: text, From: alice, To: bob}
+
+		id, err := PostMessage(ctx, payload.String(), alice, bob, 0)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	read, unread, err := MarkRead(bob, alice, ids[1])
+	if err != nil || read != ids[1] || unread != 1 {
+		t.Errorf("Expected marker %v with 1 unread, got %v with %v (%v)", ids[1], read, unread, err)
+	}
+
+	if read, unread, _ := MarkRead(bob, alice, ids[0]); read != ids[1] || unread != 1 {
+		t.Errorf("Expected the marker to stay at %v, got %v with %v unread", ids[1], read, unread)
+	}
+
+	conversations, err := Conversations(bob, 0, 10)
+	if err != nil || len(conversations) != 1 {
+		t.Fatalf("Expected one conversation, got %v (%v)", conversations, err)
+	}
+
+	if c := conversations[0]; c.Chat != alice || c.Unread != 1 || c.Read != ids[1] || c.Last == nil || c.Last.Message != "three" {
+		t.Errorf("Unexpected conversation %+v", c)
+	}
+
+	if err := DeleteMessage(bob, ids[2], alice, time.Minute, time.Now()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	conversations, _ = Conversations(alice, 0, 10)
+	if len(conversations) != 1 || conversations[0].Chat != bob || conversations[0].Unread != 0 {
+		t.Errorf("Unexpected conversations %+v", conversations)
+	}
+
+	if conversations, _ := Conversations(bob, 0, 10); len(conversations) != 1 || conversations[0].Unread != 0 {
+		t.Errorf("Expected the deleted message to no longer be unread, got %+v", conversations)
+	}
+
+	if err := DeleteClientChat(alice); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if conversations, _ := Conversations(bob, 0, 10); len(conversations) != 0 {
+		t.Errorf("Expected the deleted chat to leave the conversation list, got %+v", conversations)
+	}
+}
+
+// TestUnreadMember checks that expiring messages carry their expiry.
+func TestUnreadMember(t *testing.T) {
+	if member := unreadMember("1-0", 0); member != "1-0" {
+		t.Errorf("Expected %v, got %v", "1-0", member)
+	}
+
+	if member := unreadMember("1-0", 42); member != "1-0|42" {
+		t.Errorf("Expected %v, got %v", "1-0|42", member)
+	}
+}
+
+// TestScheduleLimits checks that delivery times in the past or too far
+// ahead are refused.
+func TestScheduleLimits(t *testing.T) {
+	now := time.Now()
+
+	for _, due := range []time.Time{now, now.Add(-time.Minute), now.Add(MaxScheduleDelay + time.Minute)} {
+		if _, err := ScheduleMessage(ScheduledMessage{From: uuid.NewString(), To: uuid.NewString(), Message: "hi"}, due, now); !errors.Is(err, ErrInvalidSchedule) {
+			t.Errorf("Expected %v for %v, got %v", ErrInvalidSchedule, due, err)
+		}
+	}
+}
+
+// TestScheduledMessages schedules two messages, cancels one and delivers the
+// other once it is due.
+func TestScheduledMessages(t *testing.T) {
+	sender := uuid.NewString()
+	recipient := uuid.NewString()
+	now := time.Now()
+
+	kept, err := ScheduleMessage(ScheduledMessage{From: sender, To: recipient, Message: "later"}, now.Add(time.Minute), now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	canceled, err := ScheduleMessage(ScheduledMessage{From: sender, To: recipient, Message: "never"}, now.Add(2*time.Minute), now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := CancelScheduled(uuid.NewString(), canceled.ID); err != ErrScheduledNotFound {
+		t.Errorf("Expected %v, got %v", ErrScheduledNotFound, err)
+	}
+
+	if err := CancelScheduled(sender, canceled.ID); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	pending, err := ScheduledMessages(sender)
+	if err != nil || len(pending) != 1 || pending[0] != kept {
+		t.Errorf("Expected %v, got %v (%v)", kept, pending, err)
+	}
+
+	var delivered []ScheduledMessage
+
+	deliver := func(ctx context.Context, message ScheduledMessage) error {
+		if message.From == sender {
+			delivered = append(delivered, message)
+		}
+		return nil
+	}
+
+	fail := func(ctx context.Context, message ScheduledMessage) {
+		t.Errorf("Expected %v to be delivered, it was given up on", message)
+	}
+
+	deliverDue(context.Background(), now, deliver, fail)
+
+	if len(delivered) != 0 {
+		t.Errorf("Expected nothing to be due, got %v", delivered)
+	}
+
+	deliverDue(context.Background(), now.Add(time.Hour), deliver, fail)
+
+	if len(delivered) != 1 || delivered[0].ID != kept.ID {
+		t.Errorf("Expected %v to be delivered, got %v", kept, delivered)
+	}
+
+	if pending, _ := ScheduledMessages(sender); len(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %v", pending)
+	}
+}
+
+// TestScheduledAttempts checks that a scheduled message failing to be
+// delivered is tried again once its lease lapses, and given up on after
+// MaxScheduleAttempts tries.
+func TestScheduledAttempts(t *testing.T) {
+	sender := uuid.NewString()
+	now := time.Now()
+
+	scheduled, err := ScheduleMessage(ScheduledMessage{From: sender, To: uuid.NewString(), Message: "later"}, now.Add(time.Minute), now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	attempts := 0
+	failed := 0
+
+	deliver := func(ctx context.Context, message ScheduledMessage) error {
+		if message.ID == scheduled.ID {
+			attempts++
+		}
+		return errors.New("unavailable")
+	}
+
+	fail := func(ctx context.Context, message ScheduledMessage) {
+		if message.ID == scheduled.ID {
+			failed++
+		}
+	}
+
+	for i := 1; i <= MaxScheduleAttempts+1; i++ {
+		deliverDue(context.Background(), now.Add(time.Duration(i)*time.Hour), deliver, fail)
+	}
+
+	if attempts != MaxScheduleAttempts || failed != 1 {
+		t.Errorf("Expected %v attempts and the message given up on, got %v attempts and %v", MaxScheduleAttempts, attempts, failed)
+	}
+
+	if pending, _ := ScheduledMessages(sender); len(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %v", pending)
+	}
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"darkchat/monitor"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	DevicesPrefix  = "devices"
+	IdentityPrefix = "identity"
+
+	// MaxIdentityBacklog is roughly how many entries an identity's stream
+	// keeps for devices that are offline. Older ones are trimmed.
+	MaxIdentityBacklog = 10000
+)
+
+var (
+	ErrUnknownDevice = errors.New("unknown device")
+	ErrRevokedDevice = errors.New("device has been revoked")
+)
+
+// Device is one of the devices linked to an identity.
+type Device struct {
+	ID       string `json:"id"`
+	Key      []byte `json:"key"`
+	Name     string `json:"name"`
+	Added    int64  `json:"added"`
+	LastSeen int64  `json:"last_seen,omitempty"`
+}
+
+// IdentityChat returns the name used in place of a chat id for the stream
+// every device of an identity reads.
+func IdentityChat(identity string) string {
+	return fmt.Sprintf("%s:%s", IdentityPrefix, identity)
+}
+
+// DeviceReader returns the name used in place of a chat id when a device
+// reads its identity's stream: its consumer group is group:<DeviceReader>.
+func DeviceReader(identity string, device string) string {
+	return fmt.Sprintf("%s:%s:%s", IdentityPrefix, identity, device)
+}
+
+func devicesKey(identity string) string {
+	return fmt.Sprintf("%s:%s", DevicesPrefix, identity)
+}
+
+func revokedKey(identity string) string {
+	return fmt.Sprintf("%s:%s:revoked", DevicesPrefix, identity)
+}
+
+// LinkDevice adds a device to an identity. Linking a device again updates
+// its name. It returns ErrRevokedDevice for a device that was revoked.
+func LinkDevice(identity string, device Device) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	revoked, err := redisClient.SIsMember(ctx, revokedKey(identity), device.ID).Result()
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return ErrRevokedDevice
+	}
+
+	if existing, err := GetDevice(identity, device.ID); err == nil {
+		device.Added = existing.Added
+		device.LastSeen = existing.LastSeen
+	}
+
+	encoded, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	if err := redisClient.HSet(ctx, devicesKey(identity), device.ID, encoded).Err(); err != nil {
+		return err
+	}
+
+	return createDeviceGroup(ctx, identity, device.ID)
+}
+
+// createDeviceGroup gives a device a consumer group on its identity's stream
+// starting with what is posted from now on, unless it has one already.
+func createDeviceGroup(ctx context.Context, identity string, deviceID string) error {
+	err := redisClient.XGroupCreateMkStream(
+		ctx,
+		fmt.Sprintf("%s:%s", StreamNamePrefix, IdentityChat(identity)),
+		fmt.Sprintf("%s:%s", GroupNamePrefix, DeviceReader(identity, deviceID)),
+		"$",
+	).Err()
+
+	if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// GetDevice returns a device of an identity, ErrRevokedDevice if it was
+// revoked or ErrUnknownDevice if it was never linked.
+func GetDevice(identity string, deviceID string) (Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	var device Device
+
+	encoded, err := redisClient.HGet(ctx, devicesKey(identity), deviceID).Result()
+
+	if err == redis.Nil {
+		revoked, err := redisClient.SIsMember(ctx, revokedKey(identity), deviceID).Result()
+		if err == nil && revoked {
+			return device, ErrRevokedDevice
+		}
+		return device, ErrUnknownDevice
+	}
+
+	if err != nil {
+		return device, err
+	}
+
+	err = json.Unmarshal([]byte(encoded), &device)
+	return device, err
+}
+
+// Devices returns the devices linked to an identity, oldest first.
+func Devices(identity string) ([]Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	values, err := redisClient.HGetAll(ctx, devicesKey(identity)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0, len(values))
+
+	for _, encoded := range values {
+		var device Device
+
+		if err := json.Unmarshal([]byte(encoded), &device); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Added < devices[j].Added })
+
+	return devices, nil
+}
+
+// AttachDevice records that a device was seen. Its consumer group was
+// created when it was linked, so it picks up everything posted to the
+// identity since, however long it took to first authenticate. The group is
+// only created here for devices that lost it.
+func AttachDevice(identity string, deviceID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	if err := createDeviceGroup(ctx, identity, deviceID); err != nil {
+		return err
+	}
+
+	device, err := GetDevice(identity, deviceID)
+	if err != nil {
+		return err
+	}
+	device.LastSeen = time.Now().Unix()
+
+	encoded, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	return redisClient.HSet(ctx, devicesKey(identity), deviceID, encoded).Err()
+}
+
+// RevokeDevice unlinks a device for good: it is removed from the device list,
+// cannot be linked again and its consumer group is destroyed, which ends the
+// streaming of any connection it still has.
+func RevokeDevice(identity string, deviceID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	removed, err := redisClient.HDel(ctx, devicesKey(identity), deviceID).Result()
+	if err != nil {
+		return err
+	}
+
+	if removed == 0 {
+		return ErrUnknownDevice
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.SAdd(ctx, revokedKey(identity), deviceID)
+	pipe.XGroupDestroy(
+		ctx,
+		fmt.Sprintf("%s:%s", StreamNamePrefix, IdentityChat(identity)),
+		fmt.Sprintf("%s:%s", GroupNamePrefix, DeviceReader(identity, deviceID)),
+	)
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// HasDevices reports whether an identity has any linked device, which is
+// what it takes for posts to its stream to be read. The devices need not be
+// connected, use GetPresence for that.
+func HasDevices(identity string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	count, err := redisClient.HLen(ctx, devicesKey(identity)).Result()
+	if err != nil {
+		databaseMonitor.Error(err.Error())
+		return false
+	}
+	return count > 0
+}
+
+// PostEventToIdentity queues an event for every device of an identity, with
+// a time to live as for PostToChatContext. The stream is trimmed to about
+// MaxIdentityBacklog entries.
+func PostEventToIdentity(ctx context.Context, op string, body interface{}, identity string, ttl time.Duration) (string, error) {
+	id, err := PostEvent(ctx, op, body, IdentityChat(identity), ttl)
+	if err != nil {
+		return "", err
+	}
+
+	trimCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	defer cancel()
+
+	stream := fmt.Sprintf("%s:%s", StreamNamePrefix, IdentityChat(identity))
+
+	if err := redisClient.XTrimMaxLenApprox(trimCtx, stream, MaxIdentityBacklog, 0).Err(); err != nil {
+		databaseMonitor.Ctx(ctx).Error("Trimming identity stream failed", monitor.F(monitor.KeyError, err))
+	}
+	return id, nil
+}
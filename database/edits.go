@@ -0,0 +1,447 @@
+package database
+
+import (
+	"context"
+	"darkchat/privacy"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	EditsPrefix      = "edits"
+	TombstonesPrefix = "tombstones"
+
+	// DEFAULTEDITWINDOW is how long after sending a message its sender may
+	// edit or delete it.
+	DEFAULTEDITWINDOW = 15 * time.Minute
+
+	// MaxHistory is the most messages one History call returns.
+	MaxHistory = 100
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrMessageDeleted  = errors.New("message has been deleted")
+	ErrNotSender       = errors.New("only the sender of a message may change it")
+	ErrEditWindow      = errors.New("message is too old to be changed")
+
+	// ErrPrivacyMode is returned for what needs messages to be kept after
+	// they are delivered, which privacy mode does not do.
+	ErrPrivacyMode = errors.New("not available in privacy mode, messages are not kept once delivered")
+)
+
+// Revision is an earlier version of an edited message.
+type Revision struct {
+	Message string `json:"message"`
+	At      int64  `json:"at"`
+}
+
+// editRecord is what is stored about a message that was edited or deleted.
+// A deleted message keeps only its tombstone.
+type editRecord struct {
+	Message   string     `json:"message,omitempty"`
+	Edited    int64      `json:"edited"`
+	Deleted   bool       `json:"deleted,omitempty"`
+	Revisions []Revision `json:"revisions,omitempty"`
+}
+
+// HistoryEntry is a message as returned by History: its latest version, or
+// a tombstone if it was deleted.
+type HistoryEntry struct {
+	ID        string      `json:"id"`
+	Chat      string      `json:"chat,omitempty"`
+	From      string      `json:"from,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Edited    int64       `json:"edited,omitempty"`
+	Deleted   bool        `json:"deleted,omitempty"`
+	Expires   int64       `json:"expires,omitempty"`
+	ReplyTo   *MessageRef `json:"reply_to,omitempty"`
+	Thread    *MessageRef `json:"thread,omitempty"`
+	Quote     string      `json:"quote,omitempty"`
+	Revisions []Revision  `json:"revisions,omitempty"`
+
+	// quoted is set on replies that quote the message they answer, until
+	// resolveQuotes fills in the quote.
+	quoted bool
+}
+
+// editsKey returns the key of the hash holding the edits and tombstones of a
+// chat's messages, by message id.
+func editsKey(chatId string) string {
+	return fmt.Sprintf("%s:%s", EditsPrefix, chatId)
+}
+
+// tombstonesKey returns the key of the set of a chat's deleted messages.
+// Members are their ids as tombstoneMember pads them, all scored zero, so
+// ranging over them by lex goes in id order.
+func tombstonesKey(chatId string) string {
+	return fmt.Sprintf("%s:%s", TombstonesPrefix, chatId)
+}
+
+// tombstoneMember pads both parts of a stream id to 20 digits.
+func tombstoneMember(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+
+	return strings.Repeat("0", 20-min(len(ms), 20)) + ms + "-" + strings.Repeat("0", 20-min(len(seq), 20)) + seq
+}
+
+// tombstoneID returns the stream id a tombstoneMember was made from.
+func tombstoneID(member string) string {
+	ms, seq, _ := strings.Cut(member, "-")
+
+	trim := func(s string) string {
+		if s = strings.TrimLeft(s, "0"); s == "" {
+			return "0"
+		}
+		return s
+	}
+	return trim(ms) + "-" + trim(seq)
+}
+
+// idTime returns the time a stream id was assigned.
+func idTime(id string) (time.Time, error) {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: malformed id %q", ErrMessageNotFound, id)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// changeable loads a message in a chat and checks that sender may still
+// change it: it was sent by sender less than window ago and was not deleted.
+func changeable(ctx context.Context, tx *redis.Tx, chatId string, id string, sender string, window time.Duration, now time.Time) (redis.XMessage, editRecord, error) {
+	var record editRecord
+
+	sent, err := idTime(id)
+	if err != nil {
+		return redis.XMessage{}, record, err
+	}
+
+	entries, err := tx.XRange(ctx, fmt.Sprintf("%s:%s", StreamNamePrefix, chatId), id, id).Result()
+	if err != nil {
+		return redis.XMessage{}, record, err
+	}
+
+	raw, err := tx.HGet(ctx, editsKey(chatId), id).Result()
+	if err != nil && err != redis.Nil {
+		return redis.XMessage{}, record, err
+	}
+
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &record); err != nil {
+			return redis.XMessage{}, record, err
+		}
+	}
+
+	if record.Deleted {
+		return redis.XMessage{}, record, ErrMessageDeleted
+	}
+
+	if len(entries) == 0 || entries[0].Values["kind"] != KindMessage {
+		return redis.XMessage{}, record, ErrMessageNotFound
+	}
+
+	if _, expired := entryExpiry(entries[0].Values, now); expired {
+		return redis.XMessage{}, record, ErrMessageNotFound
+	}
+
+	if from, _ := entries[0].Values["sender"].(string); from == "" || from != sender {
+		return redis.XMessage{}, record, ErrNotSender
+	}
+
+	if now.Sub(sent) > window {
+		return redis.XMessage{}, record, ErrEditWindow
+	}
+
+	return entries[0], record, nil
+}
+
+// entryText returns the text of the message in a stream entry.
+func entryText(entry redis.XMessage) string {
+	raw, _ := entry.Values["message"].(string)
+
+	var message protocol.Message
+	json.Unmarshal([]byte(raw), &message)
+
+	return message.Message
+}
+
+// EditMessage replaces the text of a message sent by sender to chatId. The
+// version it replaces is kept as a revision. It returns when the edit was
+// made, in milliseconds. In privacy mode messages are gone once delivered
+// and who sent them is not stored, so it returns ErrPrivacyMode.
+func EditMessage(chatId string, id string, sender string, text string, window time.Duration, now time.Time) (int64, error) {
+	if privacy.Enabled() {
+		return 0, ErrPrivacyMode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	edited := now.UnixMilli()
+
+	err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		entry, record, err := changeable(ctx, tx, chatId, id, sender, window, now)
+		if err != nil {
+			return err
+		}
+
+		sent, _ := idTime(id)
+
+		previous := Revision{Message: entryText(entry), At: sent.UnixMilli()}
+		if record.Edited != 0 {
+			previous = Revision{Message: record.Message, At: record.Edited}
+		}
+
+		record.Revisions = append(record.Revisions, previous)
+		record.Message = text
+		record.Edited = edited
+
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, editsKey(chatId), id, encoded)
+			return nil
+		})
+		return err
+	}, editsKey(chatId))
+
+	return edited, err
+}
+
+// DeleteMessage retracts a message sent by sender to chatId. The entry is
+// removed from the stream, delivered or not, and replaced by a tombstone
+// that keeps nothing of what it said. It no longer counts as unread. Like
+// EditMessage it returns ErrPrivacyMode in privacy mode.
+func DeleteMessage(chatId string, id string, sender string, window time.Duration, now time.Time) error {
+	if privacy.Enabled() {
+		return ErrPrivacyMode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		if _, _, err := changeable(ctx, tx, chatId, id, sender, window, now); err != nil {
+			return err
+		}
+
+		unread, err := forgetUnread(ctx, tx, chatId, sender, id)
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(editRecord{Edited: now.UnixMilli(), Deleted: true})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, editsKey(chatId), id, encoded)
+			pipe.ZAdd(ctx, tombstonesKey(chatId), redis.Z{Member: tombstoneMember(id)})
+			pipe.XDel(ctx, fmt.Sprintf("%s:%s", StreamNamePrefix, chatId), id)
+
+			if len(unread) > 0 {
+				pipe.ZRem(ctx, unreadKey(chatId, sender), unread...)
+			}
+			return nil
+		})
+		return err
+	}, editsKey(chatId))
+}
+
+// History returns up to limit messages delivered to a chat, newest first,
+// starting before the given id, or with the newest when before is empty.
+// Edited messages come in their latest version, with their revisions if
+// asked for, and deleted ones as tombstones. Expired messages and events are
+// left out. There is no history in privacy mode, it returns ErrPrivacyMode.
+func History(chatId string, before string, limit int, revisions bool) ([]HistoryEntry, error) {
+	if privacy.Enabled() {
+		return nil, ErrPrivacyMode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	if limit <= 0 || limit > MaxHistory {
+		limit = MaxHistory
+	}
+
+	end, last := "+", "+"
+	if before != "" {
+		end, last = "("+before, "("+tombstoneMember(before)
+	}
+
+	pipe := redisClient.Pipeline()
+	entriesCmd := pipe.XRevRangeN(ctx, fmt.Sprintf("%s:%s", StreamNamePrefix, chatId), end, "-", int64(limit))
+	tombstonesCmd := pipe.ZRevRangeByLex(ctx, tombstonesKey(chatId), &redis.ZRangeBy{Min: "-", Max: last, Count: int64(limit)})
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	entries := entriesCmd.Val()
+
+	// Tombstones have no entry left in the stream, they go wherever their id
+	// falls in the range read. If the read stopped at the limit, older ones
+	// belong to the next page.
+	oldest := ""
+	if len(entries) == limit {
+		oldest = entries[len(entries)-1].ID
+	}
+
+	ids := make([]string, 0, len(entries)+len(tombstonesCmd.Val()))
+
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+
+	for _, member := range tombstonesCmd.Val() {
+		if id := tombstoneID(member); inPage(id, before, oldest) {
+			ids = append(ids, id)
+		}
+	}
+
+	edits, err := loadEdits(ctx, chatId, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	history := make([]HistoryEntry, 0, len(ids))
+
+	for _, entry := range entries {
+		if item, ok := historyEntry(entry, edits, revisions, now); ok {
+			history = append(history, item)
+		}
+	}
+
+	for _, id := range ids[len(entries):] {
+		if record, ok := edits[id]; ok && record.Deleted {
+			history = append(history, HistoryEntry{ID: id, Edited: record.Edited, Deleted: true})
+		}
+	}
+
+	sort.Slice(history, func(i, j int) bool { return compareIDs(history[i].ID, history[j].ID) > 0 })
+
+	if len(history) > limit {
+		history = history[:limit]
+	}
+
+	if err := resolveQuotes(ctx, history, now); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// loadEdits returns the edits and tombstones of the given messages of a
+// chat, by message id. Messages that were never changed are left out.
+func loadEdits(ctx context.Context, chatId string, ids []string) (map[string]editRecord, error) {
+	edits := make(map[string]editRecord)
+
+	if len(ids) == 0 {
+		return edits, nil
+	}
+
+	raw, err := redisClient.HMGet(ctx, editsKey(chatId), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, value := range raw {
+		encoded, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var record editRecord
+		if err := json.Unmarshal([]byte(encoded), &record); err == nil {
+			edits[ids[i]] = record
+		}
+	}
+	return edits, nil
+}
+
+// historyEntry turns a stream entry into a history entry in its latest
+// version. It returns false for entries that are not messages or have
+// expired.
+func historyEntry(entry redis.XMessage, edits map[string]editRecord, revisions bool, now time.Time) (HistoryEntry, bool) {
+	if entry.Values["kind"] != KindMessage {
+		return HistoryEntry{}, false
+	}
+
+	expires, expired := entryExpiry(entry.Values, now)
+	if expired {
+		return HistoryEntry{}, false
+	}
+
+	raw, _ := entry.Values["message"].(string)
+
+	var message protocol.Message
+	if err := json.Unmarshal([]byte(raw), &message); err != nil {
+		return HistoryEntry{}, false
+	}
+
+	item := HistoryEntry{ID: entry.ID, From: message.From, Message: message.Message, Expires: expires}
+	item.ReplyTo, item.Thread, item.quoted = entryReply(entry.Values)
+
+	if record, ok := edits[entry.ID]; ok {
+		item.Message = record.Message
+		item.Edited = record.Edited
+
+		if revisions {
+			item.Revisions = record.Revisions
+		}
+	}
+
+	return item, true
+}
+
+// inPage reports whether a tombstone id falls in the range of a page of
+// history: older than before, if set, and newer than oldest, if set.
+func inPage(id string, before string, oldest string) bool {
+	if before != "" && compareIDs(id, before) >= 0 {
+		return false
+	}
+	return oldest == "" || compareIDs(id, oldest) > 0
+}
+
+// compareIDs compares two stream ids, returning -1, 0 or 1.
+func compareIDs(a string, b string) int {
+	parse := func(id string) (int64, int64) {
+		parts := strings.SplitN(id, "-", 2)
+		ms, _ := strconv.ParseInt(parts[0], 10, 64)
+
+		var seq int64
+		if len(parts) == 2 {
+			seq, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+		return ms, seq
+	}
+
+	ams, aseq := parse(a)
+	bms, bseq := parse(b)
+
+	switch {
+	case ams < bms || (ams == bms && aseq < bseq):
+		return -1
+	case ams == bms && aseq == bseq:
+		return 0
+	default:
+		return 1
+	}
+}
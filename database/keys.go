@@ -0,0 +1,186 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	KeysPrefix    = "keys"
+	PrekeysPrefix = "prekeys"
+
+	// MaxOneTimePrekeys is how many one-time prekeys are kept per identity.
+	// Uploading more drops the oldest.
+	MaxOneTimePrekeys = 100
+)
+
+var (
+	ErrNoKeys    = errors.New("no keys published for identity")
+	ErrStaleKeys = errors.New("key upload is older than the published keys")
+	ErrNotBound  = errors.New("identity is not bound to this chat")
+)
+
+// SignedPrekey is a medium-term prekey signed by the identity key.
+type SignedPrekey struct {
+	ID        uint32 `json:"id"`
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+// Prekey is a one-time prekey, handed out to at most one sender.
+type Prekey struct {
+	ID  uint32 `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// KeyBundle is what a sender fetches to start a session with an identity:
+// its identity key, signed prekey and, while any are left, one one-time
+// prekey. ChatID is the chat the identity last published its keys from.
+type KeyBundle struct {
+	IdentityKey   []byte       `json:"identity_key"`
+	SignedPrekey  SignedPrekey `json:"signed_prekey"`
+	OneTimePrekey *Prekey      `json:"one_time_prekey,omitempty"`
+	ChatID        string       `json:"chat_id,omitempty"`
+}
+
+// publishKeysScript replaces the identity key and signed prekey, appends the
+// one-time prekeys and trims them to ARGV[5], unless the upload timestamp in
+// ARGV[1] is not newer than the last one, so an upload cannot be replayed.
+var publishKeysScript = redis.NewScript(`
+local updated = tonumber(redis.call('HGET', KEYS[1], 'updated') or '0')
+if updated >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'updated', ARGV[1], 'identity_key', ARGV[2], 'signed_prekey', ARGV[3], 'chat_id', ARGV[4])
+for i = 6, #ARGV do
+	redis.call('RPUSH', KEYS[2], ARGV[i])
+end
+redis.call('LTRIM', KEYS[2], -tonumber(ARGV[5]), -1)
+return 1
+`)
+
+// unbindScript removes the chat id of an identity only if it is still the
+// given one, so a disconnect does not undo a newer upload from another chat.
+var unbindScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'chat_id') == ARGV[1] then
+	return redis.call('HDEL', KEYS[1], 'chat_id')
+end
+return 0
+`)
+
+// PublishKeys stores the keys of an identity and binds it to the chat it was
+// uploaded from. The timestamp must be newer than the previous upload, or
+// ErrStaleKeys is returned.
+func PublishKeys(identity string, identityKey []byte, signed SignedPrekey, prekeys []Prekey, chatId string, timestamp int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	signedJSON, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{timestamp, identityKey, signedJSON, chatId, MaxOneTimePrekeys}
+
+	for _, prekey := range prekeys {
+		prekeyJSON, err := json.Marshal(prekey)
+		if err != nil {
+			return err
+		}
+		args = append(args, prekeyJSON)
+	}
+
+	published, err := publishKeysScript.Run(ctx, redisClient, []string{
+		fmt.Sprintf("%s:%s", KeysPrefix, identity),
+		fmt.Sprintf("%s:%s", PrekeysPrefix, identity),
+	}, args...).Int()
+
+	if err != nil {
+		return err
+	}
+
+	if published == 0 {
+		return ErrStaleKeys
+	}
+	return nil
+}
+
+// FetchKeyBundle returns the key bundle of an identity, consuming one of its
+// one-time prekeys. LPOP is atomic, so two senders never get the same one.
+// It returns ErrNoKeys if the identity has not published any keys.
+func FetchKeyBundle(identity string) (KeyBundle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	var bundle KeyBundle
+
+	values, err := redisClient.HGetAll(ctx, fmt.Sprintf("%s:%s", KeysPrefix, identity)).Result()
+	if err != nil {
+		return bundle, err
+	}
+
+	if values["identity_key"] == "" {
+		return bundle, ErrNoKeys
+	}
+
+	bundle.IdentityKey = []byte(values["identity_key"])
+	bundle.ChatID = values["chat_id"]
+
+	if err := json.Unmarshal([]byte(values["signed_prekey"]), &bundle.SignedPrekey); err != nil {
+		return bundle, err
+	}
+
+	prekeyJSON, err := redisClient.LPop(ctx, fmt.Sprintf("%s:%s", PrekeysPrefix, identity)).Result()
+
+	if err == redis.Nil {
+		return bundle, nil
+	}
+
+	if err != nil {
+		return bundle, err
+	}
+
+	var prekey Prekey
+
+	if err := json.Unmarshal([]byte(prekeyJSON), &prekey); err != nil {
+		return bundle, err
+	}
+	bundle.OneTimePrekey = &prekey
+
+	return bundle, nil
+}
+
+// PrekeyCount returns how many one-time prekeys an identity has left, so its
+// owner knows when to upload more.
+func PrekeyCount(identity string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.LLen(ctx, fmt.Sprintf("%s:%s", PrekeysPrefix, identity)).Result()
+}
+
+// UnbindIdentity forgets the chat an identity is reachable on, if it is still
+// the given chat. It returns ErrNotBound otherwise.
+func UnbindIdentity(identity string, chatId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	removed, err := unbindScript.Run(ctx, redisClient, []string{fmt.Sprintf("%s:%s", KeysPrefix, identity)}, chatId).Int()
+	if err != nil {
+		return err
+	}
+
+	if removed == 0 {
+		return ErrNotBound
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"darkchat/metrics"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// metricsHook records the latency and errors of every Redis command issued
+// through redisClient.
+type metricsHook struct{}
+
+func (metricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (metricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+
+		observeCommand(cmd.Name(), time.Since(start), err)
+		return err
+	}
+}
+
+func (metricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+
+		observeCommand("pipeline", time.Since(start), err)
+		return err
+	}
+}
+
+// observeCommand records one command. redis.Nil only means an empty result,
+// such as a blocking read timing out, and is not counted as an error.
+func observeCommand(name string, duration time.Duration, err error) {
+	metrics.RedisLatency.WithLabelValues(name).Observe(duration.Seconds())
+
+	if err != nil && err != redis.Nil {
+		metrics.RedisErrors.WithLabelValues(name).Inc()
+	}
+}
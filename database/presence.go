@@ -0,0 +1,337 @@
+package database
+
+import (
+	"context"
+	"darkchat/monitor"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	PresencePrefix = "presence"
+
+	// DEFAULTPRESENCETIMEOUT is how long a connection counts as online after
+	// it last announced itself or sent a heartbeat, so the connections of a
+	// node that died without cleaning up go offline on their own.
+	DEFAULTPRESENCETIMEOUT = 90 * time.Second
+)
+
+// Presence states. Invisible is only ever seen by its owner, everyone else
+// sees an invisible identity as offline.
+const (
+	PresenceOnline    = "online"
+	PresenceAway      = "away"
+	PresenceBusy      = "busy"
+	PresenceInvisible = "invisible"
+	PresenceOffline   = "offline"
+)
+
+// Who may see an identity's presence. Those who may not see it as offline,
+// without a last-seen time.
+const (
+	VisibleEveryone = "everyone"
+	VisibleContacts = "contacts"
+	VisibleNobody   = "nobody"
+)
+
+var ErrInvalidPresence = errors.New("invalid presence state or visibility")
+
+// Presence is an identity's presence as seen by someone.
+type Presence struct {
+	Identity string `json:"identity"`
+	State    string `json:"state"`
+	LastSeen int64  `json:"last_seen,omitempty"`
+}
+
+// touchPresenceScript records that the connection ARGV[1] of an identity is
+// alive at ARGV[2]. Connections last seen before ARGV[3] are dropped, the
+// latest of them kept as the identity's last-seen time.
+var touchPresenceScript = redis.NewScript(`
+local stale = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3], 'WITHSCORES')
+if #stale > 0 then
+	local last = tonumber(stale[#stale])
+	if last > tonumber(redis.call('HGET', KEYS[2], 'last_seen') or '0') then
+		redis.call('HSET', KEYS[2], 'last_seen', last)
+	end
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+end
+return redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+`)
+
+func presenceKey(identity string) string {
+	return fmt.Sprintf("%s:%s", PresencePrefix, identity)
+}
+
+func presenceConnsKey(identity string) string {
+	return fmt.Sprintf("%s:%s:conns", PresencePrefix, identity)
+}
+
+func presenceAllowedKey(identity string) string {
+	return fmt.Sprintf("%s:%s:allowed", PresencePrefix, identity)
+}
+
+func presenceWatchersKey(identity string) string {
+	return fmt.Sprintf("%s:%s:watchers", PresencePrefix, identity)
+}
+
+// presenceRecord is everything stored about an identity's presence.
+type presenceRecord struct {
+	identity   string
+	state      string
+	visibility string
+	lastSeen   int64
+	online     bool
+	allowed    map[string]bool
+}
+
+// loadPresence reads an identity's presence. A connection is online if it
+// was touched within DEFAULTPRESENCETIMEOUT of now.
+func loadPresence(ctx context.Context, identity string, now time.Time) (presenceRecord, error) {
+	record := presenceRecord{identity: identity}
+
+	pipe := redisClient.Pipeline()
+	values := pipe.HGetAll(ctx, presenceKey(identity))
+	latest := pipe.ZRevRangeWithScores(ctx, presenceConnsKey(identity), 0, 0)
+	allowed := pipe.SMembers(ctx, presenceAllowedKey(identity))
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return record, err
+	}
+
+	record.state = values.Val()["state"]
+	record.visibility = values.Val()["visibility"]
+	record.lastSeen, _ = strconv.ParseInt(values.Val()["last_seen"], 10, 64)
+
+	if record.state == "" {
+		record.state = PresenceOnline
+	}
+
+	if record.visibility == "" {
+		record.visibility = VisibleEveryone
+	}
+
+	if conns := latest.Val(); len(conns) > 0 {
+		seen := int64(conns[0].Score)
+
+		record.online = now.Sub(time.Unix(seen, 0)) <= DEFAULTPRESENCETIMEOUT
+
+		// An invisible identity's last-seen time is when it went invisible,
+		// not the last sign of life of its connections.
+		if !record.online && record.state != PresenceInvisible && seen > record.lastSeen {
+			record.lastSeen = seen
+		}
+	}
+
+	record.allowed = make(map[string]bool, len(allowed.Val()))
+	for _, member := range allowed.Val() {
+		record.allowed[member] = true
+	}
+
+	return record, nil
+}
+
+// view returns the presence as the given viewer may see it. The owner sees
+// its own state, invisible included.
+func (r presenceRecord) view(viewer string) Presence {
+	presence := Presence{Identity: r.identity, State: PresenceOffline}
+
+	if viewer != r.identity {
+		switch r.visibility {
+		case VisibleNobody:
+			return presence
+		case VisibleContacts:
+			if !r.allowed[viewer] {
+				return presence
+			}
+		}
+	}
+
+	if r.online && (r.state != PresenceInvisible || viewer == r.identity) {
+		presence.State = r.state
+		return presence
+	}
+
+	presence.LastSeen = r.lastSeen
+	return presence
+}
+
+// ValidPresence reports whether a state can be set by a client.
+func ValidPresence(state string) bool {
+	switch state {
+	case PresenceOnline, PresenceAway, PresenceBusy, PresenceInvisible:
+		return true
+	}
+	return false
+}
+
+// SetPresence sets the state of an identity and marks the given connection
+// of it online. Going invisible records the last-seen time others get to see.
+func SetPresence(identity string, connID string, state string) error {
+	if !ValidPresence(state) {
+		return ErrInvalidPresence
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	now := time.Now()
+
+	values := []interface{}{"state", state}
+	if state == PresenceInvisible {
+		values = append(values, "last_seen", now.Unix())
+	}
+
+	if err := redisClient.HSet(ctx, presenceKey(identity), values...).Err(); err != nil {
+		return err
+	}
+
+	return touchPresence(ctx, identity, connID, now)
+}
+
+// TouchPresence keeps a connection of an identity online, it is called on
+// every heartbeat of a connection that set its presence.
+func TouchPresence(identity string, connID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return touchPresence(ctx, identity, connID, time.Now())
+}
+
+func touchPresence(ctx context.Context, identity string, connID string, now time.Time) error {
+	return touchPresenceScript.Run(
+		ctx,
+		redisClient,
+		[]string{presenceConnsKey(identity), presenceKey(identity)},
+		connID,
+		now.Unix(),
+		now.Add(-DEFAULTPRESENCETIMEOUT).Unix(),
+	).Err()
+}
+
+// LeavePresence marks a connection of an identity offline. It returns true if
+// that was the identity's last connection, so it is now offline.
+func LeavePresence(identity string, connID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	if err := redisClient.ZRem(ctx, presenceConnsKey(identity), connID).Err(); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	record, err := loadPresence(ctx, identity, now)
+	if err != nil || record.online {
+		return false, err
+	}
+
+	if record.state != PresenceInvisible {
+		err = redisClient.HSet(ctx, presenceKey(identity), "last_seen", now.Unix()).Err()
+	}
+	return true, err
+}
+
+// SetPresenceVisibility sets who may see an identity's presence. With
+// VisibleContacts only the identities in allowed may, allowed replaces the
+// previous list and is ignored otherwise.
+func SetPresenceVisibility(identity string, visibility string, allowed []string) error {
+	switch visibility {
+	case VisibleEveryone, VisibleContacts, VisibleNobody:
+	default:
+		return ErrInvalidPresence
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, presenceKey(identity), "visibility", visibility)
+
+	if visibility == VisibleContacts {
+		pipe.Del(ctx, presenceAllowedKey(identity))
+
+		if len(allowed) > 0 {
+			members := make([]interface{}, len(allowed))
+			for i, member := range allowed {
+				members[i] = member
+			}
+			pipe.SAdd(ctx, presenceAllowedKey(identity), members...)
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetPresence returns an identity's presence as the viewer may see it. The
+// viewer is the identity bound to the asking connection, or empty.
+func GetPresence(identity string, viewer string) (Presence, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	record, err := loadPresence(ctx, identity, time.Now())
+	if err != nil {
+		return Presence{}, err
+	}
+	return record.view(viewer), nil
+}
+
+// WatchPresence subscribes a chat to the presence changes of an identity, as
+// the viewer may see them.
+func WatchPresence(identity string, chatId string, viewer string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.HSet(ctx, presenceWatchersKey(identity), chatId, viewer).Err()
+}
+
+// UnwatchPresence ends the subscription of a chat to an identity's presence.
+func UnwatchPresence(identity string, chatId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return redisClient.HDel(ctx, presenceWatchersKey(identity), chatId).Err()
+}
+
+// NotifyPresence posts an identity's presence as a "presence" event to every
+// chat watching it, each getting what its viewer may see. Watchers whose chat
+// is gone are dropped. Events go through the chat streams, so they reach
+// watchers on any node.
+func NotifyPresence(ctx context.Context, identity string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	defer cancel()
+
+	record, err := loadPresence(ctx, identity, time.Now())
+	if err != nil {
+		return err
+	}
+
+	watchers, err := redisClient.HGetAll(ctx, presenceWatchersKey(identity)).Result()
+	if err != nil {
+		return err
+	}
+
+	for chatId, viewer := range watchers {
+		if !CheckChatExists(chatId) {
+			redisClient.HDel(ctx, presenceWatchersKey(identity), chatId)
+			continue
+		}
+
+		if _, err := PostEvent(ctx, "presence", record.view(viewer), chatId, 0); err != nil {
+			databaseMonitor.Ctx(ctx).Error("Posting presence failed", monitor.F(monitor.KeyChatID, chatId), monitor.F(monitor.KeyError, err))
+		}
+	}
+	return nil
+}
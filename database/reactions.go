@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ReactionsPrefix = "reactions"
+
+	// MaxReactionsPerSender is how many different reactions one chat may
+	// leave on a message.
+	MaxReactionsPerSender = 20
+)
+
+var ErrTooManyReactions = errors.New("too many reactions on this message")
+
+// ReactionCount is how many chats reacted to a message with an emoji, and
+// whether the one asking is among them.
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Mine  bool   `json:"mine,omitempty"`
+}
+
+// reactScript adds the reaction ARGV[1] of the chat ARGV[2] to the hash
+// KEYS[1] at the time ARGV[3] unless the chat already left ARGV[4] reactions
+// there, in which case it returns 0. The hash is tracked in the set KEYS[2]
+// and expires at ARGV[5] unless that is zero.
+var reactScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	return 1
+end
+local suffix = '|' .. ARGV[2]
+local mine = 0
+for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+	if string.sub(field, -#suffix) == suffix then
+		mine = mine + 1
+	end
+end
+if mine >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+redis.call('SADD', KEYS[2], KEYS[1])
+if tonumber(ARGV[5]) > 0 then
+	redis.call('PEXPIREAT', KEYS[1], ARGV[5])
+end
+return 1
+`)
+
+// reactionsKey returns the key of the hash holding the reactions to a
+// message. Its fields are "<emoji>|<chat>", one per reaction.
+func reactionsKey(ref MessageRef) string {
+	return fmt.Sprintf("%s:%s:%s", ReactionsPrefix, ref.Chat, ref.ID)
+}
+
+// React adds or, with remove set, takes back a reaction of a chat to a
+// message, which must have been loaded with LoadReference. The reactions
+// expire along with a disappearing message. It returns the reactions to the
+// message afterwards.
+func React(message Referenced, chatId string, emoji string, remove bool) (map[string][]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	key := reactionsKey(message.Ref)
+	field := emoji + "|" + chatId
+
+	if remove {
+		if err := redisClient.HDel(ctx, key, field).Err(); err != nil {
+			return nil, err
+		}
+		return loadReactions(ctx, message.Ref)
+	}
+
+	added, err := reactScript.Run(ctx, redisClient, []string{key, refsKey(message.Ref.Chat)},
+		field, chatId, time.Now().UnixMilli(), MaxReactionsPerSender, message.expires,
+	).Int()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if added == 0 {
+		return nil, ErrTooManyReactions
+	}
+	return loadReactions(ctx, message.Ref)
+}
+
+// Reactions returns the reactions to a message by emoji, each with the chats
+// that reacted with it.
+func Reactions(ref MessageRef) (map[string][]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	return loadReactions(ctx, ref)
+}
+
+func loadReactions(ctx context.Context, ref MessageRef) (map[string][]string, error) {
+	fields, err := redisClient.HKeys(ctx, reactionsKey(ref)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reactions := make(map[string][]string)
+
+	for _, field := range fields {
+		sep := strings.LastIndex(field, "|")
+		if sep < 0 {
+			continue
+		}
+		reactions[field[:sep]] = append(reactions[field[:sep]], field[sep+1:])
+	}
+	return reactions, nil
+}
+
+// CountReactions aggregates reactions as the given chat sees them, the most
+// used emoji first.
+func CountReactions(reactions map[string][]string, viewer string) []ReactionCount {
+	counts := make([]ReactionCount, 0, len(reactions))
+
+	for emoji, chats := range reactions {
+		count := ReactionCount{Emoji: emoji, Count: len(chats)}
+
+		for _, chat := range chats {
+			if chat == viewer {
+				count.Mine = true
+			}
+		}
+		counts = append(counts, count)
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Emoji < counts[j].Emoji
+	})
+
+	return counts
+}
@@ -0,0 +1,335 @@
+package database
+
+import (
+	"context"
+	"darkchat/privacy"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ReadsPrefix         = "reads"
+	UnreadPrefix        = "unread"
+	ConversationsPrefix = "conversations"
+	LatestPrefix        = "latest"
+
+	// MaxConversations is the most conversations one Conversations call
+	// returns.
+	MaxConversations = 50
+)
+
+// Conversation is a chat another chat exchanged messages with, as returned by
+// Conversations: when it was last active, in unix milliseconds, its latest
+// message as the viewer may see it, how many messages the viewer received
+// since its read marker and the marker itself.
+type Conversation struct {
+	Chat   string        `json:"chat"`
+	Active int64         `json:"active"`
+	Last   *HistoryEntry `json:"last,omitempty"`
+	Unread int           `json:"unread"`
+	Read   string        `json:"read,omitempty"`
+}
+
+// markReadScript moves the read marker of KEYS[2] for the chat ARGV[1] up to
+// the id ARGV[2], never back, and drops the ids up to the marker from the
+// unread set KEYS[1]. Members of the unread set are "<id>" or
+// "<id>|<expires>", scored by the time part of the id. ARGV[3] and ARGV[4]
+// are the time and sequence parts of ARGV[2], passed as strings because Lua
+// prints large numbers in exponent notation.
+var markReadScript = redis.NewScript(`
+local function parse(id)
+	local ms, seq = string.match(id, '^(%d+)-(%d+)')
+	return ms, tonumber(ms), tonumber(seq)
+end
+
+local raw, ms, seq = ARGV[3], tonumber(ARGV[3]), tonumber(ARGV[4])
+local marker = ARGV[2]
+
+local current = redis.call('HGET', KEYS[2], ARGV[1])
+if current then
+	local craw, cms, cseq = parse(current)
+	if cms and (cms > ms or (cms == ms and cseq >= seq)) then
+		raw, ms, seq, marker = craw, cms, cseq, current
+	end
+end
+
+redis.call('HSET', KEYS[2], ARGV[1], marker)
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. raw)
+
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], raw, raw)) do
+	local _, _, mseq = parse(member)
+	if mseq and mseq <= seq then
+		redis.call('ZREM', KEYS[1], member)
+	end
+end
+return marker
+`)
+
+// unreadScript counts the members of each unread set in KEYS, dropping those
+// that expired at or before ARGV[1].
+var unreadScript = redis.NewScript(`
+local counts = {}
+for i, key in ipairs(KEYS) do
+	local count = 0
+	for _, member in ipairs(redis.call('ZRANGE', key, 0, -1)) do
+		local expires = string.match(member, '|(%d+)$')
+		if expires and tonumber(expires) <= tonumber(ARGV[1]) then
+			redis.call('ZREM', key, member)
+		else
+			count = count + 1
+		end
+	end
+	counts[i] = count
+end
+return counts
+`)
+
+func readsKey(chatId string) string {
+	return fmt.Sprintf("%s:%s", ReadsPrefix, chatId)
+}
+
+// unreadKey returns the key of the set of messages chatId received from
+// other and has not read yet.
+func unreadKey(chatId string, other string) string {
+	return fmt.Sprintf("%s:%s:%s", UnreadPrefix, chatId, other)
+}
+
+// conversationsKey returns the key of the set of chats a chat exchanged
+// messages with, scored by when the latest one was posted.
+func conversationsKey(chatId string) string {
+	return fmt.Sprintf("%s:%s", ConversationsPrefix, chatId)
+}
+
+// latestKey returns the key of the hash holding the latest message of each
+// of a chat's conversations, as a MessageRef.
+func latestKey(chatId string) string {
+	return fmt.Sprintf("%s:%s", LatestPrefix, chatId)
+}
+
+// unreadMember returns the member of an unread set for a message, carrying
+// its expiry so the count can leave it out once it has disappeared.
+func unreadMember(id string, expires int64) string {
+	if expires > 0 {
+		return id + "|" + strconv.FormatInt(expires, 10)
+	}
+	return id
+}
+
+// trackConversation records a message from sender to chatId as the latest
+// of their conversation on both sides, and as unread by chatId.
+func trackConversation(ctx context.Context, sender string, chatId string, id string, expires int64) error {
+	posted, err := idTime(id)
+	if err != nil {
+		return err
+	}
+
+	score := float64(posted.UnixMilli())
+	ref := MessageRef{Chat: chatId, ID: id}.String()
+
+	pipe := redisClient.TxPipeline()
+	pipe.ZAdd(ctx, conversationsKey(chatId), redis.Z{Score: score, Member: sender})
+	pipe.HSet(ctx, latestKey(chatId), sender, ref)
+
+	if sender != chatId {
+		pipe.ZAdd(ctx, conversationsKey(sender), redis.Z{Score: score, Member: chatId})
+		pipe.HSet(ctx, latestKey(sender), chatId, ref)
+
+		pipe.ZAdd(ctx, unreadKey(chatId, sender), redis.Z{Score: score, Member: unreadMember(id, expires)})
+		trackKey(ctx, pipe, chatId, unreadKey(chatId, sender))
+	}
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// forgetConversations takes a chat that is being deleted off the
+// conversation lists of the chats it exchanged messages with, along with
+// their read markers and unread counts for it.
+func forgetConversations(ctx context.Context, chatId string) error {
+	others, err := redisClient.ZRange(ctx, conversationsKey(chatId), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	if len(others) == 0 {
+		return nil
+	}
+
+	pipe := redisClient.TxPipeline()
+
+	for _, other := range others {
+		if other == chatId {
+			continue
+		}
+
+		pipe.ZRem(ctx, conversationsKey(other), chatId)
+		pipe.HDel(ctx, latestKey(other), chatId)
+		pipe.HDel(ctx, readsKey(other), chatId)
+		pipe.Del(ctx, unreadKey(other, chatId))
+		pipe.SRem(ctx, refsKey(other), unreadKey(other, chatId))
+	}
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// forgetUnread returns the members of the unread set of chatId for a message
+// from sender, for the deletion of the message to remove.
+func forgetUnread(ctx context.Context, tx *redis.Tx, chatId string, sender string, id string) ([]interface{}, error) {
+	posted, err := idTime(id)
+	if err != nil {
+		return nil, err
+	}
+
+	score := strconv.FormatInt(posted.UnixMilli(), 10)
+
+	members, err := tx.ZRangeByScore(ctx, unreadKey(chatId, sender), &redis.ZRangeBy{Min: score, Max: score}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var forget []interface{}
+	for _, member := range members {
+		if member == id || strings.HasPrefix(member, id+"|") {
+			forget = append(forget, member)
+		}
+	}
+	return forget, nil
+}
+
+// MarkRead moves the read marker of chatId in its conversation with other up
+// to the given message id. Markers only move forward, marking an older id
+// read changes nothing. It returns the marker and how many messages from
+// other are still unread. Nothing is tracked in privacy mode, where it
+// returns ErrPrivacyMode.
+func MarkRead(chatId string, other string, id string) (string, int, error) {
+	if privacy.Enabled() {
+		return "", 0, ErrPrivacyMode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return "", 0, fmt.Errorf("%w: malformed id %q", ErrMessageNotFound, id)
+	}
+
+	key := unreadKey(chatId, other)
+
+	marker, err := markReadScript.Run(ctx, redisClient, []string{key, readsKey(chatId)}, other, id, ms, seq).Text()
+	if err != nil {
+		return "", 0, err
+	}
+
+	counts, err := unreadScript.Run(ctx, redisClient, []string{key}, time.Now().UnixMilli()).Int64Slice()
+	if err != nil || len(counts) != 1 {
+		return marker, 0, err
+	}
+	return marker, int(counts[0]), nil
+}
+
+// Conversations returns up to limit conversations of a chat, the most
+// recently active first, starting with those active before the given time in
+// unix milliseconds, or with the latest when before is zero. Conversations
+// are not tracked in privacy mode, where it returns ErrPrivacyMode.
+func Conversations(chatId string, before int64, limit int) ([]Conversation, error) {
+	if privacy.Enabled() {
+		return nil, ErrPrivacyMode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	if limit <= 0 || limit > MaxConversations {
+		limit = MaxConversations
+	}
+
+	max := "+inf"
+	if before > 0 {
+		max = "(" + strconv.FormatInt(before, 10)
+	}
+
+	chats, err := redisClient.ZRevRangeByScoreWithScores(ctx, conversationsKey(chatId), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   max,
+		Count: int64(limit),
+	}).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chats) == 0 {
+		return []Conversation{}, nil
+	}
+
+	others := make([]string, len(chats))
+	keys := make([]string, len(chats))
+
+	for i, chat := range chats {
+		others[i], _ = chat.Member.(string)
+		keys[i] = unreadKey(chatId, others[i])
+	}
+
+	pipe := redisClient.Pipeline()
+	latestCmd := pipe.HMGet(ctx, latestKey(chatId), others...)
+	readsCmd := pipe.HMGet(ctx, readsKey(chatId), others...)
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	counts, err := unreadScript.Run(ctx, redisClient, keys, now.UnixMilli()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]MessageRef, 0, len(chats))
+	latest := make([]int, len(chats))
+
+	for i := range chats {
+		latest[i] = -1
+
+		raw, _ := latestCmd.Val()[i].(string)
+		if ref, ok := parseRef(raw); ok {
+			latest[i] = len(refs)
+			refs = append(refs, ref)
+		}
+	}
+
+	messages, err := loadMessages(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := make([]Conversation, len(chats))
+
+	for i, chat := range chats {
+		conversation := Conversation{Chat: others[i], Active: int64(chat.Score)}
+
+		if i < len(counts) {
+			conversation.Unread = int(counts[i])
+		}
+
+		conversation.Read, _ = readsCmd.Val()[i].(string)
+
+		if j := latest[i]; j >= 0 {
+			if last, err := threadEntryOf(refs[j], messages[j], chatId, now); err == nil {
+				conversation.Last = &last
+			}
+		}
+
+		conversations[i] = conversation
+	}
+
+	return conversations, nil
+}
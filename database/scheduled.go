@@ -0,0 +1,362 @@
+package database
+
+import (
+	"context"
+	"darkchat/monitor"
+	"darkchat/privacy"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ScheduledKey   = "scheduled"
+	ClaimedKey     = "scheduled:claimed"
+	SchedulePrefix = "schedule"
+	PendingPrefix  = "pending"
+
+	// MaxScheduled is how many scheduled messages one chat may have
+	// pending.
+	MaxScheduled = 100
+
+	// MaxScheduleDelay is how far ahead a message can be scheduled.
+	MaxScheduleDelay = 30 * 24 * time.Hour
+
+	// DEFAULTSCHEDULEINTERVAL is how often due messages are looked for.
+	DEFAULTSCHEDULEINTERVAL = time.Second
+
+	// MaxScheduleAttempts is how many times delivering a scheduled message
+	// is tried before it is given up on.
+	MaxScheduleAttempts = 5
+
+	// scheduleLease is how long a node has to deliver a message it claimed.
+	// Messages it did not deliver in time, because it failed or stopped, are
+	// claimed again by whichever node looks next. The lease of the messages
+	// still waiting in a batch is renewed before each delivery.
+	scheduleLease = 30 * time.Second
+
+	// scheduleTimeout is how long delivering one scheduled message may take,
+	// well within its lease.
+	scheduleTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidSchedule   = errors.New("delivery time must be in the future and within the schedule limit")
+	ErrTooManyScheduled  = errors.New("too many scheduled messages")
+	ErrScheduledNotFound = errors.New("scheduled message not found")
+)
+
+// ScheduledMessage is a message waiting to be delivered at a later time.
+// Due and Created are in unix milliseconds. Identity and Device are set when
+// it was scheduled from an authenticated device, so the identity's other
+// devices get a copy once it is delivered. Attempts counts the deliveries
+// tried so far.
+type ScheduledMessage struct {
+	ID       string `json:"id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Message  string `json:"message"`
+	Due      int64  `json:"due"`
+	Created  int64  `json:"created"`
+	Identity string `json:"identity,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+// scheduleScript stores the scheduled message ARGV[1], with the id ARGV[3],
+// to be delivered at ARGV[2]: KEYS[1] is its record, KEYS[2] the set of all
+// scheduled messages and KEYS[3] the sender's pending ones. It returns 0
+// without storing anything if the sender already has ARGV[4] pending.
+var scheduleScript = redis.NewScript(`
+if redis.call('ZCARD', KEYS[3]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[2], ARGV[3])
+return 1
+`)
+
+// cancelScript removes the scheduled message ARGV[1] of the sender whose
+// pending set is KEYS[1]. It returns 0 if the message is not the sender's or
+// was already claimed for delivery.
+var cancelScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('DEL', KEYS[3])
+return 1
+`)
+
+// claimScript claims up to ARGV[3] messages due by ARGV[1], along with those
+// whose earlier claim lapsed, and returns their ids. Claimed messages move
+// from KEYS[1] to KEYS[2] scored by the end of the lease ARGV[2], so each
+// is delivered by one node at a time.
+var claimScript = redis.NewScript(`
+local lapsed = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[3]))
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[3]) - #lapsed)
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[1], id)
+	table.insert(lapsed, id)
+end
+for _, id in ipairs(lapsed) do
+	redis.call('ZADD', KEYS[2], ARGV[2], id)
+end
+return lapsed
+`)
+
+func scheduleKey(id string) string {
+	return fmt.Sprintf("%s:%s", SchedulePrefix, id)
+}
+
+// pendingKey returns the key of the set of a chat's scheduled messages,
+// scored by when they are due.
+func pendingKey(chatId string) string {
+	return fmt.Sprintf("%s:%s", PendingPrefix, chatId)
+}
+
+// ScheduleMessage stores a message to be delivered at the given time, which
+// must be in the future and at most MaxScheduleDelay away. The caller fills
+// in From, To, Message and, for a device, Identity and Device. It returns
+// the message with its id. The text would have to be kept until the
+// message is due, so nothing is scheduled in privacy mode, where it returns
+// ErrPrivacyMode.
+func ScheduleMessage(scheduled ScheduledMessage, due time.Time, now time.Time) (ScheduledMessage, error) {
+	if privacy.Enabled() {
+		return scheduled, ErrPrivacyMode
+	}
+
+	scheduled.ID = uuid.NewString()
+	scheduled.Due = due.UnixMilli()
+	scheduled.Created = now.UnixMilli()
+	scheduled.Attempts = 0
+
+	if !due.After(now) || due.Sub(now) > MaxScheduleDelay {
+		return scheduled, fmt.Errorf("%w: limit is %s", ErrInvalidSchedule, MaxScheduleDelay)
+	}
+
+	encoded, err := json.Marshal(scheduled)
+	if err != nil {
+		return scheduled, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	stored, err := scheduleScript.Run(ctx, redisClient,
+		[]string{scheduleKey(scheduled.ID), ScheduledKey, pendingKey(scheduled.From)},
+		encoded, scheduled.Due, scheduled.ID, MaxScheduled,
+	).Int()
+
+	if err != nil {
+		return scheduled, err
+	}
+
+	if stored == 0 {
+		return scheduled, fmt.Errorf("%w: limit is %d", ErrTooManyScheduled, MaxScheduled)
+	}
+	return scheduled, nil
+}
+
+// ScheduledMessages returns the messages a chat scheduled that were not
+// delivered yet, the earliest due first.
+func ScheduledMessages(chatId string) ([]ScheduledMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	ids, err := redisClient.ZRange(ctx, pendingKey(chatId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled := make([]ScheduledMessage, 0, len(ids))
+
+	if len(ids) == 0 {
+		return scheduled, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = scheduleKey(id)
+	}
+
+	records, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		raw, ok := record.(string)
+		if !ok {
+			continue
+		}
+
+		var message ScheduledMessage
+		if err := json.Unmarshal([]byte(raw), &message); err == nil {
+			scheduled = append(scheduled, message)
+		}
+	}
+
+	return scheduled, nil
+}
+
+// CancelScheduled cancels a message the chat scheduled. Messages that are
+// being delivered can no longer be canceled.
+func CancelScheduled(chatId string, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	canceled, err := cancelScript.Run(ctx, redisClient, []string{pendingKey(chatId), ScheduledKey, scheduleKey(id)}, id).Int()
+	if err != nil {
+		return err
+	}
+
+	if canceled == 0 {
+		return ErrScheduledNotFound
+	}
+	return nil
+}
+
+// DeliverScheduled passes scheduled messages to deliver once they are due,
+// looking for them at the given interval until the context is canceled.
+// Several nodes can run it at once, each message is claimed by one of them.
+// A message deliver fails on is tried again once its claim lapses, so it is
+// delivered at least once, up to MaxScheduleAttempts times. Messages given up
+// on are passed to fail and dropped.
+func DeliverScheduled(ctx context.Context, interval time.Duration, deliver func(context.Context, ScheduledMessage) error, fail func(context.Context, ScheduledMessage)) {
+	if interval <= 0 {
+		interval = DEFAULTSCHEDULEINTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := deliverDue(ctx, time.Now(), deliver, fail); err != nil {
+				databaseMonitor.Error("Delivering scheduled messages failed", monitor.F(monitor.KeyError, err))
+			}
+		}
+	}
+}
+
+// deliverDue claims the messages due by now and passes them to deliver one
+// at a time. It removes the messages it delivered or gave up on.
+func deliverDue(parent context.Context, now time.Time, deliver func(context.Context, ScheduledMessage) error, fail func(context.Context, ScheduledMessage)) error {
+	ctx, cancel := context.WithTimeout(parent, 5*time.Second)
+
+	ids, err := claimScript.Run(ctx, redisClient, []string{ScheduledKey, ClaimedKey}, now.UnixMilli(), now.Add(scheduleLease).UnixMilli(), 100).StringSlice()
+	cancel()
+
+	if err != nil {
+		return err
+	}
+
+	for i := range ids {
+		if err := deliverClaimed(parent, ids[i:], now, deliver, fail); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliverClaimed delivers the first of the claimed messages ids, within
+// scheduleTimeout, after renewing the lease of all of them so none lapses
+// while the batch is worked through.
+func deliverClaimed(parent context.Context, ids []string, now time.Time, deliver func(context.Context, ScheduledMessage) error, fail func(context.Context, ScheduledMessage)) error {
+	ctx, cancel := context.WithTimeout(parent, scheduleTimeout)
+
+	defer cancel()
+
+	if err := renewLease(ctx, ids, now); err != nil {
+		return err
+	}
+
+	message, ok, err := startAttempt(ctx, ids[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	if message.Attempts > MaxScheduleAttempts {
+		databaseMonitor.Error("Giving up on scheduled message", monitor.F(monitor.KeyChatID, message.To), monitor.F("attempts", MaxScheduleAttempts))
+		fail(ctx, message)
+	} else if err := deliver(ctx, message); err != nil {
+		databaseMonitor.Error("Delivering scheduled message failed", monitor.F(monitor.KeyChatID, message.To), monitor.F(monitor.KeyError, err))
+		return nil
+	}
+
+	return forgetScheduled(ctx, message)
+}
+
+// renewLease extends the claim on the given messages to a lease from now,
+// or from the current time if the batch has been running for a while.
+func renewLease(ctx context.Context, ids []string, now time.Time) error {
+	if current := time.Now(); current.After(now) {
+		now = current
+	}
+
+	members := make([]redis.Z, len(ids))
+	for i, id := range ids {
+		members[i] = redis.Z{Score: float64(now.Add(scheduleLease).UnixMilli()), Member: id}
+	}
+	return redisClient.ZAddXX(ctx, ClaimedKey, members...).Err()
+}
+
+// startAttempt loads a claimed message and counts the attempt to deliver it
+// before it is made, so a message that brings its node down is given up on
+// too. It reports false for messages that are gone or cannot be decoded,
+// dropping what is left of them.
+func startAttempt(ctx context.Context, id string) (ScheduledMessage, bool, error) {
+	var message ScheduledMessage
+
+	raw, err := redisClient.Get(ctx, scheduleKey(id)).Result()
+
+	if err == redis.Nil {
+		return message, false, redisClient.ZRem(ctx, ClaimedKey, id).Err()
+	}
+
+	if err != nil {
+		return message, false, err
+	}
+
+	if err := json.Unmarshal([]byte(raw), &message); err != nil {
+		databaseMonitor.Error("Decoding scheduled message failed", monitor.F(monitor.KeyError, err))
+		redisClient.Del(ctx, scheduleKey(id))
+		return message, false, redisClient.ZRem(ctx, ClaimedKey, id).Err()
+	}
+
+	message.Attempts++
+
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return message, false, err
+	}
+	return message, true, redisClient.Set(ctx, scheduleKey(id), encoded, redis.KeepTTL).Err()
+}
+
+// forgetScheduled removes a message that was delivered or given up on.
+func forgetScheduled(ctx context.Context, message ScheduledMessage) error {
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, scheduleKey(message.ID))
+	pipe.ZRem(ctx, ClaimedKey, message.ID)
+	pipe.ZRem(ctx, pendingKey(message.From), message.ID)
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,407 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"darkchat/monitor"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	SessionPrefix       = "session"
+	DetachedSessionsKey = "sessions:detached"
+	AttachedSessionsKey = "sessions:attached"
+	TakeoverChannel     = "sessions:takeover"
+
+	// SessionLease is how long an attached session stays attached without
+	// its connection being heard from. Sessions of a node that stopped
+	// without detaching them are detached by SweepSessions once their
+	// lease lapses, and their chats deleted after the grace period.
+	SessionLease = 2 * time.Minute
+
+	// DEFAULTSESSIONGRACE is how long a chat is kept for its session to be
+	// resumed after the connection drops.
+	DEFAULTSESSIONGRACE = 2 * time.Minute
+
+	// DEFAULTSESSIONSWEEP is how often chats whose grace period ran out are
+	// deleted.
+	DEFAULTSESSIONSWEEP = 5 * time.Second
+)
+
+var (
+	ErrUnknownSession   = errors.New("unknown or expired session")
+	ErrSessionTakenOver = errors.New("session was resumed by another connection")
+)
+
+// Session is what is needed to pick a chat up again on a new connection: the
+// chat, the identity bound to it, the device of the identity it
+// authenticated as and the identity whose presence it announced.
+type Session struct {
+	ChatID   string
+	Identity string
+	Device   string
+	Present  string
+}
+
+// resumeScript claims the session KEYS[1] for the connection ARGV[2], with a
+// lease in KEYS[3] until ARGV[3]. It returns the connection the session was
+// attached to, which the caller takes it over from, an empty string if it
+// was waiting to be resumed, and nil if there is no such session or it is
+// being swept.
+var resumeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local owner = ''
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 1 then
+	redis.call('PERSIST', KEYS[1])
+else
+	owner = redis.call('HGET', KEYS[1], 'owner') or ''
+	if owner == '' then
+		return false
+	end
+end
+redis.call('HSET', KEYS[1], 'owner', ARGV[2])
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+return owner
+`)
+
+// saveScript stores the state ARGV[2] to ARGV[4] of the session KEYS[1] if
+// it is still attached to the connection ARGV[1], and returns 0 if it is not.
+// The session's lease in KEYS[3] is renewed until ARGV[8]. With a deadline
+// ARGV[5] the session is detached instead: it waits in KEYS[2] to be resumed
+// until then, its key expiring at ARGV[6].
+var saveScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'owner') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'identity', ARGV[2], 'device', ARGV[3], 'present', ARGV[4])
+if ARGV[5] ~= '' then
+	redis.call('HSET', KEYS[1], 'owner', '')
+	redis.call('PEXPIREAT', KEYS[1], ARGV[6])
+	redis.call('ZADD', KEYS[2], ARGV[5], ARGV[7])
+	redis.call('ZREM', KEYS[3], ARGV[7])
+else
+	redis.call('ZADD', KEYS[3], ARGV[8], ARGV[7])
+end
+return 1
+`)
+
+// renewScript extends the lease in KEYS[2] of the session KEYS[1] to ARGV[3]
+// if it is still attached to the connection ARGV[1], and returns 0 if it is
+// not.
+var renewScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'owner') ~= ARGV[1] then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+return 1
+`)
+
+// lapseScript detaches up to ARGV[2] sessions whose lease in KEYS[1] lapsed
+// by ARGV[1], as the connection they were attached to would have when
+// closing: they wait in KEYS[2] to be resumed until ARGV[3], their keys,
+// named ARGV[5] followed by the member, expiring at ARGV[4].
+var lapseScript = redis.NewScript(`
+local lapsed = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, member in ipairs(lapsed) do
+	redis.call('ZREM', KEYS[1], member)
+	local key = ARGV[5] .. ':' .. member
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('HSET', key, 'owner', '')
+		redis.call('PEXPIREAT', key, ARGV[4])
+		redis.call('ZADD', KEYS[2], ARGV[3], member)
+	end
+end
+return #lapsed
+`)
+
+// sweepScript claims up to ARGV[2] sessions whose grace period ended by
+// ARGV[1] and returns them, so each is cleaned up by exactly one node.
+var sweepScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, member in ipairs(due) do
+	redis.call('ZREM', KEYS[1], member)
+end
+return due
+`)
+
+// sessionKey returns the Redis key of a session. As for delivery tokens only
+// a hash of the token is stored.
+func sessionKey(token string) string {
+	return fmt.Sprintf("%s:%s", SessionPrefix, tokenHash(token))
+}
+
+// tokenHash returns the hex encoded SHA-256 of a token.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a resumable session for a chat, attached to the given
+// connection for SessionLease, and returns its token. The connection renews
+// the lease with RenewSession.
+func CreateSession(chatId string, owner string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	raw := make([]byte, 32)
+
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, sessionKey(token), "chat_id", chatId, "owner", owner)
+	pipe.ZAdd(ctx, AttachedSessionsKey, redis.Z{Score: float64(time.Now().Add(SessionLease).UnixMilli()), Member: tokenHash(token)})
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// SaveSession records the state of a session while its connection is
+// attached, so a connection taking the session over picks it up, and renews
+// its lease. It returns ErrSessionTakenOver once another connection resumed
+// the session.
+func SaveSession(token string, owner string, session Session) error {
+	return saveSession(token, owner, session, time.Time{})
+}
+
+// RenewSession extends the lease of a session whose connection is still
+// there. It returns ErrSessionTakenOver once another connection resumed the
+// session.
+func RenewSession(token string, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	renewed, err := renewScript.Run(ctx, redisClient, []string{sessionKey(token), AttachedSessionsKey},
+		owner, tokenHash(token), time.Now().Add(SessionLease).UnixMilli(),
+	).Int()
+
+	if err != nil {
+		return err
+	}
+
+	if renewed == 0 {
+		return ErrSessionTakenOver
+	}
+	return nil
+}
+
+// DetachSession records the state of a session whose connection dropped and
+// keeps its chat for the grace period. If it is not resumed by then the chat
+// is deleted by SweepSessions. It returns ErrSessionTakenOver if another
+// connection resumed the session already, the chat is then no longer the
+// caller's.
+func DetachSession(token string, owner string, session Session, grace time.Duration) error {
+	return saveSession(token, owner, session, time.Now().Add(grace))
+}
+
+func saveSession(token string, owner string, session Session, deadline time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	var detach, expire interface{} = "", ""
+
+	if !deadline.IsZero() {
+		detach = deadline.UnixMilli()
+		// The key outlives the deadline in case no node is left to sweep it.
+		expire = deadline.Add(time.Hour).UnixMilli()
+	}
+
+	saved, err := saveScript.Run(ctx, redisClient, []string{sessionKey(token), DetachedSessionsKey, AttachedSessionsKey},
+		owner, session.Identity, session.Device, session.Present, detach, expire, tokenHash(token),
+		time.Now().Add(SessionLease).UnixMilli(),
+	).Int()
+
+	if err != nil {
+		return err
+	}
+
+	if saved == 0 {
+		return ErrSessionTakenOver
+	}
+	return nil
+}
+
+// ResumeSession claims a session for a new connection and returns it, along
+// with the connection it was still attached to, if any. That connection has
+// not been noticed to be gone yet, or is still there: it is told to let go
+// of the session with PublishTakeover. ResumeSession returns
+// ErrUnknownSession once the grace period is over.
+func ResumeSession(token string, owner string) (Session, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	var session Session
+
+	previous, err := resumeScript.Run(ctx, redisClient, []string{sessionKey(token), DetachedSessionsKey, AttachedSessionsKey},
+		tokenHash(token), owner, time.Now().Add(SessionLease).UnixMilli(),
+	).Text()
+
+	if err == redis.Nil {
+		return session, "", ErrUnknownSession
+	}
+
+	if err != nil {
+		return session, "", err
+	}
+
+	session, err = loadSession(ctx, sessionKey(token))
+	return session, previous, err
+}
+
+// PublishTakeover tells every node that the connection owner lost its
+// session to another connection.
+func PublishTakeover(ctx context.Context, owner string) error {
+	return redisClient.Publish(ctx, TakeoverChannel, owner).Err()
+}
+
+// SubscribeTakeovers passes the id of every connection that lost its session
+// to release, which closes it if it is local, until the context is canceled.
+func SubscribeTakeovers(ctx context.Context, release func(owner string)) {
+	pubsub := redisClient.Subscribe(ctx, TakeoverChannel)
+
+	defer pubsub.Close()
+
+	channel := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case message, ok := <-channel:
+			if !ok {
+				return
+			}
+			release(message.Payload)
+		}
+	}
+}
+
+// EndSession forgets a session for good, when its connection closed and it
+// is not to be resumed or its chat was given up for another.
+func EndSession(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, sessionKey(token))
+	pipe.ZRem(ctx, DetachedSessionsKey, tokenHash(token))
+	pipe.ZRem(ctx, AttachedSessionsKey, tokenHash(token))
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func loadSession(ctx context.Context, key string) (Session, error) {
+	var session Session
+
+	values, err := redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		return session, err
+	}
+
+	if values["chat_id"] == "" {
+		return session, ErrUnknownSession
+	}
+
+	session.ChatID = values["chat_id"]
+	session.Identity = values["identity"]
+	session.Device = values["device"]
+	session.Present = values["present"]
+
+	return session, nil
+}
+
+// SweepSessions deletes the chats of sessions that were not resumed within
+// their grace period, at the given interval until the context is canceled.
+// Sessions whose lease lapsed while attached are detached first, with the
+// given grace period.
+func SweepSessions(ctx context.Context, interval time.Duration, grace time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULTSESSIONSWEEP
+	}
+
+	if grace <= 0 {
+		grace = DEFAULTSESSIONGRACE
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sweepSessions(ctx, time.Now(), grace); err != nil {
+				databaseMonitor.Error("Sweeping sessions failed", monitor.F(monitor.KeyError, err))
+			}
+		}
+	}
+}
+
+func sweepSessions(parent context.Context, now time.Time, grace time.Duration) error {
+	ctx, cancel := context.WithTimeout(parent, 5*time.Second)
+
+	defer cancel()
+
+	deadline := now.Add(grace)
+
+	// As in saveSession the key outlives the deadline in case no node is
+	// left to sweep it.
+	err := lapseScript.Run(ctx, redisClient, []string{AttachedSessionsKey, DetachedSessionsKey},
+		now.UnixMilli(), 100, deadline.UnixMilli(), deadline.Add(time.Hour).UnixMilli(), SessionPrefix,
+	).Err()
+
+	if err != nil {
+		return err
+	}
+
+	due, err := sweepScript.Run(ctx, redisClient, []string{DetachedSessionsKey}, now.UnixMilli(), 100).StringSlice()
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range due {
+		key := fmt.Sprintf("%s:%s", SessionPrefix, hash)
+
+		session, err := loadSession(ctx, key)
+		if err != nil {
+			databaseMonitor.Error("Loading expired session failed", monitor.F(monitor.KeyError, err))
+			continue
+		}
+
+		if err := DeleteClientChat(session.ChatID); err != nil {
+			databaseMonitor.Error(err.Error(), monitor.F(monitor.KeyChatID, session.ChatID))
+		}
+
+		if session.Identity != "" {
+			if err := UnbindIdentity(session.Identity, session.ChatID); err != nil && err != ErrNotBound {
+				databaseMonitor.Error(err.Error(), monitor.F(monitor.KeyChatID, session.ChatID))
+			}
+		}
+
+		redisClient.Del(ctx, key)
+	}
+	return nil
+}
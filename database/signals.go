@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"darkchat/monitor"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const SignalChannelPrefix = "signals"
+
+// Signal is an ephemeral notification, such as a typing indicator, for a
+// chat or, when To is an IdentityChat, the devices of an identity. Signals go
+// through Redis pub/sub and are never stored: whoever is not connected when
+// one is published never sees it.
+type Signal struct {
+	To           string          `json:"to"`
+	From         string          `json:"from"`
+	FromIdentity string          `json:"from_identity,omitempty"`
+	Kind         string          `json:"kind"`
+	Body         json.RawMessage `json:"body,omitempty"`
+}
+
+// PublishSignal sends a signal to every node. It returns the number of nodes
+// listening, which is zero when no node could deliver it.
+func PublishSignal(ctx context.Context, signal Signal) (int64, error) {
+	encoded, err := json.Marshal(signal)
+	if err != nil {
+		return 0, err
+	}
+
+	return redisClient.Publish(ctx, fmt.Sprintf("%s:%s", SignalChannelPrefix, signal.To), encoded).Result()
+}
+
+// SubscribeSignals passes every signal published by any node to deliver,
+// which routes it to the local connections it is for, until the context is
+// canceled.
+func SubscribeSignals(ctx context.Context, deliver func(Signal)) {
+	pubsub := redisClient.PSubscribe(ctx, SignalChannelPrefix+":*")
+
+	defer pubsub.Close()
+
+	channel := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case message, ok := <-channel:
+			if !ok {
+				return
+			}
+
+			var signal Signal
+
+			if err := json.Unmarshal([]byte(message.Payload), &signal); err != nil {
+				databaseMonitor.Error("Malformed signal", monitor.F(monitor.KeyError, err))
+				continue
+			}
+
+			signal.To = strings.TrimPrefix(message.Channel, SignalChannelPrefix+":")
+
+			deliver(signal)
+		}
+	}
+}
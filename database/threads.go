@@ -0,0 +1,414 @@
+package database
+
+import (
+	"context"
+	"darkchat/monitor"
+	"darkchat/privacy"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ThreadPrefix = "thread"
+	RefsPrefix   = "refs"
+
+	// MaxQuote is the longest excerpt of a message quoted in a reply, in
+	// bytes.
+	MaxQuote = 200
+)
+
+var ErrNotParty = errors.New("message is not part of this conversation")
+
+// MessageRef names a message by the chat whose stream it is in and the id it
+// was given there.
+type MessageRef struct {
+	Chat string `json:"chat"`
+	ID   string `json:"id"`
+}
+
+// String returns the reference as stored in Redis, "<chat>|<id>".
+func (r MessageRef) String() string {
+	return r.Chat + "|" + r.ID
+}
+
+// parseRef reads a reference written by MessageRef.String.
+func parseRef(s string) (MessageRef, bool) {
+	chat, id, ok := strings.Cut(s, "|")
+	if !ok || chat == "" || id == "" {
+		return MessageRef{}, false
+	}
+	return MessageRef{Chat: chat, ID: id}, true
+}
+
+// Reply is what a reply refers to: the message it answers and the first
+// message of the thread. Quote asks for an excerpt of the message it answers
+// to be shown with it. The excerpt is taken from that message whenever the
+// reply is read, so it never outlives the message or an edit of it.
+type Reply struct {
+	To     MessageRef
+	Thread MessageRef
+	Quote  bool
+}
+
+// Referenced is a message that can be replied to or reacted to, as loaded by
+// LoadReference.
+type Referenced struct {
+	Ref    MessageRef
+	Sender string
+	Text   string
+	Thread MessageRef
+
+	expires int64
+}
+
+// entryReply returns the reply references stored with a stream entry and
+// whether the reply quotes the message it answers.
+func entryReply(values map[string]interface{}) (*MessageRef, *MessageRef, bool) {
+	raw, _ := values["reply_to"].(string)
+
+	replyTo, ok := parseRef(raw)
+	if !ok {
+		return nil, nil, false
+	}
+
+	raw, _ = values["thread"].(string)
+	thread, _ := parseRef(raw)
+
+	return &replyTo, &thread, values["quote"] == "1"
+}
+
+func threadKey(root MessageRef) string {
+	return fmt.Sprintf("%s:%s:%s", ThreadPrefix, root.Chat, root.ID)
+}
+
+func refsKey(chatId string) string {
+	return fmt.Sprintf("%s:%s", RefsPrefix, chatId)
+}
+
+// trackKey records a key that belongs to a chat, such as a thread or the
+// reactions to one of its messages, so it is deleted along with the chat.
+func trackKey(ctx context.Context, pipe redis.Pipeliner, chatId string, key string) {
+	pipe.SAdd(ctx, refsKey(chatId), key)
+}
+
+// deleteChatKeys deletes what is kept about a chat besides its stream: its
+// timers, edits, tombstones, read markers, conversations and every key
+// tracked for it, and takes it off the conversation lists of the chats it
+// talked to.
+func deleteChatKeys(ctx context.Context, chatId string) error {
+	if err := forgetConversations(ctx, chatId); err != nil {
+		return err
+	}
+
+	keys, err := redisClient.SMembers(ctx, refsKey(chatId)).Result()
+	if err != nil {
+		return err
+	}
+
+	keys = append(keys,
+		fmt.Sprintf("%s:%s", TimersPrefix, chatId),
+		editsKey(chatId),
+		tombstonesKey(chatId),
+		readsKey(chatId),
+		conversationsKey(chatId),
+		latestKey(chatId),
+		refsKey(chatId),
+	)
+
+	return redisClient.Del(ctx, keys...).Err()
+}
+
+// storedMessage is a message as read from Redis: its stream entry, nil once
+// it is gone from the stream, and its edit record.
+type storedMessage struct {
+	entry  *redis.XMessage
+	record editRecord
+}
+
+// loadMessages reads the given messages in a single round trip.
+func loadMessages(ctx context.Context, refs []MessageRef) ([]storedMessage, error) {
+	messages := make([]storedMessage, len(refs))
+
+	if len(refs) == 0 {
+		return messages, nil
+	}
+
+	entryCmds := make([]*redis.XMessageSliceCmd, len(refs))
+	editCmds := make([]*redis.StringCmd, len(refs))
+
+	pipe := redisClient.Pipeline()
+
+	for i, ref := range refs {
+		entryCmds[i] = pipe.XRange(ctx, fmt.Sprintf("%s:%s", StreamNamePrefix, ref.Chat), ref.ID, ref.ID)
+		editCmds[i] = pipe.HGet(ctx, editsKey(ref.Chat), ref.ID)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i := range refs {
+		if entries := entryCmds[i].Val(); len(entries) > 0 {
+			messages[i].entry = &entries[0]
+		}
+
+		if raw := editCmds[i].Val(); raw != "" {
+			json.Unmarshal([]byte(raw), &messages[i].record)
+		}
+	}
+	return messages, nil
+}
+
+// LoadReference loads a message to reply or react to, in its latest version.
+// Messages that are expired, deleted or are not messages are not found. Who
+// sent a message is not stored in privacy mode, nor is it kept once
+// delivered, so there is nothing to refer to and it returns ErrPrivacyMode.
+func LoadReference(ref MessageRef) (Referenced, error) {
+	if privacy.Enabled() {
+		return Referenced{Ref: ref}, ErrPrivacyMode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	messages, err := loadMessages(ctx, []MessageRef{ref})
+	if err != nil {
+		return Referenced{Ref: ref}, err
+	}
+	return referenceOf(ref, messages[0], time.Now())
+}
+
+// referenceOf turns a loaded message into a Referenced.
+func referenceOf(ref MessageRef, message storedMessage, now time.Time) (Referenced, error) {
+	referenced := Referenced{Ref: ref}
+
+	if message.entry == nil || message.entry.Values["kind"] != KindMessage || message.record.Deleted {
+		return referenced, ErrMessageNotFound
+	}
+
+	expires, expired := entryExpiry(message.entry.Values, now)
+	if expired {
+		return referenced, ErrMessageNotFound
+	}
+
+	referenced.Sender, _ = message.entry.Values["sender"].(string)
+	referenced.Text = entryText(*message.entry)
+	referenced.expires = expires
+
+	if message.record.Edited != 0 {
+		referenced.Text = message.record.Message
+	}
+
+	referenced.Thread = ref
+	if _, thread, _ := entryReply(message.entry.Values); thread != nil && thread.Chat != "" {
+		referenced.Thread = *thread
+	}
+
+	return referenced, nil
+}
+
+// resolveQuotes fills in the quotes of the replies among entries from the
+// messages they answer, as those read now. Replies to messages that are
+// gone quote nothing.
+func resolveQuotes(ctx context.Context, entries []HistoryEntry, now time.Time) error {
+	var (
+		refs    []MessageRef
+		indexes []int
+	)
+
+	for i, entry := range entries {
+		if entry.quoted && entry.ReplyTo != nil {
+			refs = append(refs, *entry.ReplyTo)
+			indexes = append(indexes, i)
+		}
+	}
+
+	messages, err := loadMessages(ctx, refs)
+	if err != nil {
+		return err
+	}
+
+	for i, message := range messages {
+		if referenced, err := referenceOf(refs[i], message, now); err == nil {
+			entries[indexes[i]].Quote = referenced.Excerpt()
+		}
+	}
+	return nil
+}
+
+// Party reports whether a chat took part in the message, as its sender or
+// its recipient.
+func (r Referenced) Party(chatId string) bool {
+	return r.Ref.Chat == chatId || (r.Sender != "" && r.Sender == chatId)
+}
+
+// Other returns the chat on the other side of the message from chatId.
+func (r Referenced) Other(chatId string) string {
+	if r.Ref.Chat == chatId {
+		return r.Sender
+	}
+	return r.Ref.Chat
+}
+
+// Excerpt returns the start of the message's text, at most MaxQuote bytes
+// and cut at a rune boundary.
+func (r Referenced) Excerpt() string {
+	if len(r.Text) <= MaxQuote {
+		return r.Text
+	}
+
+	cut := MaxQuote
+	for cut > 0 && !utf8.RuneStart(r.Text[cut]) {
+		cut--
+	}
+	return r.Text[:cut]
+}
+
+// PostReply is PostMessage for a reply. The reply is stored with its
+// references and added to its thread, which the thread's first message joins
+// on the first reply. Once stored the reply is delivered whatever happens to
+// the thread, so failing to add it there is logged rather than returned,
+// which would have the sender post it again.
+func PostReply(ctx context.Context, message string, sender string, chatId string, ttl time.Duration, reply Reply) (string, error) {
+	if privacy.Enabled() {
+		return "", ErrPrivacyMode
+	}
+
+	extra := map[string]interface{}{
+		"sender":   sender,
+		"reply_to": reply.To.String(),
+		"thread":   reply.Thread.String(),
+	}
+
+	if reply.Quote {
+		extra["quote"] = "1"
+	}
+
+	id, err := postEntry(ctx, KindMessage, message, chatId, ttl, extra)
+	if err != nil {
+		return "", err
+	}
+
+	threadCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+	defer cancel()
+
+	rootTime, _ := idTime(reply.Thread.ID)
+	replyTime, _ := idTime(id)
+	key := threadKey(reply.Thread)
+
+	pipe := redisClient.TxPipeline()
+	pipe.ZAddNX(threadCtx, key, redis.Z{Score: float64(rootTime.UnixMilli()), Member: reply.Thread.String()})
+	pipe.ZAdd(threadCtx, key, redis.Z{Score: float64(replyTime.UnixMilli()), Member: MessageRef{Chat: chatId, ID: id}.String()})
+	trackKey(threadCtx, pipe, reply.Thread.Chat, key)
+
+	if _, err := pipe.Exec(threadCtx); err != nil {
+		databaseMonitor.Ctx(ctx).Error("Adding reply to thread failed", monitor.F(monitor.KeyChatID, chatId), monitor.F(monitor.KeyMessageID, id), monitor.F(monitor.KeyError, err))
+	}
+	return id, nil
+}
+
+// Thread returns up to limit messages of the thread started by root that
+// the viewer took part in, newest first, starting before the given id or
+// with the newest when before is empty. Messages come in their latest
+// version, deleted ones as tombstones, and expired ones are dropped from the
+// thread. Messages are loaded a page at a time. There are no threads in
+// privacy mode, it returns ErrPrivacyMode.
+func Thread(root MessageRef, viewer string, before string, limit int) ([]HistoryEntry, error) {
+	if privacy.Enabled() {
+		return nil, ErrPrivacyMode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	if limit <= 0 || limit > MaxHistory {
+		limit = MaxHistory
+	}
+
+	members, err := redisClient.ZRevRange(ctx, threadKey(root), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []MessageRef
+
+	for _, member := range members {
+		ref, ok := parseRef(member)
+		if ok && (before == "" || compareIDs(ref.ID, before) < 0) {
+			refs = append(refs, ref)
+		}
+	}
+
+	now := time.Now()
+	thread := make([]HistoryEntry, 0, limit)
+
+	var gone []interface{}
+
+	for len(refs) > 0 && len(thread) < limit {
+		page := refs[:min(limit, len(refs))]
+		refs = refs[len(page):]
+
+		messages, err := loadMessages(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, message := range messages {
+			entry, err := threadEntryOf(page[i], message, viewer, now)
+
+			switch {
+			case err == ErrMessageNotFound:
+				gone = append(gone, page[i].String())
+			case err == nil && len(thread) < limit:
+				thread = append(thread, entry)
+			}
+		}
+	}
+
+	if len(gone) > 0 {
+		redisClient.ZRem(ctx, threadKey(root), gone...)
+	}
+
+	if err := resolveQuotes(ctx, thread, now); err != nil {
+		return nil, err
+	}
+	return thread, nil
+}
+
+// threadEntryOf turns a loaded message of a thread into what the viewer may
+// see of it. It returns ErrNotParty for messages the viewer did not take
+// part in.
+func threadEntryOf(ref MessageRef, message storedMessage, viewer string, now time.Time) (HistoryEntry, error) {
+	if message.entry == nil {
+		if message.record.Deleted && ref.Chat == viewer {
+			return HistoryEntry{ID: ref.ID, Chat: ref.Chat, Edited: message.record.Edited, Deleted: true}, nil
+		}
+		return HistoryEntry{}, ErrMessageNotFound
+	}
+
+	if sender, _ := message.entry.Values["sender"].(string); ref.Chat != viewer && sender != viewer {
+		return HistoryEntry{}, ErrNotParty
+	}
+
+	edits := map[string]editRecord{}
+	if message.record.Edited != 0 {
+		edits[ref.ID] = message.record
+	}
+
+	entry, ok := historyEntry(*message.entry, edits, false, now)
+	if !ok {
+		return HistoryEntry{}, ErrMessageNotFound
+	}
+
+	entry.Chat = ref.Chat
+	return entry, nil
+}
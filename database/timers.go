@@ -0,0 +1,195 @@
+package database
+
+import (
+	"context"
+	"darkchat/monitor"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	TimersPrefix = "timers"
+	ExpiringKey  = "expiring"
+
+	// MaxTTL is the longest timer a conversation can have.
+	MaxTTL = 30 * 24 * time.Hour
+
+	// DEFAULTREAPINTERVAL is how often expired entries are removed.
+	DEFAULTREAPINTERVAL = time.Second
+)
+
+// inboxTimer is the field of a chat's timers hash holding the timer it set
+// for everything delivered to it, the other fields are the timers it set for
+// what it sends to each chat.
+const inboxTimer = "*"
+
+var ErrInvalidTTL = errors.New("invalid time to live")
+
+// reapScript deletes up to ARGV[2] stream entries whose expiry, the score in
+// the expiring set, is at or before ARGV[1], along with their edits and
+// tombstones. Members are "<stream>|<id>", ARGV[3], ARGV[4] and ARGV[5] are
+// the stream, edits and tombstones key prefixes. Running it as a script makes
+// it safe for several nodes to reap at once.
+var reapScript = redis.NewScript(`
+local function pad(digits)
+	return string.rep('0', 20 - #digits) .. digits
+end
+
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, member in ipairs(due) do
+	local sep = string.find(member, '|', 1, true)
+	local stream = string.sub(member, 1, sep - 1)
+	local id = string.sub(member, sep + 1)
+	local chat = string.sub(stream, #ARGV[3] + 1)
+	redis.call('XDEL', stream, id)
+	redis.call('HDEL', ARGV[4] .. chat, id)
+	local ms, seq = string.match(id, '^(%d+)-(%d+)$')
+	if ms then
+		redis.call('ZREM', ARGV[5] .. chat, pad(ms) .. '-' .. pad(seq))
+	end
+	redis.call('ZREM', KEYS[1], member)
+end
+return #due
+`)
+
+// SetTimer sets the time to live of messages in a conversation. With an
+// empty with it applies to everything delivered to chatId, otherwise to what
+// chatId sends to with. A zero ttl removes the timer.
+func SetTimer(chatId string, with string, ttl time.Duration) error {
+	if ttl < 0 || ttl > MaxTTL {
+		return fmt.Errorf("%w: %s, limit is %s", ErrInvalidTTL, ttl, MaxTTL)
+	}
+
+	if with == "" {
+		with = inboxTimer
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	key := fmt.Sprintf("%s:%s", TimersPrefix, chatId)
+
+	if ttl == 0 {
+		return redisClient.HDel(ctx, key, with).Err()
+	}
+	return redisClient.HSet(ctx, key, with, int64(ttl/time.Millisecond)).Err()
+}
+
+// ConversationTTL returns the time to live of a message from one chat to
+// another: the shorter of the sender's timer for the recipient and the
+// recipient's timer for everything it receives, or zero if neither is set.
+// With an empty from only the recipient's timer applies.
+func ConversationTTL(from string, to string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	pipe := redisClient.Pipeline()
+
+	inbox := pipe.HGet(ctx, fmt.Sprintf("%s:%s", TimersPrefix, to), inboxTimer)
+
+	var outbox *redis.StringCmd
+	if from != "" {
+		outbox = pipe.HGet(ctx, fmt.Sprintf("%s:%s", TimersPrefix, from), to)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	var ttl time.Duration
+
+	for _, cmd := range []*redis.StringCmd{inbox, outbox} {
+		if cmd == nil {
+			continue
+		}
+
+		millis, err := cmd.Int64()
+		if err != nil {
+			continue
+		}
+
+		if timer := time.Duration(millis) * time.Millisecond; ttl == 0 || timer < ttl {
+			ttl = timer
+		}
+	}
+	return ttl, nil
+}
+
+// ReapExpired removes expired entries from every chat stream at the given
+// interval until the context is canceled.
+func ReapExpired(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULTREAPINTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := reapExpired(ctx, time.Now()); err != nil {
+				databaseMonitor.Error("Removing expired messages failed", monitor.F(monitor.KeyError, err))
+			}
+		}
+	}
+}
+
+// reapExpired removes the entries that expired by now, in batches, and
+// returns how many there were.
+func reapExpired(parent context.Context, now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(parent, 5*time.Second)
+
+	defer cancel()
+
+	const batch = 500
+
+	total := 0
+
+	for {
+		n, err := reapScript.Run(ctx, redisClient, []string{ExpiringKey}, now.UnixMilli(), batch, StreamNamePrefix+":", EditsPrefix+":", TombstonesPrefix+":").Int()
+		if err != nil {
+			return total, err
+		}
+
+		total += n
+
+		if n < batch {
+			return total, nil
+		}
+	}
+}
+
+// scheduleExpiry records when an entry expires so the reaper removes it.
+func scheduleExpiry(ctx context.Context, stream string, id string, expires int64) error {
+	return redisClient.ZAdd(ctx, ExpiringKey, redis.Z{
+		Score:  float64(expires),
+		Member: stream + "|" + id,
+	}).Err()
+}
+
+// entryExpiry returns the expiry of a stream entry in unix milliseconds, or
+// zero if it does not expire, and whether it has expired by now. Readers
+// check it because the reaper only runs every so often.
+func entryExpiry(values map[string]interface{}, now time.Time) (int64, bool) {
+	raw, ok := values["expires"].(string)
+	if !ok {
+		return 0, false
+	}
+
+	expires, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return expires, expires <= now.UnixMilli()
+}
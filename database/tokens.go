@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const DeliveryTokenPrefix = "delivery"
+
+var ErrUnknownToken = errors.New("unknown or expired delivery token")
+
+// revokeTokenScript deletes a delivery token only if it belongs to the chat
+// asking, so one client cannot revoke another's tokens.
+var revokeTokenScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// tokenKey returns the Redis key of a delivery token. Only a hash of the
+// token is stored, so the keys in Redis cannot be used to deliver anything.
+func tokenKey(token string) string {
+	return fmt.Sprintf("%s:%s", DeliveryTokenPrefix, tokenHash(token))
+}
+
+// IssueDeliveryToken creates a random token that lets whoever holds it deliver
+// to the given chat until it expires, without saying who they are.
+func IssueDeliveryToken(chatId string, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	raw := make([]byte, 32)
+
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	if err := redisClient.Set(ctx, tokenKey(token), chatId, ttl).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RedeemDeliveryToken returns the chat a delivery token delivers to, or
+// ErrUnknownToken if it does not exist or has expired. Tokens can be used
+// until they expire.
+func RedeemDeliveryToken(token string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	chatId, err := redisClient.Get(ctx, tokenKey(token)).Result()
+
+	if err == redis.Nil {
+		return "", ErrUnknownToken
+	}
+	return chatId, err
+}
+
+// RevokeDeliveryToken deletes a delivery token issued to the given chat. It
+// returns ErrUnknownToken if there is no such token for that chat.
+func RevokeDeliveryToken(token string, chatId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	removed, err := revokeTokenScript.Run(ctx, redisClient, []string{tokenKey(token)}, chatId).Int()
+	if err != nil {
+		return err
+	}
+
+	if removed == 0 {
+		return ErrUnknownToken
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package errcodes
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Code identifies a category of error exchanged between the server and
+// clients in error frames. Codes are grouped by their thousands digit:
+// 1xxx framing and payload problems, 2xxx delivery problems, 3xxx limits and
+// access control, 4xxx problems reported by clients about received messages.
+type Code uint16
+
+const (
+	Unknown Code = 1000
+
+	MalformedFrame   Code = 1001
+	FrameTooLarge    Code = 1002
+	InvalidMessage   Code = 1003
+	InvalidRecipient Code = 1004
+	UnknownOperation Code = 1005
+	InvalidRequest   Code = 1006
+	InvalidSignature Code = 1007
+
+	ChatNotFound     Code = 2001
+	DeliveryFailed   Code = 2002
+	KeysNotFound     Code = 2003
+	SessionExpired   Code = 2004
+	SessionTakenOver Code = 2005
+	DeviceNotFound   Code = 2006
+	MessageNotFound  Code = 2007
+
+	Throttled         Code = 3001
+	Banned            Code = 3002
+	ServerFull        Code = 3003
+	AccessDenied      Code = 3004
+	InvalidToken      Code = 3005
+	DeviceRevoked     Code = 3006
+	EditNotAllowed    Code = 3007
+	PrivacyRestricted Code = 3008
+
+	Undecryptable    Code = 4001
+	UnsupportedType  Code = 4002
+	ClientRejected   Code = 4003
+	ClientOverloaded Code = 4004
+)
+
+type entry struct {
+	name string
+
+	// relay marks codes that a recipient may report about a specific message
+	// and that are worth passing back to whoever sent it.
+	relay bool
+}
+
+var table = map[Code]entry{
+	Unknown:           {name: "unknown"},
+	MalformedFrame:    {name: "malformed_frame"},
+	FrameTooLarge:     {name: "frame_too_large"},
+	InvalidMessage:    {name: "invalid_message"},
+	InvalidRecipient:  {name: "invalid_recipient"},
+	UnknownOperation:  {name: "unknown_operation"},
+	InvalidRequest:    {name: "invalid_request"},
+	InvalidSignature:  {name: "invalid_signature"},
+	ChatNotFound:      {name: "chat_not_found"},
+	DeliveryFailed:    {name: "delivery_failed"},
+	KeysNotFound:      {name: "keys_not_found"},
+	SessionExpired:    {name: "session_expired"},
+	SessionTakenOver:  {name: "session_taken_over"},
+	DeviceNotFound:    {name: "device_not_found"},
+	MessageNotFound:   {name: "message_not_found"},
+	Throttled:         {name: "throttled"},
+	Banned:            {name: "banned"},
+	ServerFull:        {name: "server_full"},
+	AccessDenied:      {name: "access_denied"},
+	InvalidToken:      {name: "invalid_token"},
+	DeviceRevoked:     {name: "device_revoked"},
+	EditNotAllowed:    {name: "edit_not_allowed"},
+	PrivacyRestricted: {name: "privacy_restricted"},
+	Undecryptable:     {name: "undecryptable", relay: true},
+	UnsupportedType:   {name: "unsupported_type", relay: true},
+	ClientRejected:    {name: "rejected", relay: true},
+	ClientOverloaded:  {name: "client_overloaded"},
+}
+
+// Known reports whether the code is in the table.
+func (c Code) Known() bool {
+	_, ok := table[c]
+	return ok
+}
+
+// Relayable reports whether an error with this code that refers to a message
+// should be passed back to the sender of that message.
+func (c Code) Relayable() bool {
+	return table[c].relay
+}
+
+// String returns the symbolic name of the code, or "unknown" for codes not in
+// the table.
+func (c Code) String() string {
+	if e, ok := table[c]; ok {
+		return e.name
+	}
+	return table[Unknown].name
+}
+
+// Report is a parsed error frame.
+type Report struct {
+	Code      Code
+	MessageID string
+	Text      string
+}
+
+// reportPattern matches "E<code>: text" and "E<code>@<message id>: text".
+var reportPattern = regexp.MustCompile(`^E(\d{4})(?:@([0-9A-Za-z:._-]+))?: (.*)$`)
+
+// Format renders an error frame text for the given code. The message id is
+// optional and is only included when it is not empty.
+func Format(code Code, messageID string, text string) string {
+	if messageID == "" {
+		return fmt.Sprintf("E%d: %s", code, text)
+	}
+	return fmt.Sprintf("E%d@%s: %s", code, messageID, text)
+}
+
+// Parse reads an error frame text written by Format. Text that does not
+// follow the format, as sent by older clients, is returned as a report with
+// the Unknown code so it is still logged in full. Trailing spaces, which a
+// padded frame ends with, are ignored.
+func Parse(s string) Report {
+	s = strings.TrimRight(s, " ")
+
+	match := reportPattern.FindStringSubmatch(s)
+	if match == nil {
+		return Report{Code: Unknown, Text: s}
+	}
+
+	code, err := strconv.ParseUint(match[1], 10, 16)
+	if err != nil || !Code(code).Known() {
+		return Report{Code: Unknown, MessageID: match[2], Text: match[3]}
+	}
+
+	return Report{Code: Code(code), MessageID: match[2], Text: match[3]}
+}
@@ -0,0 +1,34 @@
+package errcodes
+
+import "testing"
+
+// TestFormatParse round trips reports with and without message ids and
+// checks that free text from older clients is still accepted.
+func TestFormatParse(t *testing.T) {
+	cases := []Report{
+		{Code: Throttled, Text: "rate limit exceeded"},
+		{Code: Undecryptable, MessageID: "1700000000000-0", Text: "bad mac"},
+	}
+
+	for _, c := range cases {
+		parsed := Parse(Format(c.Code, c.MessageID, c.Text))
+		if parsed != c {
+			t.Errorf("Expected %+v, got %+v", c, parsed)
+		}
+	}
+
+	parsed := Parse(Format(Throttled, "", "slow down") + "    ")
+	if parsed.Text != "slow down" {
+		t.Errorf("Expected padding to be ignored, got %q", parsed.Text)
+	}
+
+	parsed = Parse("something broke")
+	if parsed.Code != Unknown || parsed.Text != "something broke" {
+		t.Errorf("Expected an unknown report with the full text, got %+v", parsed)
+	}
+
+	parsed = Parse("E9999: made up")
+	if parsed.Code != Unknown || parsed.Text != "made up" {
+		t.Errorf("Expected an unknown report, got %+v", parsed)
+	}
+}
@@ -0,0 +1,156 @@
+package health
+
+import (
+	"context"
+	"crypto/subtle"
+	"darkchat/database"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULTADDRESS = ":8081"
+
+var (
+	listening atomic.Bool
+	draining  atomic.Bool
+)
+
+// SetListening records whether the chat listener is accepting connections.
+func SetListening(up bool) {
+	listening.Store(up)
+}
+
+// SetDraining turns readiness off (or back on) without touching liveness, so
+// an orchestrator stops routing new clients here before the server shuts
+// down.
+func SetDraining(drain bool) {
+	draining.Store(drain)
+}
+
+// Ready returns nil if the server can take new clients: it is not draining,
+// the chat listener is up and Redis answers a ping.
+func Ready(ctx context.Context) error {
+	if draining.Load() {
+		return errors.New("draining")
+	}
+
+	if !listening.Load() {
+		return errors.New("listener is not up")
+	}
+
+	if err := database.Ping(ctx); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	return nil
+}
+
+// Handler returns a mux serving /healthz, /readyz and /drain. /healthz
+// answers as long as the process is alive, /readyz reports Ready, and /drain
+// turns draining on with POST and off with DELETE. Since draining takes the
+// node out of rotation, /drain requires drainToken as a bearer token, or
+// without one only answers requests from the loopback interface.
+func Handler(drainToken string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		if err := Ready(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if !drainAllowed(r, drainToken) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			SetDraining(true)
+		case http.MethodDelete:
+			SetDraining(false)
+		default:
+			http.Error(w, "use POST to drain or DELETE to undrain", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "draining=%t\n", draining.Load())
+	})
+
+	return mux
+}
+
+// drainAllowed reports whether a request may change draining: it carries
+// the token, or no token is set and it comes from the loopback interface.
+func drainAllowed(r *http.Request, token string) bool {
+	if token != "" {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+// Serve exposes Handler at the given address until the context is canceled.
+// It returns nil after a clean shutdown.
+func Serve(ctx context.Context, address string, drainToken string) error {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           Handler(drainToken),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Probe requests the given path from a health listener and returns an error
+// unless it answers 200. It backs the healthcheck command.
+func Probe(ctx context.Context, url string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return nil
+}
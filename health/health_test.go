@@ -0,0 +1,76 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestDrainTogglesReadiness checks that liveness is unaffected by draining
+// while readiness is refused as soon as draining is turned on.
+func TestDrainTogglesReadiness(t *testing.T) {
+	server := httptest.NewServer(Handler(""))
+
+	defer server.Close()
+
+	SetListening(true)
+
+	defer SetListening(false)
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/drain", nil)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	defer SetDraining(false)
+
+	response, err = http.Get(server.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d while draining, got %d", http.StatusServiceUnavailable, response.StatusCode)
+	}
+
+	response, err = http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d for liveness, got %d", http.StatusOK, response.StatusCode)
+	}
+}
+
+// TestDrainRequiresToken checks that /drain refuses requests without the
+// configured token.
+func TestDrainRequiresToken(t *testing.T) {
+	server := httptest.NewServer(Handler("secret"))
+
+	defer server.Close()
+
+	defer SetDraining(false)
+
+	for token, expected := range map[string]int{"": http.StatusForbidden, "wrong": http.StatusForbidden, "secret": http.StatusOK} {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/drain", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != expected {
+			t.Errorf("Expected %d with token %q, got %d", expected, token, response.StatusCode)
+		}
+	}
+}
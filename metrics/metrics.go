@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"context"
+	"darkchat/monitor"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "darkchat"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	ActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Number of client connections currently open.",
+	})
+
+	Accepts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accepts_total",
+		Help:      "Number of connections accepted by the listener.",
+	})
+
+	Rejects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejects_total",
+		Help:      "Number of connections refused, by reason.",
+	}, []string{"reason"})
+
+	FramesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "frames_in_total",
+		Help:      "Number of frames received from clients, by protocol type.",
+	}, []string{"type"})
+
+	FramesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "frames_out_total",
+		Help:      "Number of frames sent to clients, by protocol type.",
+	}, []string{"type"})
+
+	DeliveryLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_latency_seconds",
+		Help:      "Time from a message being posted to a chat stream to it being written to the recipient's connection.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	RedisLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Duration of Redis commands, by command.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"command"})
+
+	RedisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Number of failed Redis commands, by command.",
+	}, []string{"command"})
+
+	HeartbeatRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "heartbeat_rtt_seconds",
+		Help:      "Time from a heartbeat being written to a client to the client's heartbeat answering it.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+
+	OutboundQueue = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "outbound_queue_depth",
+		Help:      "Number of messages read from Redis and waiting to be written to clients.",
+	})
+
+	CoverFrames = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cover_frames_total",
+		Help:      "Number of cover frames sent to clients, also counted in frames_out_total.",
+	})
+
+	LogDropped = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "log_lines_dropped_total",
+		Help:      "Number of log lines discarded because an async log buffer was full.",
+	}, func() float64 {
+		return float64(monitor.Dropped())
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ActiveConnections,
+		Accepts,
+		Rejects,
+		FramesIn,
+		FramesOut,
+		DeliveryLatency,
+		RedisLatency,
+		RedisErrors,
+		HeartbeatRTT,
+		OutboundQueue,
+		CoverFrames,
+		LogDropped,
+	)
+}
+
+// Handler returns the HTTP handler exposing every darkchat metric in the
+// Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Serve exposes the metrics on /metrics at the given address until the
+// context is canceled. It returns nil after a clean shutdown.
+func Serve(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
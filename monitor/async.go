@@ -0,0 +1,223 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies for the async buffer.
+const (
+	// OverflowBlock makes the caller wait for room in the buffer.
+	OverflowBlock = "block"
+	// OverflowDrop discards the line and counts it.
+	OverflowDrop = "drop"
+	// OverflowSample keeps one line in SampleRate once the buffer is three
+	// quarters full, and drops everything once it is full.
+	OverflowSample = "sample"
+)
+
+const (
+	DEFAULTBUFFERSIZE = 4096
+	DEFAULTSAMPLERATE = 10
+)
+
+var ErrUnknownOverflow = errors.New("unknown log overflow policy")
+
+// ValidOverflow checks an overflow policy. The empty string is accepted and
+// means OverflowBlock.
+func ValidOverflow(policy string) error {
+	switch policy {
+	case "", OverflowBlock, OverflowDrop, OverflowSample:
+		return nil
+	}
+	return fmt.Errorf("%w %q, use %s, %s or %s", ErrUnknownOverflow, policy, OverflowBlock, OverflowDrop, OverflowSample)
+}
+
+// dropped counts lines discarded by every async buffer since start.
+var dropped atomic.Uint64
+
+// Dropped returns the number of log lines discarded because an async buffer
+// was full.
+func Dropped() uint64 {
+	return dropped.Load()
+}
+
+type queued struct {
+	level string
+	line  []byte
+}
+
+// asyncQueue is a bounded ring buffer of encoded lines drained by a single
+// writer goroutine, so logging on the hot path costs an append instead of a
+// write system call.
+type asyncQueue struct {
+	core *core
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []queued
+	head    int
+	count   int
+	busy    bool
+	closed  bool
+	stopped chan struct{}
+
+	policy     string
+	sampleRate uint64
+	seen       uint64
+
+	// droppedHere counts lines this queue dropped since the writer last
+	// reported them.
+	droppedHere uint64
+}
+
+func newAsyncQueue(c *core, config Config) *asyncQueue {
+	size := config.BufferSize
+	if size <= 0 {
+		size = DEFAULTBUFFERSIZE
+	}
+
+	rate := config.SampleRate
+	if rate <= 0 {
+		rate = DEFAULTSAMPLERATE
+	}
+
+	q := &asyncQueue{
+		core:       c,
+		buf:        make([]queued, size),
+		stopped:    make(chan struct{}),
+		policy:     config.Overflow,
+		sampleRate: uint64(rate),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	go q.run()
+
+	return q
+}
+
+// push queues a line according to the overflow policy. Lines at error level
+// or above are never dropped, they wait for room like OverflowBlock.
+func (q *asyncQueue) push(level string, line []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		q.core.write(level, line)
+		return
+	}
+
+	important := ParseLevel(level) >= LevelError
+
+	if !important && q.policy == OverflowSample && q.count >= len(q.buf)*3/4 {
+		q.seen++
+		if q.seen%q.sampleRate != 0 {
+			q.drop()
+			return
+		}
+	}
+
+	for q.count == len(q.buf) {
+		if !important && q.policy != OverflowBlock && q.policy != "" {
+			q.drop()
+			return
+		}
+		q.cond.Wait()
+
+		if q.closed {
+			q.core.write(level, line)
+			return
+		}
+	}
+
+	q.buf[(q.head+q.count)%len(q.buf)] = queued{level: level, line: line}
+	q.count++
+	q.cond.Broadcast()
+}
+
+func (q *asyncQueue) drop() {
+	q.droppedHere++
+	dropped.Add(1)
+}
+
+// run is the writer goroutine. It takes everything queued in one go, writes
+// it with the lock released, and exits once closed and empty.
+func (q *asyncQueue) run() {
+	defer close(q.stopped)
+
+	batch := make([]queued, 0, len(q.buf))
+
+	for {
+		q.mu.Lock()
+		for q.count == 0 && !q.closed {
+			q.cond.Wait()
+		}
+
+		if q.count == 0 && q.closed {
+			q.mu.Unlock()
+			return
+		}
+
+		batch = batch[:0]
+		for q.count > 0 {
+			batch = append(batch, q.buf[q.head])
+			q.buf[q.head] = queued{}
+			q.head = (q.head + 1) % len(q.buf)
+			q.count--
+		}
+
+		lost := q.droppedHere
+		q.droppedHere = 0
+		q.busy = true
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		if lost > 0 {
+			notice := encodeRecord(Record{
+				Time:    time.Now(),
+				Level:   "WARNING",
+				Message: "monitor dropped log lines, buffer full",
+				Fields:  []Field{F("dropped", lost)},
+			})
+			q.core.write("WARNING", notice)
+		}
+
+		for _, entry := range batch {
+			q.core.write(entry.level, entry.line)
+		}
+
+		q.mu.Lock()
+		q.busy = false
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+// flush waits until every line queued before the call has been written.
+func (q *asyncQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for (q.count > 0 || q.busy) && !q.closed {
+		q.cond.Wait()
+	}
+}
+
+// close drains the buffer, stops the writer and makes later pushes write
+// synchronously.
+func (q *asyncQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		<-q.stopped
+		return
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	<-q.stopped
+}
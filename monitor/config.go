@@ -0,0 +1,172 @@
+package monitor
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level orders log levels so lines below a minimum can be dropped.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelFatal
+)
+
+// ParseLevel maps a level name onto a Level. Names are case insensitive and
+// both "WARN" and "WARNING" are accepted. Unknown names are treated as
+// LevelInfo, so custom levels passed to Log are written by default.
+func ParseLevel(name string) Level {
+	switch strings.ToUpper(name) {
+	case "DEBUG":
+		return LevelDebug
+	case "WARN", "WARNING":
+		return LevelWarning
+	case "ERROR":
+		return LevelError
+	case "FATAL":
+		return LevelFatal
+	default:
+		return LevelInfo
+	}
+}
+
+// Sink names accepted in Config.Sinks.
+const (
+	SinkFile   = "file"
+	SinkStderr = "stderr"
+	SinkSyslog = "syslog"
+)
+
+// Config controls where every Monitor writes and what it keeps.
+type Config struct {
+	// Level is the minimum level for every logger, and Levels overrides it
+	// per logger name, the log file name without its extension, such as
+	// "server" or "database".
+	Level  string
+	Levels map[string]string
+
+	// Sinks lists where lines go: SinkFile, SinkStderr and SinkSyslog.
+	Sinks []string
+
+	// Dir is the directory log files are created in. Empty means the
+	// working directory.
+	Dir string
+
+	// Rotation of log files. A file is rotated once it grows past MaxSize
+	// bytes or has been open for RotateEvery, whichever comes first. Zero
+	// disables either trigger. Rotated files are gzipped when Compress is
+	// set, and only the newest MaxBackups younger than MaxAge are kept.
+	MaxSize     int64
+	RotateEvery time.Duration
+	MaxBackups  int
+	MaxAge      time.Duration
+	Compress    bool
+
+	// Async moves writes to a background goroutine fed by a buffer of
+	// BufferSize lines. Overflow picks what happens when the buffer is full:
+	// OverflowBlock (the default), OverflowDrop or OverflowSample, keeping
+	// one line in SampleRate. Error and fatal lines are never dropped.
+	Async      bool
+	BufferSize int
+	Overflow   string
+	SampleRate int
+}
+
+// DefaultConfig returns the configuration used until Configure is called: a
+// file per logger at the level given by the LOG_LEVEL environment variable.
+func DefaultConfig() Config {
+	level := os.Getenv("LOG_LEVEL")
+	if level == "" {
+		level = "DEBUG"
+	}
+
+	return Config{
+		Level: level,
+		Sinks: []string{SinkFile},
+	}
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*core
+	current    = DefaultConfig()
+)
+
+// Configure applies the configuration to every Monitor created so far and to
+// those created afterwards. Existing sinks are closed and reopened.
+func Configure(config Config) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	current = config
+
+	for _, c := range registry {
+		c.apply(config)
+	}
+}
+
+func register(c *core) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry = append(registry, c)
+	c.apply(current)
+}
+
+// unregister stops Configure from reopening the sinks of a closed core.
+func unregister(c *core) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for i, registered := range registry {
+		if registered == c {
+			registry = append(registry[:i], registry[i+1:]...)
+			return
+		}
+	}
+}
+
+// Flush waits for every Monitor's async buffer to be written out. It should
+// be called before the process exits.
+func Flush() {
+	registryMu.Lock()
+	cores := append([]*core(nil), registry...)
+	registryMu.Unlock()
+
+	for _, c := range cores {
+		if q := c.queue.Load(); q != nil {
+			q.flush()
+		}
+	}
+}
+
+// apply replaces the sinks, level and async buffer of the core according to
+// the config. A previous buffer is drained into the old sinks first.
+func (c *core) apply(config Config) {
+	level := config.Level
+	if override, ok := config.Levels[c.name]; ok {
+		level = override
+	}
+	c.level.Store(int32(ParseLevel(level)))
+
+	if q := c.queue.Swap(nil); q != nil {
+		q.close()
+	}
+
+	sinks := openSinks(c.name, c.file, config)
+
+	c.mu.Lock()
+	closeSinks(c.sinks)
+	c.sinks = sinks
+	c.mu.Unlock()
+
+	if config.Async {
+		c.queue.Store(newAsyncQueue(c, config))
+	}
+}
@@ -0,0 +1,28 @@
+package monitor
+
+import "context"
+
+type connIDKey struct{}
+
+// WithConnID returns a context carrying the correlation id of a client
+// connection, so every package handling that connection can tag its log lines
+// with it.
+func WithConnID(ctx context.Context, connID string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, connID)
+}
+
+// ConnID returns the correlation id stored in the context, or an empty string.
+func ConnID(ctx context.Context) string {
+	connID, _ := ctx.Value(connIDKey{}).(string)
+	return connID
+}
+
+// Ctx returns a Monitor that adds the correlation id carried by the context
+// to every line, or the Monitor itself if the context carries none.
+func (m *Monitor) Ctx(ctx context.Context) *Monitor {
+	connID := ConnID(ctx)
+	if connID == "" {
+		return m
+	}
+	return m.With(F(KeyConnID, connID))
+}
@@ -0,0 +1,167 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Common field keys, so every package names the same thing the same way.
+const (
+	KeyConnID     = "conn_id"
+	KeyChatID     = "chat_id"
+	KeyRemoteAddr = "remote_addr"
+	KeyMessageID  = "message_id"
+	KeyError      = "error"
+)
+
+// Field is a key/value pair attached to a log line.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// F builds a Field.
+func F(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Record is a single log line before encoding.
+type Record struct {
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  []Field
+}
+
+// Encoder turns a Record into one line of output, including the trailing
+// newline.
+type Encoder interface {
+	Encode(buf *bytes.Buffer, record Record)
+}
+
+// NewEncoder returns the encoder for a format name: "json", "logfmt" or
+// "text". Unknown names fall back to text.
+func NewEncoder(format string) Encoder {
+	switch strings.ToLower(format) {
+	case "json":
+		return JSONEncoder{}
+	case "logfmt":
+		return LogfmtEncoder{}
+	default:
+		return TextEncoder{}
+	}
+}
+
+// TextEncoder writes the historical human readable format,
+// "2006-01-02 15:04:05 [LEVEL] message", followed by any fields as key=value.
+type TextEncoder struct{}
+
+func (TextEncoder) Encode(buf *bytes.Buffer, record Record) {
+	buf.WriteString(record.Time.Format("2006-01-02 15:04:05"))
+	buf.WriteString(" [")
+	buf.WriteString(record.Level)
+	buf.WriteString("] ")
+	buf.WriteString(record.Message)
+
+	for _, field := range record.Fields {
+		buf.WriteByte(' ')
+		writeLogfmtPair(buf, field.Key, field.Value)
+	}
+	buf.WriteByte('\n')
+}
+
+// LogfmtEncoder writes time, level and msg followed by the fields, all as
+// key=value pairs.
+type LogfmtEncoder struct{}
+
+func (LogfmtEncoder) Encode(buf *bytes.Buffer, record Record) {
+	writeLogfmtPair(buf, "time", record.Time.Format(time.RFC3339Nano))
+	buf.WriteByte(' ')
+	writeLogfmtPair(buf, "level", strings.ToLower(record.Level))
+	buf.WriteByte(' ')
+	writeLogfmtPair(buf, "msg", record.Message)
+
+	for _, field := range record.Fields {
+		buf.WriteByte(' ')
+		writeLogfmtPair(buf, field.Key, field.Value)
+	}
+	buf.WriteByte('\n')
+}
+
+// JSONEncoder writes one JSON object per line with time, level and msg keys
+// followed by the fields.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(buf *bytes.Buffer, record Record) {
+	buf.WriteByte('{')
+	writeJSONPair(buf, "time", record.Time.Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeJSONPair(buf, "level", record.Level)
+	buf.WriteByte(',')
+	writeJSONPair(buf, "msg", record.Message)
+
+	for _, field := range record.Fields {
+		buf.WriteByte(',')
+		writeJSONPair(buf, field.Key, field.Value)
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONPair(buf *bytes.Buffer, key string, value any) {
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(v)
+}
+
+func writeLogfmtPair(buf *bytes.Buffer, key string, value any) {
+	buf.WriteString(key)
+	buf.WriteByte('=')
+
+	var s string
+
+	switch v := value.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case time.Duration:
+		s = v.String()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if needsQuoting(s) {
+		buf.WriteString(strconv.Quote(s))
+		return
+	}
+	buf.WriteString(s)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,88 +1,235 @@
 package monitor
 
 import (
+	"bytes"
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// core is the state shared by a Monitor and every child created with With:
+// the sinks lines are written to, the minimum level and, in async mode, the
+// buffer feeding the sinks.
+type core struct {
+	name  string
+	file  string
+	mu    sync.Mutex
+	sinks []Sink
+	level atomic.Int32
+	queue atomic.Pointer[asyncQueue]
+}
+
 type Monitor struct {
-	file *os.File
-	*log.Logger
-	mu sync.Mutex
+	*core
+	fields []Field
 }
 
-// New creates a new Monitor instance that writes logs to the specified file.
-// If the file does not exist, it will be created. If there is an error opening
-// the file, the function returns nil. The Logger is initialized with standard
-// log flags. The returned Monitor must be closed using the Close method when
-// it is no longer needed to ensure the file is properly closed.
+// encoder holds the Encoder chosen with SetFormat. Encoders have different
+// concrete types, which atomic.Value refuses to swap between, so a pointer
+// to the interface is stored instead.
+var encoder atomic.Pointer[Encoder]
 
-func New(filename string) *Monitor {
+// redactor, when set, rewrites the message and every field value before a
+// record is encoded.
+var redactor atomic.Pointer[func(string) string]
+
+func init() {
+	SetFormat(os.Getenv("LOG_FORMAT"))
+}
+
+// SetFormat selects the output format of every Monitor: "json", "logfmt" or
+// "text". It defaults to the LOG_FORMAT environment variable, or text when
+// that is not set.
+func SetFormat(format string) {
+	e := NewEncoder(format)
+	encoder.Store(&e)
+}
+
+// SetRedactor installs a function applied to the message and to the text of
+// every field value of each record before it is encoded, so identifiers can
+// be scrubbed in one place whatever logged them. A nil function removes it.
+func SetRedactor(redact func(string) string) {
+	if redact == nil {
+		redactor.Store(nil)
+		return
+	}
+	redactor.Store(&redact)
+}
+
+// redactRecord returns a copy of record with redact applied. Strings, errors
+// and Stringers are formatted to text first, other values such as numbers are
+// kept as they are.
+func redactRecord(record Record, redact func(string) string) Record {
+	record.Message = redact(record.Message)
+
+	fields := make([]Field, len(record.Fields))
+
+	for i, field := range record.Fields {
+		switch field.Value.(type) {
+		case string, error, fmt.Stringer:
+			fields[i] = Field{Key: field.Key, Value: redact(fmt.Sprint(field.Value))}
+		default:
+			fields[i] = field
+		}
+	}
+	record.Fields = fields
+
+	return record
+}
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+// New creates a new Monitor named after the specified file, writing to the
+// sinks of the current configuration (by default only that file, created on
+// the first line written). If a file cannot be opened the Monitor falls back
+// to stderr rather than failing, so New never returns nil. The returned Monitor
+// should be closed using the Close method when it is no longer needed to
+// ensure the file is properly closed.
 
-	if err != nil {
-		return nil
+func New(filename string) *Monitor {
+	c := &core{
+		name: strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)),
+		file: filename,
 	}
 
+	register(c)
+
+	return &Monitor{core: c}
+}
+
+// With returns a Monitor that writes to the same sinks and adds the given
+// fields to every line it logs, after any fields the parent already adds.
+func (m *Monitor) With(fields ...Field) *Monitor {
 	return &Monitor{
-		file:   file,
-		Logger: log.New(file, "", log.LstdFlags),
+		core:   m.core,
+		fields: append(m.fields[:len(m.fields):len(m.fields)], fields...),
 	}
 }
 
+// SetLevel sets the minimum level this Monitor, and every Monitor sharing its
+// sinks, writes. Lines below it are dropped before they are encoded.
+func (m *Monitor) SetLevel(level string) {
+	m.level.Store(int32(ParseLevel(level)))
+}
+
+// Enabled reports whether a line at the given level would be written.
+func (m *Monitor) Enabled(level string) bool {
+	return ParseLevel(level) >= Level(m.level.Load())
+}
+
 // Log writes a message to the log with the given level. The level can be any
 // string, but common levels are "INFO", "ERROR", "DEBUG", and "WARNING". The
-// message is formatted with a timestamp and the log level, and then written to
-// the underlying logger.
-func (m *Monitor) Log(level, message string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// message is encoded together with a timestamp, the level, the Monitor's own
+// fields and the given fields in the format chosen with SetFormat.
+func (m *Monitor) Log(level, message string, fields ...Field) {
+	if !m.Enabled(level) {
+		return
+	}
 
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	record := Record{
+		Time:    time.Now(),
+		Level:   level,
+		Message: message,
+		Fields:  append(m.fields[:len(m.fields):len(m.fields)], fields...),
+	}
 
-	loggerMessage := fmt.Sprintf("[%s] [%s] %s ", timestamp, level, message)
+	line := encodeRecord(record)
 
-	m.Logger.Println(loggerMessage)
+	if q := m.queue.Load(); q != nil {
+		q.push(level, line)
+		return
+	}
+
+	m.write(level, line)
 }
 
-// Close closes the file associated with the Monitor.
+// encodeRecord redacts a record, if a redactor is set, and encodes it in the
+// format chosen with SetFormat.
+func encodeRecord(record Record) []byte {
+	if redact := redactor.Load(); redact != nil {
+		record = redactRecord(record, *redact)
+	}
+
+	var buf bytes.Buffer
+
+	(*encoder.Load()).Encode(&buf, record)
+
+	return buf.Bytes()
+}
+
+// write hands an encoded line to every sink, falling back to stderr for a
+// sink that fails.
+func (c *core) write(level string, line []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, sink := range c.sinks {
+		if err := sink.WriteRecord(level, line); err != nil {
+			os.Stderr.Write(line)
+		}
+	}
+}
+
+// Flush blocks until every line logged so far has been written to the
+// sinks. It returns immediately when the Monitor is not in async mode.
+func (m *Monitor) Flush() {
+	if q := m.queue.Load(); q != nil {
+		q.flush()
+	}
+}
+
+// Close closes the sinks associated with the Monitor.
 // It must be called when the Monitor is no longer needed to ensure
 // that the file is properly closed and resources are released.
 
 func (m *Monitor) Close() {
-	m.file.Close()
+	unregister(m.core)
+
+	if q := m.queue.Swap(nil); q != nil {
+		q.close()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	closeSinks(m.sinks)
+	m.sinks = nil
 }
 
 // Info logs a message with the level "INFO".
-func (m *Monitor) Info(message string) {
-	m.Log("INFO", message)
+func (m *Monitor) Info(message string, fields ...Field) {
+	m.Log("INFO", message, fields...)
 }
 
-// Error logs a message with the level "ERROR".
-
 // Error logs a message with the level "ERROR".
 // This method formats the message with a timestamp and the log level,
 // then writes it to the underlying logger.
 
-func (m *Monitor) Error(message string) {
-	m.Log("ERROR", message)
+func (m *Monitor) Error(message string, fields ...Field) {
+	m.Log("ERROR", message, fields...)
 }
 
 // Debug logs a message with the level "DEBUG".
 // This method formats the message with a timestamp and the log level,
 // then writes it to the underlying logger.
 
-func (m *Monitor) Debug(message string) {
-	m.Log("DEBUG", message)
+func (m *Monitor) Debug(message string, fields ...Field) {
+	m.Log("DEBUG", message, fields...)
 }
 
 // Warning logs a message with the level "WARNING".
 // This method formats the message with a timestamp and the log level,
 // then writes it to the underlying logger.
-func (m *Monitor) Warning(message string) {
-	m.Log("WARNING", message)
+func (m *Monitor) Warning(message string, fields ...Field) {
+	m.Log("WARNING", message, fields...)
+}
+
+// Fatal logs a message with the level "FATAL", flushes every Monitor and
+// exits the process.
+func (m *Monitor) Fatal(message string, fields ...Field) {
+	m.Log("FATAL", message, fields...)
+	Flush()
+	os.Exit(1)
 }
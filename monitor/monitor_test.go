@@ -0,0 +1,356 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestEncoders encodes the same record with every encoder and checks the
+// level, message and fields come out in the expected shape.
+func TestEncoders(t *testing.T) {
+	record := Record{
+		Time:    time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   "ERROR",
+		Message: "write failed",
+		Fields:  []Field{F(KeyChatID, "abc"), F(KeyError, errors.New("broken pipe"))},
+	}
+
+	var buf bytes.Buffer
+
+	TextEncoder{}.Encode(&buf, record)
+	if buf.String() != "2025-01-02 03:04:05 [ERROR] write failed chat_id=abc error=\"broken pipe\"\n" {
+		t.Errorf("Unexpected text output %q", buf.String())
+	}
+
+	buf.Reset()
+	LogfmtEncoder{}.Encode(&buf, record)
+	if buf.String() != "time=2025-01-02T03:04:05Z level=error msg=\"write failed\" chat_id=abc error=\"broken pipe\"\n" {
+		t.Errorf("Unexpected logfmt output %q", buf.String())
+	}
+
+	buf.Reset()
+	JSONEncoder{}.Encode(&buf, record)
+
+	var decoded map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Expected valid JSON, got %v: %s", err, buf.String())
+	}
+
+	if decoded["msg"] != "write failed" || decoded[KeyChatID] != "abc" || decoded[KeyError] != "broken pipe" {
+		t.Errorf("Unexpected JSON output %v", decoded)
+	}
+}
+
+// TestWithAndSlog logs through a child Monitor and through the slog adapter
+// and checks that the context fields end up on the line with one timestamp.
+func TestWithAndSlog(t *testing.T) {
+	SetFormat("text")
+
+	filename := filepath.Join(t.TempDir(), "test.log")
+
+	m := New(filename)
+
+	defer m.Close()
+
+	m.With(F(KeyConnID, "c1")).Info("accepted")
+	m.Slog().With("chat_id", "abc").Warn("throttled", "count", 3)
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d: %q", len(lines), content)
+	}
+
+	if !strings.HasSuffix(lines[0], "[INFO] accepted conn_id=c1") {
+		t.Errorf("Unexpected line %q", lines[0])
+	}
+
+	if !strings.HasSuffix(lines[1], "[WARNING] throttled chat_id=abc count=3") {
+		t.Errorf("Unexpected line %q", lines[1])
+	}
+}
+
+// TestLevelsAndRotation configures a small maximum size with compression and
+// a per-logger level, then checks that debug lines are dropped, the file is
+// rotated into gzipped backups and only MaxBackups of them are kept.
+func TestLevelsAndRotation(t *testing.T) {
+	SetFormat("text")
+
+	dir := t.TempDir()
+
+	defer Configure(DefaultConfig())
+
+	Configure(Config{
+		Level:      "DEBUG",
+		Levels:     map[string]string{"rotation": "INFO"},
+		Sinks:      []string{SinkFile},
+		Dir:        dir,
+		MaxSize:    64,
+		MaxBackups: 2,
+		Compress:   true,
+	})
+
+	m := New("rotation.log")
+
+	for i := 0; i < 10; i++ {
+		m.Debug("dropped")
+		m.Info("kept line that is long enough to force rotation")
+	}
+
+	m.Close()
+
+	backups, err := filepath.Glob(filepath.Join(dir, "rotation.log.*.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 2 {
+		t.Errorf("Expected 2 compressed backups, got %d", len(backups))
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "rotation.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(content), "dropped") {
+		t.Error("Expected debug lines to be filtered out")
+	}
+}
+
+// TestFallbackToStderr checks that a Monitor whose file cannot be opened is
+// still usable instead of being nil.
+func TestFallbackToStderr(t *testing.T) {
+	m := New(filepath.Join(t.TempDir(), "missing", "dir", "test.log"))
+
+	if m == nil {
+		t.Fatal("Expected a Monitor, got nil")
+	}
+
+	m.Info("falls back to stderr")
+	m.Close()
+}
+
+// gateSink blocks every write until the gate channel is closed, so a test can
+// fill an async buffer.
+type gateSink struct {
+	gate  chan struct{}
+	lines *atomic.Int64
+}
+
+func (s gateSink) WriteRecord(level string, line []byte) error {
+	<-s.gate
+	s.lines.Add(1)
+	return nil
+}
+
+func (s gateSink) Close() error { return nil }
+
+// TestAsyncDropAndFlush fills a tiny async buffer behind a blocked sink with
+// the drop policy, checks that lines are dropped and counted instead of
+// blocking the caller, and that Flush returns only once the rest is written.
+func TestAsyncDropAndFlush(t *testing.T) {
+	defer Configure(DefaultConfig())
+
+	Configure(Config{
+		Level:      "DEBUG",
+		Sinks:      []string{SinkStderr},
+		Async:      true,
+		BufferSize: 4,
+		Overflow:   OverflowDrop,
+	})
+
+	m := New("async.log")
+
+	var lines atomic.Int64
+	gate := make(chan struct{})
+
+	m.mu.Lock()
+	m.sinks = []Sink{gateSink{gate: gate, lines: &lines}}
+	m.mu.Unlock()
+
+	before := Dropped()
+
+	for i := 0; i < 20; i++ {
+		m.Info("line")
+	}
+
+	lost := Dropped() - before
+	if lost == 0 {
+		t.Error("Expected lines to be dropped while the sink is blocked")
+	}
+
+	close(gate)
+	m.Flush()
+
+	// The writer may have taken one batch before the buffer filled up, and
+	// reports the drops in a line of its own.
+	if written := lines.Load(); written+int64(lost) < 20 {
+		t.Errorf("Expected every line to be written or dropped, %d written and %d dropped", written, lost)
+	}
+
+	m.Error("after flush")
+	m.Close()
+}
+
+// TestCtxAddsConnID checks that a Monitor derived from a context carrying a
+// connection id tags its lines with it, and that a bare context adds nothing.
+func TestCtxAddsConnID(t *testing.T) {
+	m := &Monitor{core: &core{}}
+
+	if got := m.Ctx(context.Background()); got != m {
+		t.Error("Expected the same Monitor for a context without a connection id")
+	}
+
+	child := m.Ctx(WithConnID(context.Background(), "c1"))
+
+	if len(child.fields) != 1 || child.fields[0] != F(KeyConnID, "c1") {
+		t.Errorf("Expected a conn_id field, got %v", child.fields)
+	}
+}
+
+// TestRedactor installs a redactor and checks it is applied to the message
+// and string fields but leaves numbers alone.
+func TestRedactor(t *testing.T) {
+	SetFormat("text")
+	SetRedactor(func(s string) string { return strings.ReplaceAll(s, "secret", "***") })
+
+	defer SetRedactor(nil)
+
+	filename := filepath.Join(t.TempDir(), "test.log")
+
+	m := New(filename)
+
+	defer m.Close()
+
+	m.Info("secret accepted", F(KeyRemoteAddr, "secret:1"), F("count", 3))
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(strings.TrimSpace(string(content)), "[INFO] *** accepted remote_addr=***:1 count=3") {
+		t.Errorf("Unexpected line %q", content)
+	}
+}
+
+// TestFileOpenedOnFirstWrite checks that creating a Monitor does not create
+// its file until a line is written.
+func TestFileOpenedOnFirstWrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "lazy.log")
+
+	m := New(filename)
+
+	defer m.Close()
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file before the first line, got %v", err)
+	}
+
+	m.Info("first")
+
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("Expected the file after the first line, got %v", err)
+	}
+}
+
+// captureSink keeps every line written to it, after waiting for the gate.
+type captureSink struct {
+	gate  chan struct{}
+	mu    *sync.Mutex
+	lines *[]string
+}
+
+func (s captureSink) WriteRecord(level string, line []byte) error {
+	<-s.gate
+	s.mu.Lock()
+	*s.lines = append(*s.lines, string(line))
+	s.mu.Unlock()
+	return nil
+}
+
+func (s captureSink) Close() error { return nil }
+
+// TestDropNoticeFormat checks that the notice about dropped lines is encoded
+// like any other line, so it stays valid JSON.
+func TestDropNoticeFormat(t *testing.T) {
+	SetFormat("json")
+
+	defer SetFormat("text")
+	defer Configure(DefaultConfig())
+
+	Configure(Config{
+		Level:      "DEBUG",
+		Sinks:      []string{SinkStderr},
+		Async:      true,
+		BufferSize: 2,
+		Overflow:   OverflowDrop,
+	})
+
+	m := New("notice.log")
+
+	var mu sync.Mutex
+	var lines []string
+	gate := make(chan struct{})
+
+	m.mu.Lock()
+	m.sinks = []Sink{captureSink{gate: gate, mu: &mu, lines: &lines}}
+	m.mu.Unlock()
+
+	for i := 0; i < 10; i++ {
+		m.Info("line")
+	}
+
+	close(gate)
+	m.Flush()
+
+	// The notice goes out with the batch after the drops.
+	m.Info("line")
+	m.Flush()
+	m.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	notices := 0
+	for _, line := range lines {
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+			t.Errorf("Expected JSON, got %q", line)
+		}
+		if strings.Contains(line, "dropped log lines") {
+			notices++
+		}
+	}
+
+	if notices == 0 {
+		t.Error("Expected a notice about dropped lines")
+	}
+}
+
+// TestValidOverflow checks that unknown overflow policies are refused.
+func TestValidOverflow(t *testing.T) {
+	for _, policy := range []string{"", OverflowBlock, OverflowDrop, OverflowSample} {
+		if err := ValidOverflow(policy); err != nil {
+			t.Errorf("Expected no error for %q, got %v", policy, err)
+		}
+	}
+
+	if err := ValidOverflow("dorp"); !errors.Is(err, ErrUnknownOverflow) {
+		t.Errorf("Expected %v, got %v", ErrUnknownOverflow, err)
+	}
+}
@@ -0,0 +1,221 @@
+package monitor
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405"
+
+// rotatingFile is a file sink that moves the current file aside once it is
+// too big or too old, optionally gzips the old file and prunes backups past
+// the retention limits. Backups are named <file>.<timestamp>[.gz].
+type rotatingFile struct {
+	path   string
+	config Config
+
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// compressing tracks background compression so Close can wait for it.
+	compressing sync.WaitGroup
+}
+
+// openRotatingFile returns a sink for the file at path. The file is only
+// opened on the first write, so loggers created before the configuration is
+// applied leave no files behind in the wrong directory.
+func openRotatingFile(path string, config Config) (*rotatingFile, error) {
+	return &rotatingFile{path: path, config: config}, nil
+}
+
+// openFile opens the file at the sink's path for appending and returns it
+// with its size.
+func (r *rotatingFile) openFile() (*os.File, int64, error) {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// WriteRecord is called with the Monitor's lock held, so it does not need a
+// lock of its own. A file that could not be opened or rotated is tried again
+// on the next write.
+func (r *rotatingFile) WriteRecord(level string, line []byte) error {
+	if r.file == nil {
+		file, size, err := r.openFile()
+		if err != nil {
+			return err
+		}
+		r.file, r.size, r.opened = file, size, time.Now()
+	}
+
+	if r.due(int64(len(line))) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "monitor: rotating %s: %s\n", r.path, err.Error())
+		}
+	}
+
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) due(next int64) bool {
+	if r.config.MaxSize > 0 && r.size > 0 && r.size+next > r.config.MaxSize {
+		return true
+	}
+	return r.config.RotateEvery > 0 && time.Since(r.opened) >= r.config.RotateEvery
+}
+
+// rotate moves the current file aside and opens a new one. The old handle is
+// only closed once the new file is open, so a failure leaves the sink
+// writing to the file it had.
+func (r *rotatingFile) rotate() error {
+	backup := fmt.Sprintf("%s.%s", r.path, time.Now().Format(backupTimeFormat))
+	for i := 1; exists(backup) || exists(backup+".gz"); i++ {
+		backup = fmt.Sprintf("%s.%s.%d", r.path, time.Now().Format(backupTimeFormat), i)
+	}
+
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+
+	file, size, err := r.openFile()
+	if err != nil {
+		// Put the file back so the next attempt finds it where it was.
+		os.Rename(backup, r.path)
+		return err
+	}
+
+	r.file.Close()
+	r.file, r.size, r.opened = file, size, time.Now()
+
+	if r.config.Compress {
+		r.compressing.Add(1)
+		go func() {
+			defer r.compressing.Done()
+
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "monitor: compressing %s: %s\n", backup, err.Error())
+			}
+			r.prune()
+		}()
+		return nil
+	}
+
+	r.prune()
+	return nil
+}
+
+// prune removes backups beyond MaxBackups and backups older than MaxAge.
+func (r *rotatingFile) prune() {
+	if r.config.MaxBackups <= 0 && r.config.MaxAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+
+	backups := make([]backup, 0, len(matches))
+
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || info.IsDir() || strings.HasSuffix(match, ".tmp") {
+			continue
+		}
+		backups = append(backups, backup{path: match, modTime: info.ModTime()})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+
+	for i, b := range backups {
+		tooMany := r.config.MaxBackups > 0 && i >= r.config.MaxBackups
+		tooOld := r.config.MaxAge > 0 && time.Since(b.modTime) > r.config.MaxAge
+
+		if tooMany || tooOld {
+			os.Remove(b.path)
+		}
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.compressing.Wait()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// compressFile gzips path into path.gz and removes the original. The
+// compressed data is written to a temporary file first so a crash never
+// leaves a truncated .gz behind.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,92 @@
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Sink is a destination for encoded log lines.
+type Sink interface {
+	// WriteRecord writes one encoded line. The level is passed along for
+	// sinks, like syslog, that record it out of band.
+	WriteRecord(level string, line []byte) error
+	Close() error
+}
+
+// writerSink adapts an io.Writer, closing it only if it is an io.Closer other
+// than the process' standard streams.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) WriteRecord(level string, line []byte) error {
+	_, err := s.w.Write(line)
+	return err
+}
+
+func (s writerSink) Close() error {
+	if s.w == os.Stderr || s.w == os.Stdout {
+		return nil
+	}
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// openSinks opens the sinks named in the config for the logger. A sink that
+// fails to open is reported on stderr and replaced by stderr, so logging
+// never silently stops.
+func openSinks(name string, filename string, config Config) []Sink {
+	sinks := make([]Sink, 0, len(config.Sinks))
+	stderr := false
+
+	for _, kind := range config.Sinks {
+		var (
+			sink Sink
+			err  error
+		)
+
+		switch kind {
+		case SinkFile:
+			path := filename
+			if config.Dir != "" {
+				path = filepath.Join(config.Dir, filepath.Base(filename))
+			}
+			sink, err = openRotatingFile(path, config)
+		case SinkStderr:
+			if stderr {
+				continue
+			}
+			stderr = true
+			sink = writerSink{w: os.Stderr}
+		case SinkSyslog:
+			sink, err = openSyslog(name)
+		default:
+			err = fmt.Errorf("unknown log sink %q", kind)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "monitor: %s: %s, logging to stderr instead\n", name, err.Error())
+			if !stderr {
+				stderr = true
+				sinks = append(sinks, writerSink{w: os.Stderr})
+			}
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(sinks) == 0 {
+		sinks = append(sinks, writerSink{w: os.Stderr})
+	}
+	return sinks
+}
+
+func closeSinks(sinks []Sink) {
+	for _, sink := range sinks {
+		sink.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package monitor
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogHandler adapts a Monitor to the log/slog Handler interface so code can
+// log through a *slog.Logger and still end up in the Monitor's file and
+// format.
+type slogHandler struct {
+	monitor *Monitor
+	group   string
+}
+
+// Handler returns a slog.Handler writing to the Monitor.
+func (m *Monitor) Handler() slog.Handler {
+	return &slogHandler{monitor: m}
+}
+
+// Slog returns a *slog.Logger writing to the Monitor.
+func (m *Monitor) Slog() *slog.Logger {
+	return slog.New(m.Handler())
+}
+
+func (h *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *slogHandler) Handle(ctx context.Context, record slog.Record) error {
+	fields := make([]Field, 0, record.NumAttrs())
+
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = h.appendAttr(fields, attr)
+		return true
+	})
+
+	h.monitor.Log(levelName(record.Level), record.Message, fields...)
+	return nil
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := make([]Field, 0, len(attrs))
+
+	for _, attr := range attrs {
+		fields = h.appendAttr(fields, attr)
+	}
+
+	return &slogHandler{monitor: h.monitor.With(fields...), group: h.group}
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{monitor: h.monitor, group: h.group + name + "."}
+}
+
+// appendAttr flattens an attribute, and any group it contains, into fields
+// whose keys are prefixed with the open groups.
+func (h *slogHandler) appendAttr(fields []Field, attr slog.Attr) []Field {
+	attr.Value = attr.Value.Resolve()
+
+	if attr.Equal(slog.Attr{}) {
+		return fields
+	}
+
+	if attr.Value.Kind() == slog.KindGroup {
+		nested := &slogHandler{monitor: h.monitor, group: h.group}
+		if attr.Key != "" {
+			nested.group += attr.Key + "."
+		}
+		for _, a := range attr.Value.Group() {
+			fields = nested.appendAttr(fields, a)
+		}
+		return fields
+	}
+
+	return append(fields, F(h.group+attr.Key, attr.Value.Any()))
+}
+
+// levelName maps slog levels onto the level names used by Monitor.
+func levelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
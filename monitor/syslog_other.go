@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package monitor
+
+import "errors"
+
+func openSyslog(name string) (Sink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+
+package monitor
+
+import (
+	"log/syslog"
+)
+
+// syslogSink writes lines to the local syslog daemon, mapping the Monitor
+// levels onto syslog severities.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func openSyslog(name string) (Sink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "darkchat-"+name)
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w: w}, nil
+}
+
+func (s syslogSink) WriteRecord(level string, line []byte) error {
+	message := string(line)
+
+	switch ParseLevel(level) {
+	case LevelDebug:
+		return s.w.Debug(message)
+	case LevelWarning:
+		return s.w.Warning(message)
+	case LevelError:
+		return s.w.Err(message)
+	case LevelFatal:
+		return s.w.Crit(message)
+	default:
+		return s.w.Info(message)
+	}
+}
+
+func (s syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -1,9 +1,12 @@
 package pinger
 
 import (
+	"bytes"
 	"context"
+	"darkchat/metrics"
 	"darkchat/monitor"
 	"io"
+	"math/rand"
 	"time"
 
 	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
@@ -16,13 +19,21 @@ var monitorLogger = monitor.New("pinger.log")
 // Ping writes a "PING" message to the writer at regular intervals, given by the
 // reset channel. If the reset channel is closed, Ping returns immediately.
 // If the context is canceled, Ping returns immediately.
-// If the writer returns an error, the error is logged to the monitorLogger.
+// If the writer returns an error, the error is logged to the monitorLogger,
+// tagged with the connection id carried by the context.
 //
 // If the interval is zero, or becomes zero after a reset, the interval defaults
 // to DEFAULTPINGINTERVAL.
 //
 // The function runs in its own goroutine, and does not block.
 func Ping(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
+	PingWithJitter(ctx, w, reset, 0)
+}
+
+// PingWithJitter is Ping with each interval randomised by up to the given
+// fraction of it in either direction, so heartbeats do not mark the
+// connection with a perfectly regular pattern.
+func PingWithJitter(ctx context.Context, w io.Writer, reset <-chan time.Duration, jitter float64) {
 	var interval time.Duration
 
 	select {
@@ -36,7 +47,10 @@ func Ping(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
 		interval = DEFAULTPINGINTERVAL
 	}
 
-	timer := time.NewTimer(interval)
+	logger := monitorLogger.Ctx(ctx)
+	tracker, _ := w.(*Tracker)
+
+	timer := time.NewTimer(jittered(interval, jitter))
 
 	defer func() {
 		if !timer.Stop() {
@@ -58,10 +72,34 @@ func Ping(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
 		case <-timer.C:
 			var payload = new(protocol.Beat)
 
-			if _, err := protocol.Encode(w, payload, protocol.HeartBeat); err != nil {
-				monitorLogger.Error(err.Error())
+			// The frame is encoded first and written in a single call, so
+			// writers that serialize frames see it whole.
+			var frame bytes.Buffer
+			protocol.Encode(&frame, payload, protocol.HeartBeat)
+
+			if _, err := w.Write(frame.Bytes()); err != nil {
+				logger.Error(err.Error())
+			} else {
+				metrics.FramesOut.WithLabelValues("beat").Inc()
+				if tracker != nil {
+					tracker.frameSent()
+				}
 			}
 		}
-		_ = timer.Reset(interval)
+		_ = timer.Reset(jittered(interval, jitter))
 	}
 }
+
+// jittered returns interval moved by a random amount of up to jitter times
+// it in either direction. Jitter is capped at 1 so the result is never
+// negative.
+func jittered(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+
+	return time.Duration(float64(interval) * (1 + jitter*(2*rand.Float64()-1)))
+}
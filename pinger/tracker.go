@@ -0,0 +1,60 @@
+package pinger
+
+import (
+	"darkchat/metrics"
+	"io"
+	"sync"
+	"time"
+)
+
+// Tracker wraps the writer handed to Ping and remembers when the last
+// heartbeat was written, so the round trip to the client's answer can be
+// measured. Heartbeats carry no id, so the first heartbeat from the client
+// after the server's is taken as its answer.
+type Tracker struct {
+	w      io.Writer
+	onSent func()
+	mu     sync.Mutex
+	sent   time.Time
+}
+
+// NewTracker returns a Tracker writing heartbeats to w. If onSent is not nil
+// it is called after every heartbeat frame Ping writes successfully.
+func NewTracker(w io.Writer, onSent func()) *Tracker {
+	return &Tracker{w: w, onSent: onSent}
+}
+
+// frameSent is called by Ping once a whole heartbeat frame has been written.
+// The round trip starts there, so time spent waiting for the connection's
+// write lock is not counted.
+func (t *Tracker) frameSent() {
+	t.mu.Lock()
+	t.sent = time.Now()
+	t.mu.Unlock()
+
+	if t.onSent != nil {
+		t.onSent()
+	}
+}
+
+// Write writes the heartbeat to the underlying writer.
+func (t *Tracker) Write(p []byte) (int, error) {
+	return t.w.Write(p)
+}
+
+// Ack is called when the client sends a heartbeat. If a heartbeat from the
+// server is waiting for its answer the round trip is recorded and returned.
+func (t *Tracker) Ack() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.sent.IsZero() {
+		return 0, false
+	}
+
+	elapsed := time.Since(t.sent)
+	t.sent = time.Time{}
+
+	metrics.HeartbeatRTT.Observe(elapsed.Seconds())
+	return elapsed, true
+}
@@ -0,0 +1,177 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"darkchat/monitor"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULTSALTROTATION = 24 * time.Hour
+	DEFAULTPADBUCKET    = 256
+)
+
+var ErrWeakened = errors.New("option is not allowed in privacy mode")
+
+// Config describes the privacy mode guarantees.
+type Config struct {
+	// Hash replaces identifiers in logs with salted hashes that stay stable
+	// for SaltRotation, so lines about one client can still be correlated
+	// for a while. Without it identifiers are replaced by a fixed marker.
+	Hash         bool
+	SaltRotation time.Duration
+
+	// PadBucket is the size stored entries are padded up to a multiple of.
+	PadBucket int
+}
+
+// Options are the settings of the rest of the server that privacy mode has
+// an opinion on. Validate refuses any that would weaken its guarantees.
+type Options struct {
+	LogLevel  string
+	LogLevels map[string]string
+	LogSinks  []string
+}
+
+var (
+	enabled atomic.Bool
+	config  Config
+
+	saltMu      sync.Mutex
+	salt        []byte
+	saltExpires time.Time
+)
+
+// identifiers matches what must not reach the logs: IPv4 and IPv6 addresses,
+// UUIDs, which is the format of chat ids, and 32 hex digit ids, the format
+// of identities and devices, which would link one user's connections across
+// sessions. Compressed IPv6 addresses are only recognised by their "::" so
+// that times such as 15:04:05 are kept.
+var identifiers = regexp.MustCompile(
+	`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}` +
+		`|\b[0-9a-fA-F]{32}\b` +
+		`|\b(?:\d{1,3}\.){3}\d{1,3}\b` +
+		`|(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}` +
+		`|(?:[0-9a-fA-F]{1,4}:)*[0-9a-fA-F]{0,4}::(?:[0-9a-fA-F]{1,4}:)*[0-9a-fA-F]{0,4}`,
+)
+
+// Validate returns an error naming the first option that would weaken
+// privacy mode.
+func Validate(options Options) error {
+	if strings.EqualFold(options.LogLevel, "debug") {
+		return fmt.Errorf("%w: debug logging", ErrWeakened)
+	}
+
+	for name, level := range options.LogLevels {
+		if strings.EqualFold(level, "debug") {
+			return fmt.Errorf("%w: debug logging for %s", ErrWeakened, name)
+		}
+	}
+
+	for _, sink := range options.LogSinks {
+		if sink == "syslog" {
+			return fmt.Errorf("%w: the syslog sink ships logs outside the server's retention", ErrWeakened)
+		}
+	}
+	return nil
+}
+
+// Enable turns privacy mode on for the whole process.
+func Enable(c Config) {
+	if c.SaltRotation <= 0 {
+		c.SaltRotation = DEFAULTSALTROTATION
+	}
+	if c.PadBucket <= 0 {
+		c.PadBucket = DEFAULTPADBUCKET
+	}
+
+	config = c
+	enabled.Store(true)
+
+	monitor.SetRedactor(Redact)
+}
+
+// Enabled reports whether privacy mode is on.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Redact replaces every IP address, chat id, identity and device id in s. It returns s unchanged
+// when privacy mode is off.
+func Redact(s string) string {
+	if !Enabled() {
+		return s
+	}
+	return identifiers.ReplaceAllStringFunc(s, pseudonym)
+}
+
+// pseudonym returns the replacement for one identifier.
+func pseudonym(value string) string {
+	if !config.Hash {
+		return "[redacted]"
+	}
+
+	mac := hmac.New(sha256.New, currentSalt())
+	mac.Write([]byte(value))
+
+	return "h:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// currentSalt returns the hashing salt, replacing it with a fresh random one
+// once it is older than the rotation period. Old salts are never kept, so
+// hashes cannot be linked across periods.
+func currentSalt() []byte {
+	saltMu.Lock()
+	defer saltMu.Unlock()
+
+	if salt == nil || time.Now().After(saltExpires) {
+		salt = make([]byte, 32)
+		rand.Read(salt)
+		saltExpires = time.Now().Add(config.SaltRotation)
+	}
+	return salt
+}
+
+// Padding returns the filler needed to bring an entry of the given size up to
+// the next multiple of the pad bucket, or an empty string when privacy mode
+// is off.
+func Padding(size int) string {
+	if !Enabled() {
+		return ""
+	}
+
+	remainder := size % config.PadBucket
+	if remainder == 0 {
+		return ""
+	}
+	return strings.Repeat("=", config.PadBucket-remainder)
+}
+
+// Banner describes the guarantees of privacy mode, for printing at startup.
+func Banner() string {
+	identifiersLine := "IP addresses, chat ids, identities and device ids are replaced by [redacted] in every log"
+	if config.Hash {
+		identifiersLine = fmt.Sprintf("IP addresses, chat ids, identities and device ids are replaced by salted hashes in every log, the salt is rotated every %s and never stored", config.SaltRotation)
+	}
+
+	return strings.Join([]string{
+		"Privacy mode is on:",
+		"  - " + identifiersLine,
+		"  - messages are deleted from Redis as soon as they are delivered, so error reports are not relayed",
+		"  - sender and recipient ids and send times are not stored with messages",
+		"  - plain messages arrive without a sender, sealed envelopes carry it",
+		"  - edits, deletions, history, replies, reactions and scheduled messages are refused",
+		"  - conversation lists and read markers are not kept",
+		fmt.Sprintf("  - stored entries are padded to multiples of %d bytes", config.PadBucket),
+		"  - debug logging and the syslog sink are refused",
+	}, "\n")
+}
@@ -0,0 +1,105 @@
+package privacy
+
+import (
+	"darkchat/monitor"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRedact enables privacy mode and checks that addresses and chat ids are
+// hashed consistently and that nothing else in the line changes.
+func TestRedact(t *testing.T) {
+	Enable(Config{Hash: true})
+
+	defer func() {
+		enabled.Store(false)
+		monitor.SetRedactor(nil)
+	}()
+
+	line := "read tcp 127.0.0.1:8080->10.1.2.3:51234 chat 3f2b1c9e-8d4a-4e5f-9a6b-7c8d9e0f1a2b [2001:db8::1]:80"
+	redacted := Redact(line)
+
+	for _, leak := range []string{"10.1.2.3", "127.0.0.1", "3f2b1c9e", "2001:db8"} {
+		if strings.Contains(redacted, leak) {
+			t.Errorf("Expected %s to be redacted from %q", leak, redacted)
+		}
+	}
+
+	if !strings.HasPrefix(redacted, "read tcp ") || !strings.Contains(redacted, " chat ") {
+		t.Errorf("Expected the rest of the line to be kept, got %q", redacted)
+	}
+
+	if Redact("10.1.2.3") != Redact("10.1.2.3") {
+		t.Error("Expected hashes to be stable within a salt period")
+	}
+}
+
+// TestRedactDevice logs a device line in privacy mode and checks that the
+// device and identity ids do not reach the log.
+func TestRedactDevice(t *testing.T) {
+	Enable(Config{Hash: true})
+
+	defer func() {
+		enabled.Store(false)
+		monitor.SetRedactor(nil)
+	}()
+
+	monitor.SetFormat("text")
+
+	device := "0123456789abcdef0123456789abcdef"
+	identity := "fedcba9876543210fedcba9876543210"
+
+	filename := filepath.Join(t.TempDir(), "privacy.log")
+
+	m := monitor.New(filename)
+	m.Info("Authenticated device", monitor.F("device", device), monitor.F(monitor.KeyError, "identity:"+identity+" revoked"))
+	m.Close()
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, leak := range []string{device, identity} {
+		if strings.Contains(string(content), leak) {
+			t.Errorf("Expected %s to be redacted from %q", leak, content)
+		}
+	}
+
+	if !strings.Contains(string(content), "Authenticated device device=h:") {
+		t.Errorf("Expected the device to be hashed, got %q", content)
+	}
+}
+
+// TestPaddingAndValidate checks the padding arithmetic and that weakening
+// options are refused.
+func TestPaddingAndValidate(t *testing.T) {
+	Enable(Config{PadBucket: 16})
+
+	defer func() {
+		enabled.Store(false)
+		monitor.SetRedactor(nil)
+	}()
+
+	if n := len(Padding(10)); n != 6 {
+		t.Errorf("Expected 6 bytes of padding, got %d", n)
+	}
+
+	if n := len(Padding(32)); n != 0 {
+		t.Errorf("Expected no padding, got %d", n)
+	}
+
+	if err := Validate(Options{LogLevel: "DEBUG"}); err == nil {
+		t.Error("Expected debug logging to be refused")
+	}
+
+	if err := Validate(Options{LogLevel: "info", LogLevels: map[string]string{"server": "debug"}}); err == nil {
+		t.Error("Expected debug logging for one logger to be refused")
+	}
+
+	if err := Validate(Options{LogLevel: "info", LogSinks: []string{"file", "stderr"}}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket that refills at a fixed rate up to a maximum burst.
+// The zero value is not usable, buckets must be created with NewBucket.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket that refills at rate tokens per second and
+// holds at most burst tokens. A rate of zero or less disables the bucket and
+// every call to AllowN succeeds.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// AllowN reports whether n tokens are available at the given time and removes
+// them from the bucket if they are. A request larger than the burst is allowed
+// only when the bucket is full so that oversized frames are slowed down rather
+// than refused forever.
+func (b *Bucket) AllowN(now time.Time, n int) bool {
+	if !b.available(now, n) {
+		return false
+	}
+	b.take(n)
+	return true
+}
+
+// available reports whether n tokens are available at the given time without
+// removing them.
+func (b *Bucket) available(now time.Time, n int) bool {
+	if b.rate <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.need(n)
+}
+
+// take removes n tokens, which available must have reported.
+func (b *Bucket) take(n int) {
+	if b.rate <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens -= b.need(n)
+	if b.tokens < 0 {
+		b.tokens = 0
+	}
+}
+
+// need returns how many tokens a request of n costs, capped at the burst.
+func (b *Bucket) need(n int) float64 {
+	if need := float64(n); need < b.burst {
+		return need
+	}
+	return b.burst
+}
+
+// full reports whether the bucket has refilled completely at the given time.
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
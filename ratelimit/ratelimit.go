@@ -0,0 +1,205 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULTMESSAGERATE  = 10
+	DEFAULTMESSAGEBURST = 20
+	DEFAULTBYTERATE     = 64 * 1024
+	DEFAULTBYTEBURST    = 256 * 1024
+	DEFAULTMAXSTRIKES   = 5
+	DEFAULTSTRIKEWINDOW = time.Minute
+	DEFAULTBANDURATION  = 5 * time.Minute
+)
+
+const pruneInterval = time.Minute
+
+var (
+	ErrThrottled = errors.New("rate limit exceeded")
+	ErrBanned    = errors.New("temporarily banned for exceeding rate limits")
+)
+
+// Config holds the limits applied to every key tracked by a Limiter. Rates are
+// expressed per second. A rate of zero disables that limit.
+type Config struct {
+	MessageRate  float64
+	MessageBurst int
+	ByteRate     float64
+	ByteBurst    int
+
+	// MaxStrikes is the number of throttled requests within StrikeWindow
+	// after which the key is banned for BanDuration. Zero disables bans.
+	MaxStrikes   int
+	StrikeWindow time.Duration
+	BanDuration  time.Duration
+}
+
+// DefaultConfig returns the limits used when none are configured.
+func DefaultConfig() Config {
+	return Config{
+		MessageRate:  DEFAULTMESSAGERATE,
+		MessageBurst: DEFAULTMESSAGEBURST,
+		ByteRate:     DEFAULTBYTERATE,
+		ByteBurst:    DEFAULTBYTEBURST,
+		MaxStrikes:   DEFAULTMAXSTRIKES,
+		StrikeWindow: DEFAULTSTRIKEWINDOW,
+		BanDuration:  DEFAULTBANDURATION,
+	}
+}
+
+type entry struct {
+	messages *Bucket
+	bytes    *Bucket
+	strikes  []time.Time
+	banned   time.Time
+}
+
+// Limiter tracks message and byte buckets for arbitrary keys, such as a
+// connection, a chat identity or a source IP, and escalates repeat offenders
+// to a temporary ban.
+type Limiter struct {
+	config    Config
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastPrune time.Time
+}
+
+// New creates a Limiter enforcing the given configuration.
+func New(config Config) *Limiter {
+	return &Limiter{
+		config:    config,
+		entries:   make(map[string]*entry),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow charges one message of the given size against every key. Nothing is
+// charged unless every bucket of every key has room. All keys are checked
+// before any of them is charged a strike, so a single frame counts
+// once per key. It returns ErrBanned if any key is serving a ban, ErrThrottled
+// if any bucket is empty and nil otherwise.
+func (l *Limiter) Allow(size int, keys ...string) error {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	entries := make([]*entry, 0, len(keys))
+
+	for _, key := range keys {
+		e := l.lookup(key, now)
+		if now.Before(e.banned) {
+			return ErrBanned
+		}
+		entries = append(entries, e)
+	}
+
+	// Every bucket is checked before any is charged, so a frame refused by
+	// one limit does not use up tokens of the others.
+	throttled := false
+
+	for _, e := range entries {
+		if !e.messages.available(now, 1) || !e.bytes.available(now, size) {
+			throttled = true
+		}
+	}
+
+	if !throttled {
+		for _, e := range entries {
+			e.messages.take(1)
+			e.bytes.take(size)
+		}
+		return nil
+	}
+
+	banned := false
+
+	for _, e := range entries {
+		if l.strike(e, now) {
+			banned = true
+		}
+	}
+
+	if banned {
+		return ErrBanned
+	}
+	return ErrThrottled
+}
+
+// Banned reports whether the key is currently serving a ban.
+func (l *Limiter) Banned(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+
+	return ok && time.Now().Before(e.banned)
+}
+
+func (l *Limiter) lookup(key string, now time.Time) *entry {
+	e, ok := l.entries[key]
+	if !ok {
+		e = &entry{
+			messages: NewBucket(l.config.MessageRate, l.config.MessageBurst),
+			bytes:    NewBucket(l.config.ByteRate, l.config.ByteBurst),
+		}
+		l.entries[key] = e
+	}
+	return e
+}
+
+// strike records a throttled request and reports whether the entry has
+// crossed the strike threshold and is now banned.
+func (l *Limiter) strike(e *entry, now time.Time) bool {
+	if l.config.MaxStrikes <= 0 {
+		return false
+	}
+
+	cutoff := now.Add(-l.config.StrikeWindow)
+	kept := e.strikes[:0]
+
+	for _, s := range e.strikes {
+		if s.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	e.strikes = append(kept, now)
+
+	if len(e.strikes) < l.config.MaxStrikes {
+		return false
+	}
+
+	e.strikes = e.strikes[:0]
+	e.banned = now.Add(l.config.BanDuration)
+	return true
+}
+
+// prune drops entries that are idle, that is full buckets with no recent
+// strikes and no active ban, so the map does not grow with every connection
+// ever seen.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+
+	cutoff := now.Add(-l.config.StrikeWindow)
+
+	for key, e := range l.entries {
+		if now.Before(e.banned) {
+			continue
+		}
+		if n := len(e.strikes); n > 0 && e.strikes[n-1].After(cutoff) {
+			continue
+		}
+		if e.messages.full(now) && e.bytes.full(now) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBucketRefill drains a bucket, checks that further requests are refused,
+// and verifies that tokens become available again once time has passed.
+func TestBucketRefill(t *testing.T) {
+	now := time.Now()
+	bucket := NewBucket(10, 2)
+	bucket.last = now
+
+	if !bucket.AllowN(now, 1) || !bucket.AllowN(now, 1) {
+		t.Fatal("Expected the burst to be allowed")
+	}
+
+	if bucket.AllowN(now, 1) {
+		t.Error("Expected an empty bucket to refuse the request")
+	}
+
+	if !bucket.AllowN(now.Add(100*time.Millisecond), 1) {
+		t.Error("Expected the bucket to refill after 100ms")
+	}
+}
+
+// TestLimiterEscalation throttles a key until it crosses the strike threshold
+// and checks that it is reported as banned afterwards.
+func TestLimiterEscalation(t *testing.T) {
+	limiter := New(Config{
+		MessageRate:  1,
+		MessageBurst: 1,
+		MaxStrikes:   2,
+		StrikeWindow: time.Minute,
+		BanDuration:  time.Minute,
+	})
+
+	if err := limiter.Allow(1, "chat:a", "ip:127.0.0.1"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := limiter.Allow(1, "chat:a", "ip:127.0.0.1"); err != ErrThrottled {
+		t.Errorf("Expected %v, got %v", ErrThrottled, err)
+	}
+
+	if err := limiter.Allow(1, "chat:a", "ip:127.0.0.1"); err != ErrBanned {
+		t.Errorf("Expected %v, got %v", ErrBanned, err)
+	}
+
+	if !limiter.Banned("ip:127.0.0.1") {
+		t.Error("Expected the IP to be banned")
+	}
+
+	if limiter.Banned("ip:10.0.0.1") {
+		t.Error("Expected an unrelated IP not to be banned")
+	}
+}
+
+// TestLimiterChargesNothingWhenThrottled checks that a frame refused by the
+// byte limit does not use up a message token.
+func TestLimiterChargesNothingWhenThrottled(t *testing.T) {
+	limiter := New(Config{
+		MessageRate:  0.001,
+		MessageBurst: 1,
+		ByteRate:     0.001,
+		ByteBurst:    10,
+	})
+
+	limiter.lookup("chat:a", time.Now()).bytes.take(5)
+
+	if err := limiter.Allow(8, "chat:a"); err != ErrThrottled {
+		t.Fatalf("Expected %v, got %v", ErrThrottled, err)
+	}
+
+	if err := limiter.Allow(4, "chat:a"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"darkchat/access"
+	"darkchat/database"
+	"darkchat/monitor"
+	"net/netip"
+	"time"
+)
+
+const DEFAULTACCESSREFRESH = 5 * time.Second
+
+// seedAccessLists validates the allow and deny entries from the
+// configuration and adds them to the shared lists, so every node enforces
+// them. Adding an entry that is already there changes nothing, so nodes can
+// be started with the same entries any number of times.
+func seedAccessLists(allow, deny []string) error {
+	seeds := map[string][]string{
+		database.AllowList: allow,
+		database.DenyList:  deny,
+	}
+
+	for list, entries := range seeds {
+		prefixes, err := access.ParsePrefixes(entries)
+		if err != nil {
+			return err
+		}
+
+		for _, prefix := range prefixes {
+			if err := database.AddAccessEntry(list, prefix.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadAccessList fetches the shared allow list, deny list and bans and
+// replaces the contents of the given list with them. Entries that fail to
+// parse are logged and skipped.
+func loadAccessList(list *access.List) error {
+	allowEntries, err := database.AccessEntries(database.AllowList)
+	if err != nil {
+		return err
+	}
+
+	denyEntries, err := database.AccessEntries(database.DenyList)
+	if err != nil {
+		return err
+	}
+
+	banEntries, err := database.ActiveBans()
+	if err != nil {
+		return err
+	}
+
+	allow := parseAccessEntries(allowEntries)
+	deny := parseAccessEntries(denyEntries)
+	bans := make([]access.Ban, 0, len(banEntries))
+
+	for entry, expires := range banEntries {
+		prefix, err := access.ParsePrefix(entry)
+		if err != nil {
+			monitorLogger.Warning(err.Error())
+			continue
+		}
+		bans = append(bans, access.Ban{Prefix: prefix, Expires: expires})
+	}
+
+	list.Update(allow, deny, bans)
+	return nil
+}
+
+func parseAccessEntries(entries []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+
+	for _, entry := range entries {
+		prefix, err := access.ParsePrefix(entry)
+		if err != nil {
+			monitorLogger.Warning(err.Error())
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// refreshAccessList reloads the shared access lists every interval until the
+// context is canceled, so bans added or lifted at runtime reach this node
+// without a restart.
+func refreshAccessList(ctx context.Context, list *access.List, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := loadAccessList(list); err != nil {
+				monitorLogger.Error("Refreshing access lists failed", monitor.F(monitor.KeyError, err))
+			}
+		}
+	}
+}
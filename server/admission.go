@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULTMAXCONNECTIONS      = 10000
+	DEFAULTMAXCONNECTIONSPERIP = 32
+	DEFAULTHANDSHAKETIMEOUT    = 10 * time.Second
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+var (
+	ErrServerFull  = errors.New("server is full, try again later")
+	ErrTooManyFrom = errors.New("too many connections from your address")
+)
+
+// admission keeps count of the open connections, globally and per source IP,
+// and refuses new ones once either limit is reached. A limit of zero or less
+// means unlimited.
+type admission struct {
+	mu     sync.Mutex
+	max    int
+	perIP  int
+	active int
+	byIP   map[string]int
+}
+
+func newAdmission(max, perIP int) *admission {
+	return &admission{
+		max:   max,
+		perIP: perIP,
+		byIP:  make(map[string]int),
+	}
+}
+
+// acquire reserves a connection slot for the given IP. It returns
+// ErrServerFull or ErrTooManyFrom if a slot is not available. Every successful
+// acquire must be paired with a release.
+func (a *admission) acquire(ip string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.max > 0 && a.active >= a.max {
+		return ErrServerFull
+	}
+
+	if a.perIP > 0 && a.byIP[ip] >= a.perIP {
+		return ErrTooManyFrom
+	}
+
+	a.active++
+	a.byIP[ip]++
+	return nil
+}
+
+// release frees the slot previously acquired for the given IP.
+func (a *admission) release(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.active--
+	a.byIP[ip]--
+
+	if a.byIP[ip] <= 0 {
+		delete(a.byIP, ip)
+	}
+}
+
+// acceptBackoff returns how long to wait before the next Accept after a
+// failure, doubling the previous delay up to maxAcceptBackoff. This stops
+// errors like EMFILE from turning the accept loop into a busy loop.
+func acceptBackoff(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return minAcceptBackoff
+	}
+
+	next := previous * 2
+	if next > maxAcceptBackoff {
+		next = maxAcceptBackoff
+	}
+	return next
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAdmissionLimits fills the per-IP and global limits and checks that
+// further connections are refused until a slot is released.
+func TestAdmissionLimits(t *testing.T) {
+	slots := newAdmission(3, 2)
+
+	for i := 0; i < 2; i++ {
+		if err := slots.acquire("10.0.0.1"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if err := slots.acquire("10.0.0.1"); err != ErrTooManyFrom {
+		t.Errorf("Expected %v, got %v", ErrTooManyFrom, err)
+	}
+
+	if err := slots.acquire("10.0.0.2"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := slots.acquire("10.0.0.3"); err != ErrServerFull {
+		t.Errorf("Expected %v, got %v", ErrServerFull, err)
+	}
+
+	slots.release("10.0.0.1")
+
+	if err := slots.acquire("10.0.0.3"); err != nil {
+		t.Errorf("Expected no error after release, got %v", err)
+	}
+}
+
+// TestAcceptBackoff checks that the accept backoff doubles and is capped.
+func TestAcceptBackoff(t *testing.T) {
+	if d := acceptBackoff(0); d != minAcceptBackoff {
+		t.Errorf("Expected %s, got %s", minAcceptBackoff, d)
+	}
+
+	if d := acceptBackoff(10 * time.Millisecond); d != 20*time.Millisecond {
+		t.Errorf("Expected 20ms, got %s", d)
+	}
+
+	if d := acceptBackoff(maxAcceptBackoff); d != maxAcceptBackoff {
+		t.Errorf("Expected %s, got %s", maxAcceptBackoff, d)
+	}
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"darkchat/ratelimit"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ControlFrame is the frame type of darkchat's extension requests, responses
+// and events. It uses the same header as protocol frames but protocol.Decode
+// never sees it: the frameReader hands control frames to handleControl, and
+// writeToClient encodes them itself.
+//
+// A request is a JSON object {"op": ..., "ref": ..., "body": {...}}. Every
+// request gets a response with the same op and ref, "ok" and either "body" or
+// an "error" in errcodes format. Events pushed by the server carry an op, the
+// stream id of the entry as "id" when there is one, and a body.
+const ControlFrame uint8 = 0x80
+
+var (
+	ErrUnknownOperation = errors.New("unknown operation")
+	ErrBadRequest       = errors.New("malformed request")
+)
+
+type controlRequest struct {
+	Op   string          `json:"op"`
+	Ref  string          `json:"ref,omitempty"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type controlResponse struct {
+	Op    string      `json:"op"`
+	Ref   string      `json:"ref,omitempty"`
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// Byte returns the JSON encoding of the response.
+func (r *controlResponse) Byte() []byte {
+	b, _ := json.Marshal(r)
+	return b
+}
+
+// String returns the JSON encoding of the response as a string.
+func (r *controlResponse) String() string {
+	return string(r.Byte())
+}
+
+// controlHandler serves one op. The body returned is sent back in the
+// response, errors are sent with the code given by codedError or
+// errcodes.InvalidRequest.
+type controlHandler func(ctx context.Context, client Client, body json.RawMessage) (interface{}, error)
+
+var controlHandlers = map[string]controlHandler{}
+
+// selfLimited marks the ops whose handlers apply limits of their own instead
+// of the message limits every other request is charged against.
+var selfLimited = map[string]bool{}
+
+// registerControl adds the handler for an op. It is called from init in the
+// file implementing the op.
+func registerControl(op string, handler controlHandler) {
+	if _, exists := controlHandlers[op]; exists {
+		panic(fmt.Sprintf("control op %s registered twice", op))
+	}
+	controlHandlers[op] = handler
+}
+
+// codedError carries the error code a control request failed with.
+type codedError struct {
+	code errcodes.Code
+	err  error
+}
+
+func (e codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode tags err with the code it is reported to the client with.
+func withCode(code errcodes.Code, err error) error {
+	return codedError{code: code, err: err}
+}
+
+// decodeBody unmarshals a request body, tagging failures as invalid requests.
+func decodeBody(body json.RawMessage, v interface{}) error {
+	if len(body) == 0 {
+		return withCode(errcodes.InvalidRequest, fmt.Errorf("%w: missing body", ErrBadRequest))
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return withCode(errcodes.InvalidRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+	}
+	return nil
+}
+
+// handleControl serves one control frame. Failed requests are answered with
+// an error response, handleControl only returns an error when the connection
+// should be dropped: the response could not be written or the client is
+// banned.
+func handleControl(ctx context.Context, client Client, payload []byte) error {
+	var request controlRequest
+
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return writeControl(client, &controlResponse{
+			Error: errcodes.Format(errcodes.MalformedFrame, "", err.Error()),
+		})
+	}
+
+	response := &controlResponse{Op: request.Op, Ref: request.Ref}
+
+	if err := client.allowControl(request.Op, len(payload)); err != nil {
+		client.log.Warning("Throttled", monitor.F("op", request.Op), monitor.F(monitor.KeyError, err))
+
+		code := errcodes.Throttled
+		if err == ratelimit.ErrBanned {
+			code = errcodes.Banned
+		}
+		response.Error = errcodes.Format(code, "", err.Error())
+
+		if writeErr := writeControl(client, response); writeErr != nil {
+			return writeErr
+		}
+		if err == ratelimit.ErrBanned {
+			return err
+		}
+		return nil
+	}
+
+	handler, ok := controlHandlers[request.Op]
+	if !ok {
+		response.Error = errcodes.Format(errcodes.UnknownOperation, "", fmt.Sprintf("%s: %q", ErrUnknownOperation, request.Op))
+		return writeControl(client, response)
+	}
+
+	body, err := handler(ctx, client, request.Body)
+
+	return respond(client, response, body, err)
+}
+
+// allowControl charges a request against the message limits, unless its op
+// is limited by its handler.
+func (c Client) allowControl(op string, size int) error {
+	if selfLimited[op] {
+		return nil
+	}
+	return c.allow(size)
+}
+
+// respond completes a response with the result of a handler and sends it.
+func respond(client Client, response *controlResponse, body interface{}, err error) error {
+	if err != nil {
+		code := errcodes.InvalidRequest
+
+		var coded codedError
+		if errors.As(err, &coded) {
+			code = coded.code
+		}
+
+		client.log.Warning("Control request failed", monitor.F("op", response.Op), monitor.F(monitor.KeyError, err))
+		response.Error = errcodes.Format(code, "", err.Error())
+
+		return writeControl(client, response)
+	}
+
+	response.OK = true
+	response.Body = body
+
+	return writeControl(client, response)
+}
+
+// writeControl sends a response to the client, logging failures.
+func writeControl(client Client, response *controlResponse) error {
+	if err := writeToClient(client, response, ControlFrame); err != nil {
+		client.log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// connState is the part of a connection's state that control requests
+// change. Client is passed around by value, so it holds a pointer to it.
+type connState struct {
+	mu       sync.Mutex
+	identity string
+	session  string
+
+	// device is the device the connection authenticated as, challenge the
+	// nonce it has to sign to do so and deviceStream the streaming of its
+	// identity's stream.
+	device       string
+	challenge    []byte
+	deviceStream *streaming
+
+	// present is the identity whose presence the connection announced.
+	present string
+}
+
+// setIdentity records the identity the client proved it holds the key of.
+func (s *connState) setIdentity(identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.identity = identity
+}
+
+// boundIdentity returns the identity bound to the connection, or an empty
+// string.
+func (s *connState) boundIdentity() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.identity
+}
+
+// setSession records the token of the connection's resumable session.
+func (s *connState) setSession(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.session = token
+}
+
+// sessionToken returns the token of the connection's session, or an empty
+// string if it is not resumable.
+func (s *connState) sessionToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.session
+}
+
+// restore takes over the identity of a resumed session. The device and
+// presence of the session are bound again by the caller, the connection's own
+// are forgotten.
+func (s *connState) restore(token string, identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.session = token
+	s.identity = identity
+	s.device = ""
+	s.challenge = nil
+	s.deviceStream = nil
+	s.present = ""
+}
+
+// setChallenge records the nonce a devices.auth request has to sign.
+func (s *connState) setChallenge(nonce []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.challenge = nonce
+}
+
+// takeChallenge returns the pending nonce, or nil, and clears it so it is
+// only ever signed once.
+func (s *connState) takeChallenge() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nonce := s.challenge
+	s.challenge = nil
+	return nonce
+}
+
+// setDevice records the device the connection authenticated as and the
+// streaming of its identity's stream. It returns the streaming of a device
+// the connection was authenticated as before, for the caller to stop.
+func (s *connState) setDevice(identity string, device string, stream *streaming) *streaming {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.deviceStream
+
+	s.identity = identity
+	s.device = device
+	s.deviceStream = stream
+
+	return previous
+}
+
+// boundDevice returns the identity and device the connection authenticated
+// as, or empty strings.
+func (s *connState) boundDevice() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.device == "" {
+		return "", ""
+	}
+	return s.identity, s.device
+}
+
+// releaseDevice forgets the device and returns its streaming, or nil, for
+// the caller to stop.
+func (s *connState) releaseDevice() *streaming {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream := s.deviceStream
+
+	s.device = ""
+	s.deviceStream = nil
+
+	return stream
+}
+
+// setPresent records that the connection announced the presence of an
+// identity, so it is kept online by heartbeats and taken offline when the
+// connection closes.
+func (s *connState) setPresent(identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.present = identity
+}
+
+// presentIdentity returns the identity whose presence the connection
+// announced, or an empty string.
+func (s *connState) presentIdentity() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.present
+}
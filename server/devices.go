@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"encoding/json"
+	"errors"
+	"time"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+)
+
+const (
+	// deviceLinkContext and deviceAuthContext prefix what identity and
+	// device keys sign, so a signature made for one purpose cannot be
+	// replayed for another.
+	deviceLinkContext = "darkchat-device-link:"
+	deviceAuthContext = "darkchat-device-auth:"
+
+	// maxDeviceName is the longest device name kept, in bytes.
+	maxDeviceName = 64
+)
+
+var (
+	ErrInvalidDeviceKey = errors.New("device key must be a 32 byte Ed25519 public key")
+	ErrNoChallenge      = errors.New("no pending challenge, request one with devices.challenge")
+	ErrNoDevice         = errors.New("no device authenticated on this connection")
+	ErrOtherIdentity    = errors.New("connection is bound to another identity")
+)
+
+// deviceLink is the body of a devices.link request. The identity key signs
+// the device key, certifying that the device speaks for the identity.
+type deviceLink struct {
+	IdentityKey []byte `json:"identity_key"`
+	DeviceKey   []byte `json:"device_key"`
+	Name        string `json:"name,omitempty"`
+	Signature   []byte `json:"signature"`
+}
+
+// deviceAuth is the body of a devices.auth request, signed with the device
+// key over the nonce returned by devices.challenge.
+type deviceAuth struct {
+	Identity  string `json:"identity"`
+	Device    string `json:"device"`
+	Signature []byte `json:"signature"`
+}
+
+type deviceRevoke struct {
+	Device string `json:"device"`
+}
+
+// syncEvent is how a message sent from one device reaches the identity's
+// other devices.
+type syncEvent struct {
+	Device     string `json:"device"`
+	To         string `json:"to,omitempty"`
+	ToIdentity string `json:"to_identity,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Envelope   []byte `json:"envelope,omitempty"`
+	ID         string `json:"id,omitempty"`
+}
+
+func init() {
+	registerControl("devices.link", linkDevice)
+	registerControl("devices.challenge", challengeDevice)
+	registerControl("devices.auth", authenticateDevice)
+	registerControl("devices.list", listDevices)
+	registerControl("devices.revoke", revokeDevice)
+}
+
+// verifyDeviceLink checks that the identity key signed the device key and
+// returns the identity and device ids.
+func verifyDeviceLink(link deviceLink) (string, string, error) {
+	if len(link.IdentityKey) != ed25519.PublicKeySize {
+		return "", "", withCode(errcodes.InvalidRequest, ErrInvalidIdentityKey)
+	}
+
+	if len(link.DeviceKey) != ed25519.PublicKeySize {
+		return "", "", withCode(errcodes.InvalidRequest, ErrInvalidDeviceKey)
+	}
+
+	signed := append([]byte(deviceLinkContext), link.DeviceKey...)
+
+	if !ed25519.Verify(ed25519.PublicKey(link.IdentityKey), signed, link.Signature) {
+		return "", "", withCode(errcodes.InvalidSignature, ErrInvalidSignature)
+	}
+
+	return identityOf(link.IdentityKey), identityOf(link.DeviceKey), nil
+}
+
+// verifyDeviceAuth checks that the device key signed the challenge nonce.
+func verifyDeviceAuth(deviceKey []byte, nonce []byte, signature []byte) error {
+	if len(deviceKey) != ed25519.PublicKeySize {
+		return withCode(errcodes.InvalidRequest, ErrInvalidDeviceKey)
+	}
+
+	signed := append([]byte(deviceAuthContext), nonce...)
+
+	if !ed25519.Verify(ed25519.PublicKey(deviceKey), signed, signature) {
+		return withCode(errcodes.InvalidSignature, ErrInvalidSignature)
+	}
+	return nil
+}
+
+// deviceError maps device lookup failures to the codes sent to the client.
+func deviceError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrRevokedDevice):
+		return withCode(errcodes.DeviceRevoked, err)
+	case errors.Is(err, database.ErrUnknownDevice):
+		return withCode(errcodes.DeviceNotFound, err)
+	default:
+		return withCode(errcodes.DeliveryFailed, errors.New("devices could not be loaded"))
+	}
+}
+
+// linkDevice adds a device to an identity's device list. Linking does not
+// authenticate the connection, the device does that itself with devices.auth.
+func linkDevice(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var link deviceLink
+
+	if err := decodeBody(body, &link); err != nil {
+		return nil, err
+	}
+
+	identity, deviceID, err := verifyDeviceLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(link.Name) > maxDeviceName {
+		link.Name = link.Name[:maxDeviceName]
+	}
+
+	device := database.Device{ID: deviceID, Key: link.DeviceKey, Name: link.Name, Added: time.Now().Unix()}
+
+	if err := database.LinkDevice(identity, device); err != nil {
+		return nil, deviceError(err)
+	}
+
+	client.log.Info("Linked device", monitor.F("device", deviceID))
+
+	return map[string]string{"identity": identity, "device": deviceID}, nil
+}
+
+// challengeDevice returns a fresh nonce for the next devices.auth request.
+func challengeDevice(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	nonce := make([]byte, 32)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("challenge could not be created"))
+	}
+
+	client.state.setChallenge(nonce)
+
+	return map[string][]byte{"nonce": nonce}, nil
+}
+
+// authenticateDevice binds the connection to a linked device of an identity
+// and starts delivering the identity's stream to it: everything sent to the
+// identity, and what its other devices send, from where the device last left
+// off.
+func authenticateDevice(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var auth deviceAuth
+
+	if err := decodeBody(body, &auth); err != nil {
+		return nil, err
+	}
+
+	if err := validateIdentity(auth.Identity); err != nil {
+		return nil, err
+	}
+
+	nonce := client.state.takeChallenge()
+	if nonce == nil {
+		return nil, withCode(errcodes.InvalidRequest, ErrNoChallenge)
+	}
+
+	if bound := client.state.boundIdentity(); bound != "" && bound != auth.Identity {
+		return nil, withCode(errcodes.InvalidRequest, ErrOtherIdentity)
+	}
+
+	device, err := database.GetDevice(auth.Identity, auth.Device)
+	if err != nil {
+		return nil, deviceError(err)
+	}
+
+	if err := verifyDeviceAuth(device.Key, nonce, auth.Signature); err != nil {
+		return nil, err
+	}
+
+	if err := bindDevice(ctx, client, auth.Identity, device.ID); err != nil {
+		return nil, deviceError(err)
+	}
+
+	client.log.Info("Authenticated device", monitor.F("device", device.ID))
+
+	saveSession(client)
+
+	return map[string]string{"identity": auth.Identity, "device": device.ID}, nil
+}
+
+// bindDevice attaches the connection to a device of an identity it
+// authenticated as, now or before it resumed its session, and starts
+// delivering the identity's stream to it.
+func bindDevice(ctx context.Context, client Client, identity string, device string) error {
+	if err := database.AttachDevice(identity, device); err != nil {
+		return err
+	}
+
+	stream := startDeviceStreaming(ctx, client, identity, device)
+
+	if previous := client.state.setDevice(identity, device, stream); previous != nil {
+		previous.stop()
+	}
+
+	signals.add(database.IdentityChat(identity), client)
+
+	client.lifecycle.markAuthenticated()
+	return nil
+}
+
+// listDevices returns the devices linked to the connection's identity.
+func listDevices(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	identity, _ := client.state.boundDevice()
+	if identity == "" {
+		return nil, withCode(errcodes.InvalidRequest, ErrNoDevice)
+	}
+
+	devices, err := database.Devices(identity)
+	if err != nil {
+		return nil, deviceError(err)
+	}
+	return map[string]interface{}{"devices": devices}, nil
+}
+
+// revokeDevice removes a device of the connection's identity for good. Its
+// connections, this one included if it revokes itself, are closed.
+func revokeDevice(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request deviceRevoke
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	identity, _ := client.state.boundDevice()
+	if identity == "" {
+		return nil, withCode(errcodes.InvalidRequest, ErrNoDevice)
+	}
+
+	if err := database.RevokeDevice(identity, request.Device); err != nil {
+		return nil, deviceError(err)
+	}
+
+	client.log.Info("Revoked device", monitor.F("device", request.Device))
+
+	return map[string]string{"device": request.Device}, nil
+}
+
+// startDeviceStreaming delivers the identity's stream to a device through
+// its own consumer group, leaving out what the device sent or read itself. When the
+// group is destroyed because the device was revoked, the client is told and
+// the connection closed.
+func startDeviceStreaming(ctx context.Context, client Client, identity string, device string) *streaming {
+	ownSync := func(payload protocol.Payload) bool {
+		event, ok := payload.(*database.Event)
+		if !ok || (event.Op != "sync" && event.Op != "read") {
+			return false
+		}
+
+		var origin struct {
+			Device string `json:"device"`
+		}
+		return json.Unmarshal(event.Body, &origin) == nil && origin.Device == device
+	}
+
+	s := streamTo(ctx, client, database.DeviceReader(identity, device), []string{database.IdentityChat(identity)}, ownSync)
+
+	go func() {
+		<-s.done
+
+		if s.stopped() {
+			return
+		}
+
+		client.log.Warning("Device revoked", monitor.F("device", device))
+		writeError(client, errcodes.DeviceRevoked, database.ErrRevokedDevice)
+		client.lifecycle.disconnect("device revoked")
+		client.connection.Close()
+	}()
+
+	return s
+}
+
+// syncOutbound copies what was sent to the other devices of the sender's
+// identity, with the time to live of the original. Nothing is copied for
+// senders that did not authenticate as a device. A failed copy is logged,
+// the message itself was delivered.
+func syncOutbound(ctx context.Context, from outbound, event syncEvent, ttl time.Duration) {
+	if from.device == "" {
+		return
+	}
+
+	event.Device = from.device
+
+	if _, err := database.PostEventToIdentity(ctx, "sync", event, from.identity, ttl); err != nil {
+		from.log.Error("Syncing to other devices failed", monitor.F(monitor.KeyError, err))
+	}
+}
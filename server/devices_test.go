@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// TestVerifyDeviceLink certifies a device key with an identity key and checks
+// that it verifies to the ids of both keys, and that a signature by another
+// key or over another purpose is refused.
+func TestVerifyDeviceLink(t *testing.T) {
+	identityKey, identityPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	deviceKey, devicePrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	link := deviceLink{
+		IdentityKey: identityKey,
+		DeviceKey:   deviceKey,
+		Signature:   ed25519.Sign(identityPrivate, append([]byte(deviceLinkContext), deviceKey...)),
+	}
+
+	identity, device, err := verifyDeviceLink(link)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if identity != identityOf(identityKey) || device != identityOf(deviceKey) {
+		t.Errorf("Unexpected ids %s and %s", identity, device)
+	}
+
+	selfSigned := link
+	selfSigned.Signature = ed25519.Sign(devicePrivate, append([]byte(deviceLinkContext), deviceKey...))
+	if _, _, err := verifyDeviceLink(selfSigned); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected %v, got %v", ErrInvalidSignature, err)
+	}
+
+	otherPurpose := link
+	otherPurpose.Signature = ed25519.Sign(identityPrivate, append([]byte(deviceAuthContext), deviceKey...))
+	if _, _, err := verifyDeviceLink(otherPurpose); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected %v, got %v", ErrInvalidSignature, err)
+	}
+}
+
+// TestVerifyDeviceAuth checks that a device proves itself by signing the
+// challenge nonce, and only that nonce.
+func TestVerifyDeviceAuth(t *testing.T) {
+	deviceKey, devicePrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	nonce := []byte("nonce")
+	signature := ed25519.Sign(devicePrivate, append([]byte(deviceAuthContext), nonce...))
+
+	if err := verifyDeviceAuth(deviceKey, nonce, signature); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := verifyDeviceAuth(deviceKey, []byte("other nonce"), signature); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected %v, got %v", ErrInvalidSignature, err)
+	}
+
+	if err := verifyDeviceAuth([]byte("short"), nonce, signature); !errors.Is(err, ErrInvalidDeviceKey) {
+		t.Errorf("Expected %v, got %v", ErrInvalidDeviceKey, err)
+	}
+}
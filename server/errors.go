@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// handleClientError logs an error reported by the client, counts it against
+// the client's error codes and, when it refers to a message the client
+// received and the code is relayable, passes it back to the sender of that
+// message. The relayed report is posted with the connection's context, so it
+// is logged with the connection id.
+func handleClientError(ctx context.Context, client Client, report errcodes.Report) {
+	client.errorReports[report.Code]++
+
+	client.log.Warning(
+		"Client reported error",
+		monitor.F("code", int(report.Code)),
+		monitor.F("category", report.Code.String()),
+		monitor.F(monitor.KeyMessageID, report.MessageID),
+		monitor.F("text", report.Text),
+	)
+
+	if report.MessageID == "" || !report.Code.Relayable() {
+		return
+	}
+
+	sender, err := database.MessageSender(client.chatId, report.MessageID)
+	if err != nil {
+		client.log.Warning("Not relaying error", monitor.F(monitor.KeyMessageID, report.MessageID), monitor.F(monitor.KeyError, err))
+		return
+	}
+
+	if !database.CheckChatExists(sender) {
+		return
+	}
+
+	text := errcodes.Format(report.Code, report.MessageID, report.Text)
+
+	if _, err := database.PostErrorToChat(ctx, text, sender); err != nil {
+		client.log.Error(err.Error())
+	}
+}
+
+// summarizeErrorReports renders the per-code counts of errors reported by a
+// client, for logging when the connection closes.
+func summarizeErrorReports(reports map[errcodes.Code]int) string {
+	codes := make([]int, 0, len(reports))
+
+	for code := range reports {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	parts := make([]string, 0, len(codes))
+
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%s=%d", errcodes.Code(code), reports[errcodes.Code(code)]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"unicode"
+	"unicode/utf8"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	DEFAULTMAXFRAMESIZE   = 64 * 1024
+	DEFAULTMAXMESSAGESIZE = 16 * 1024
+)
+
+// frameHeaderSize is the type byte followed by the big endian uint32 payload
+// length written by protocol.Encode.
+const frameHeaderSize = 5
+
+// maxDiscardFactor bounds how large an oversized frame may be and still be
+// skipped so the connection can carry on. Anything bigger is treated as abuse
+// and the connection is closed.
+const maxDiscardFactor = 16
+
+var (
+	ErrFrameTooLarge   = errors.New("frame too large")
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrEmptyMessage    = errors.New("message is empty")
+	ErrInvalidUTF8     = errors.New("message is not valid UTF-8")
+	ErrControlChars    = errors.New("message contains control characters")
+	ErrInvalidChatId   = errors.New("invalid recipient chat id")
+)
+
+// frameReader sits between the connection and protocol.Decode and inspects
+// each frame header before the decoder allocates a buffer for it.
+type frameReader struct {
+	*bufio.Reader
+	maxFrameSize int
+}
+
+func newFrameReader(conn net.Conn, maxFrameSize int) *frameReader {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DEFAULTMAXFRAMESIZE
+	}
+	return &frameReader{
+		Reader:       bufio.NewReaderSize(conn, frameHeaderSize+4096),
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// next peeks at the header of the next frame and returns ErrFrameTooLarge if
+// the declared payload exceeds the limit. Oversized frames within
+// maxDiscardFactor of the limit are skipped without being buffered, and skip
+// is true so the caller knows the stream is still in sync.
+func (f *frameReader) next() (skip bool, err error) {
+	header, err := f.Peek(frameHeaderSize)
+	if err != nil {
+		return false, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[1:]))
+
+	if size <= int64(f.maxFrameSize) {
+		return false, nil
+	}
+
+	if size > int64(f.maxFrameSize)*maxDiscardFactor {
+		return false, fmt.Errorf("%w: %d bytes, limit is %d", ErrFrameTooLarge, size, f.maxFrameSize)
+	}
+
+	if _, err := f.Discard(frameHeaderSize); err != nil {
+		return false, err
+	}
+
+	if _, err := io.CopyN(io.Discard, f, size); err != nil {
+		return false, err
+	}
+
+	return true, fmt.Errorf("%w: %d bytes, limit is %d", ErrFrameTooLarge, size, f.maxFrameSize)
+}
+
+// control reads the next frame if it is a ControlFrame and returns its
+// payload, with ok false and nothing consumed for any other frame type. It
+// must be called after next, which has already checked the size.
+func (f *frameReader) control() (payload []byte, ok bool, err error) {
+	header, err := f.Peek(frameHeaderSize)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if header[0] != ControlFrame {
+		return nil, false, nil
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+
+	if _, err := f.Discard(frameHeaderSize); err != nil {
+		return nil, false, err
+	}
+
+	payload = make([]byte, size)
+
+	if _, err := io.ReadFull(f, payload); err != nil {
+		return nil, false, err
+	}
+	return payload, true, nil
+}
+
+// writeFrame writes a frame with the header protocol.Encode uses, in one
+// write so it cannot interleave with frames written by other goroutines.
+func writeFrame(w io.Writer, frameType uint8, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// validateMessage checks that a decoded message is addressed to a well formed
+// chat id and carries non-empty, valid UTF-8 text without control characters
+// other than newlines and tabs, no longer than maxMessageSize bytes.
+func validateMessage(m protocol.Message, maxMessageSize int) error {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DEFAULTMAXMESSAGESIZE
+	}
+
+	if err := validateChatId(m.To); err != nil {
+		return err
+	}
+
+	if len(m.Message) == 0 {
+		return ErrEmptyMessage
+	}
+
+	if len(m.Message) > maxMessageSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooLarge, len(m.Message), maxMessageSize)
+	}
+
+	if !utf8.ValidString(m.Message) {
+		return ErrInvalidUTF8
+	}
+
+	for _, r := range m.Message {
+		if r == '\n' || r == '\t' {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return ErrControlChars
+		}
+	}
+	return nil
+}
+
+// validateChatId checks that the id has the format of the ids handed out by
+// the server.
+func validateChatId(chatId string) error {
+	parsed, err := uuid.Parse(chatId)
+	if err != nil || parsed.String() != chatId {
+		return fmt.Errorf("%w: %q", ErrInvalidChatId, chatId)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+	"github.com/google/uuid"
+)
+
+// TestFrameReaderOversized sends a frame larger than the limit followed by a
+// small one and checks that the large frame is reported and skipped while the
+// small one is left for the decoder.
+func TestFrameReaderOversized(t *testing.T) {
+	server, client := net.Pipe()
+
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		frame := make([]byte, frameHeaderSize+32)
+		frame[0] = protocol.MessageType
+		binary.BigEndian.PutUint32(frame[1:], 32)
+		client.Write(frame)
+
+		small := make([]byte, frameHeaderSize+4)
+		small[0] = protocol.MessageType
+		binary.BigEndian.PutUint32(small[1:], 4)
+		client.Write(small)
+	}()
+
+	reader := newFrameReader(server, 16)
+
+	skipped, err := reader.next()
+	if !errors.Is(err, ErrFrameTooLarge) || !skipped {
+		t.Fatalf("Expected a skipped %v, got %v (skipped %v)", ErrFrameTooLarge, err, skipped)
+	}
+
+	skipped, err = reader.next()
+	if err != nil || skipped {
+		t.Fatalf("Expected the small frame to pass, got %v (skipped %v)", err, skipped)
+	}
+}
+
+// TestFrameReaderControl writes a control frame followed by a message frame
+// and checks that only the control frame is consumed by control.
+func TestFrameReaderControl(t *testing.T) {
+	server, client := net.Pipe()
+
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		writeFrame(client, ControlFrame, []byte(`{"op":"keys.count"}`))
+		writeFrame(client, protocol.MessageType, []byte("{}"))
+	}()
+
+	reader := newFrameReader(server, 64)
+
+	if _, err := reader.next(); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, ok, err := reader.control()
+	if err != nil || !ok || string(payload) != `{"op":"keys.count"}` {
+		t.Fatalf("Expected the control payload, got %q (ok %v, err %v)", payload, ok, err)
+	}
+
+	if _, err := reader.next(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := reader.control(); ok || err != nil {
+		t.Errorf("Expected the message frame to be left for the decoder, got ok %v, err %v", ok, err)
+	}
+}
+
+// TestValidateMessage checks the recipient and text validation rules.
+func TestValidateMessage(t *testing.T) {
+	to := uuid.NewString()
+
+	cases := []struct {
+		message  protocol.Message
+		expected error
+	}{
+		{protocol.Message{Message: "hi\nthere", To: to}, nil},
+		{protocol.Message{Message: "hello", To: "not-a-chat"}, ErrInvalidChatId},
+		{protocol.Message{Message: "", To: to}, ErrEmptyMessage},
+		{protocol.Message{Message: strings.Repeat("a", 11), To: to}, ErrMessageTooLarge},
+		{protocol.Message{Message: "bad \xff", To: to}, ErrInvalidUTF8},
+		{protocol.Message{Message: "bell \a", To: to}, ErrControlChars},
+	}
+
+	for _, c := range cases {
+		err := validateMessage(c.message, 10)
+		if !errors.Is(err, c.expected) {
+			t.Errorf("%q: expected %v, got %v", c.message.Message, c.expected, err)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxUploadSkew is how far the timestamp of a key upload may be from the
+// server's clock.
+const maxUploadSkew = 5 * time.Minute
+
+var (
+	ErrInvalidIdentityKey = errors.New("identity key must be a 32 byte Ed25519 public key")
+	ErrInvalidSignature   = errors.New("signature does not verify")
+	ErrUploadExpired      = errors.New("upload timestamp is too far from the server's clock")
+	ErrTooManyPrekeys     = errors.New("too many one-time prekeys")
+	ErrNoIdentity         = errors.New("no identity bound to this connection, upload keys first")
+	ErrInvalidIdentity    = errors.New("invalid identity")
+	ErrTwoRecipients      = errors.New("envelope has both a chat and an identity recipient")
+)
+
+// keyUpload is the body of a keys.upload request. Bundle is signed as sent,
+// byte for byte, with the identity key, which proves the uploader holds it
+// without the server and client having to agree on a canonical encoding.
+type keyUpload struct {
+	IdentityKey []byte          `json:"identity_key"`
+	Bundle      json.RawMessage `json:"bundle"`
+	Signature   []byte          `json:"signature"`
+}
+
+type keyBundleUpload struct {
+	Timestamp      int64                 `json:"timestamp"`
+	SignedPrekey   database.SignedPrekey `json:"signed_prekey"`
+	OneTimePrekeys []database.Prekey     `json:"one_time_prekeys"`
+}
+
+type keyFetch struct {
+	Identity string `json:"identity"`
+}
+
+// envelopeSend is the body of an envelope.send request. The envelope goes to
+// the chat To or, when ToIdentity is set instead, to every device of that
+// identity.
+type envelopeSend struct {
+	To         string `json:"to,omitempty"`
+	ToIdentity string `json:"to_identity,omitempty"`
+	Envelope   []byte `json:"envelope"`
+}
+
+// envelopeEvent is how a relayed envelope reaches its recipient.
+type envelopeEvent struct {
+	From     string `json:"from"`
+	Envelope []byte `json:"envelope"`
+}
+
+func init() {
+	registerControl("keys.upload", uploadKeys)
+	registerControl("keys.fetch", fetchKeys)
+	registerControl("keys.count", countPrekeys)
+	registerControl("envelope.send", sendEnvelope)
+}
+
+// identityOf returns the identity id of an identity key: the hex encoded
+// first 16 bytes of its SHA-256. Identities are self-certifying, whoever can
+// sign with the key owns the id.
+func identityOf(identityKey []byte) string {
+	sum := sha256.Sum256(identityKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// verifyKeyUpload checks the signatures and timestamp of an upload and
+// returns the decoded bundle.
+func verifyKeyUpload(upload keyUpload, now time.Time) (keyBundleUpload, error) {
+	var bundle keyBundleUpload
+
+	if len(upload.IdentityKey) != ed25519.PublicKeySize {
+		return bundle, withCode(errcodes.InvalidRequest, ErrInvalidIdentityKey)
+	}
+
+	identityKey := ed25519.PublicKey(upload.IdentityKey)
+
+	if !ed25519.Verify(identityKey, upload.Bundle, upload.Signature) {
+		return bundle, withCode(errcodes.InvalidSignature, fmt.Errorf("bundle %w", ErrInvalidSignature))
+	}
+
+	if err := decodeBody(upload.Bundle, &bundle); err != nil {
+		return bundle, err
+	}
+
+	skew := now.Sub(time.UnixMilli(bundle.Timestamp))
+	if skew > maxUploadSkew || skew < -maxUploadSkew {
+		return bundle, withCode(errcodes.InvalidRequest, ErrUploadExpired)
+	}
+
+	if !ed25519.Verify(identityKey, bundle.SignedPrekey.Key, bundle.SignedPrekey.Signature) {
+		return bundle, withCode(errcodes.InvalidSignature, fmt.Errorf("signed prekey %w", ErrInvalidSignature))
+	}
+
+	if len(bundle.OneTimePrekeys) > database.MaxOneTimePrekeys {
+		return bundle, withCode(errcodes.InvalidRequest, fmt.Errorf("%w: %d, limit is %d", ErrTooManyPrekeys, len(bundle.OneTimePrekeys), database.MaxOneTimePrekeys))
+	}
+	return bundle, nil
+}
+
+// uploadKeys publishes the identity key, signed prekey and one-time prekeys
+// of the client and binds the identity to the connection.
+func uploadKeys(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var upload keyUpload
+
+	if err := decodeBody(body, &upload); err != nil {
+		return nil, err
+	}
+
+	bundle, err := verifyKeyUpload(upload, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	identity := identityOf(upload.IdentityKey)
+
+	err = database.PublishKeys(identity, upload.IdentityKey, bundle.SignedPrekey, bundle.OneTimePrekeys, client.chatId, bundle.Timestamp)
+
+	if errors.Is(err, database.ErrStaleKeys) {
+		return nil, withCode(errcodes.InvalidRequest, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("keys could not be stored"))
+	}
+
+	client.state.setIdentity(identity)
+
+	saveSession(client)
+
+	count, err := database.PrekeyCount(identity)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("keys could not be counted"))
+	}
+
+	return map[string]interface{}{"identity": identity, "prekeys": count}, nil
+}
+
+// fetchKeys returns the key bundle of an identity, consuming one of its
+// one-time prekeys.
+func fetchKeys(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request keyFetch
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateIdentity(request.Identity); err != nil {
+		return nil, err
+	}
+
+	bundle, err := database.FetchKeyBundle(request.Identity)
+
+	if errors.Is(err, database.ErrNoKeys) {
+		return nil, withCode(errcodes.KeysNotFound, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("keys could not be fetched"))
+	}
+	return bundle, nil
+}
+
+// countPrekeys returns how many one-time prekeys the client's identity has
+// left.
+func countPrekeys(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	identity := client.state.boundIdentity()
+	if identity == "" {
+		return nil, withCode(errcodes.InvalidRequest, ErrNoIdentity)
+	}
+
+	count, err := database.PrekeyCount(identity)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("keys could not be counted"))
+	}
+	return map[string]interface{}{"identity": identity, "prekeys": count}, nil
+}
+
+// validateIdentity checks that an identity id is as returned by identityOf.
+func validateIdentity(identity string) error {
+	if decoded, err := hex.DecodeString(identity); err != nil || len(decoded) != 16 {
+		return withCode(errcodes.InvalidRequest, ErrInvalidIdentity)
+	}
+	return nil
+}
+
+// sendEnvelope relays an opaque ciphertext envelope to a chat, or to the
+// devices of an identity. The server does not look inside it, it only bounds
+// its size. A copy goes to the sender's other devices.
+func sendEnvelope(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request envelopeSend
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateEnvelope(request, client.maxMessageSize); err != nil {
+		return nil, err
+	}
+
+	event := envelopeEvent{From: client.chatId, Envelope: request.Envelope}
+
+	var (
+		id  string
+		ttl time.Duration
+		err error
+	)
+
+	if request.ToIdentity != "" {
+		if !database.HasDevices(request.ToIdentity) {
+			return nil, withCode(errcodes.DeviceNotFound, errors.New("identity has no devices"))
+		}
+
+		ttl, err = database.ConversationTTL(client.chatId, database.IdentityChat(request.ToIdentity))
+		if err == nil {
+			id, err = database.PostEventToIdentity(ctx, "envelope", event, request.ToIdentity, ttl)
+		}
+		if err != nil {
+			return nil, withCode(errcodes.DeliveryFailed, errors.New("envelope could not be delivered"))
+		}
+	} else {
+		if !database.CheckChatExists(request.To) {
+			return nil, withCode(errcodes.ChatNotFound, errors.New("chat does not exist"))
+		}
+
+		ttl, err = database.ConversationTTL(client.chatId, request.To)
+		if err == nil {
+			id, err = database.PostEvent(ctx, "envelope", event, request.To, ttl)
+		}
+		if err != nil {
+			return nil, withCode(errcodes.DeliveryFailed, errors.New("envelope could not be delivered"))
+		}
+	}
+
+	syncOutbound(ctx, clientOutbound(client), syncEvent{To: request.To, ToIdentity: request.ToIdentity, Envelope: request.Envelope, ID: id}, ttl)
+
+	return map[string]string{"id": id}, nil
+}
+
+// validateEnvelope checks that an envelope is addressed to a well formed chat
+// id or identity, not both, and is neither empty nor larger than
+// maxMessageSize bytes.
+func validateEnvelope(request envelopeSend, maxMessageSize int) error {
+	if request.ToIdentity != "" {
+		if request.To != "" {
+			return withCode(errcodes.InvalidRecipient, ErrTwoRecipients)
+		}
+		if err := validateIdentity(request.ToIdentity); err != nil {
+			return withCode(errcodes.InvalidRecipient, err)
+		}
+		return validateEnvelopeSize(request.Envelope, maxMessageSize)
+	}
+
+	if err := validateChatId(request.To); err != nil {
+		return withCode(errcodes.InvalidRecipient, err)
+	}
+	return validateEnvelopeSize(request.Envelope, maxMessageSize)
+}
+
+// validateEnvelopeSize checks that an envelope is neither empty nor larger
+// than maxMessageSize bytes.
+func validateEnvelopeSize(envelope []byte, maxMessageSize int) error {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DEFAULTMAXMESSAGESIZE
+	}
+
+	if len(envelope) == 0 {
+		return withCode(errcodes.InvalidMessage, ErrEmptyMessage)
+	}
+
+	if len(envelope) > maxMessageSize {
+		return withCode(errcodes.InvalidMessage, fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooLarge, len(envelope), maxMessageSize))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"darkchat/database"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TestVerifyKeyUpload signs a bundle and checks that it verifies, and that
+// tampering with it, a bad signed prekey or an old timestamp are refused.
+func TestVerifyKeyUpload(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+
+	now := time.Now()
+	prekey := []byte("signed prekey public key 32 byte")
+
+	sign := func(bundle keyBundleUpload) keyUpload {
+		raw, _ := json.Marshal(bundle)
+		return keyUpload{IdentityKey: public, Bundle: raw, Signature: ed25519.Sign(private, raw)}
+	}
+
+	bundle := keyBundleUpload{
+		Timestamp:      now.UnixMilli(),
+		SignedPrekey:   database.SignedPrekey{ID: 1, Key: prekey, Signature: ed25519.Sign(private, prekey)},
+		OneTimePrekeys: []database.Prekey{{ID: 1, Key: []byte("one")}},
+	}
+
+	if _, err := verifyKeyUpload(sign(bundle), now); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	tampered := sign(bundle)
+	tampered.Bundle = json.RawMessage(string(tampered.Bundle) + " ")
+	if _, err := verifyKeyUpload(tampered, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected %v, got %v", ErrInvalidSignature, err)
+	}
+
+	badPrekey := bundle
+	badPrekey.SignedPrekey.Signature = ed25519.Sign(private, []byte("something else"))
+	if _, err := verifyKeyUpload(sign(badPrekey), now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected %v, got %v", ErrInvalidSignature, err)
+	}
+
+	old := bundle
+	old.Timestamp = now.Add(-time.Hour).UnixMilli()
+	if _, err := verifyKeyUpload(sign(old), now); !errors.Is(err, ErrUploadExpired) {
+		t.Errorf("Expected %v, got %v", ErrUploadExpired, err)
+	}
+}
+
+// TestValidateEnvelope checks the recipient and size rules for envelopes,
+// addressed to a chat or to an identity.
+func TestValidateEnvelope(t *testing.T) {
+	to := uuid.NewString()
+
+	if err := validateEnvelope(envelopeSend{To: to, Envelope: []byte{0, 1, 2}}, 8); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := validateEnvelope(envelopeSend{To: "nobody", Envelope: []byte{0}}, 8); !errors.Is(err, ErrInvalidChatId) {
+		t.Errorf("Expected %v, got %v", ErrInvalidChatId, err)
+	}
+
+	if err := validateEnvelope(envelopeSend{To: to, Envelope: make([]byte, 9)}, 8); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected %v, got %v", ErrMessageTooLarge, err)
+	}
+
+	identity := identityOf([]byte("identity key"))
+
+	if err := validateEnvelope(envelopeSend{ToIdentity: identity, Envelope: []byte{0}}, 8); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := validateEnvelope(envelopeSend{To: to, ToIdentity: identity, Envelope: []byte{0}}, 8); !errors.Is(err, ErrTwoRecipients) {
+		t.Errorf("Expected %v, got %v", ErrTwoRecipients, err)
+	}
+
+	if err := validateEnvelope(envelopeSend{ToIdentity: "nobody", Envelope: []byte{0}}, 8); !errors.Is(err, ErrInvalidIdentity) {
+		t.Errorf("Expected %v, got %v", ErrInvalidIdentity, err)
+	}
+}
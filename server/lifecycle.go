@@ -0,0 +1,110 @@
+package server
+
+import (
+	"darkchat/monitor"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var auditLogger = monitor.New("audit.log")
+
+// lifecycle collects what happened to one connection so a single audit
+// record can be written when it closes.
+type lifecycle struct {
+	connID   string
+	accepted time.Time
+
+	mu            sync.Mutex
+	registered    time.Time
+	authenticated time.Time
+	reason        string
+
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	framesIn  atomic.Int64
+	framesOut atomic.Int64
+}
+
+func newLifecycle(connID string) *lifecycle {
+	return &lifecycle{connID: connID, accepted: time.Now()}
+}
+
+// markRegistered records when the client's chat was registered.
+func (l *lifecycle) markRegistered() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.registered = time.Now()
+}
+
+// markAuthenticated records when the client proved its identity.
+func (l *lifecycle) markAuthenticated() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.authenticated = time.Now()
+}
+
+// disconnect records why the connection is closing. Only the first reason is
+// kept, it is the one that started the shutdown.
+func (l *lifecycle) disconnect(reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.reason == "" {
+		l.reason = reason
+	}
+}
+
+// record writes the audit record for the connection to the audit log.
+func (l *lifecycle) record(log *monitor.Monitor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reason := l.reason
+	if reason == "" {
+		reason = "closed"
+	}
+
+	fields := []monitor.Field{
+		monitor.F("accepted_at", l.accepted.Format(time.RFC3339Nano)),
+		monitor.F("reason", reason),
+		monitor.F("bytes_in", l.bytesIn.Load()),
+		monitor.F("bytes_out", l.bytesOut.Load()),
+		monitor.F("frames_in", l.framesIn.Load()),
+		monitor.F("frames_out", l.framesOut.Load()),
+		monitor.F("duration", time.Since(l.accepted)),
+		monitor.F("authenticated", !l.authenticated.IsZero()),
+	}
+
+	if !l.registered.IsZero() {
+		fields = append(fields, monitor.F("registered_at", l.registered.Format(time.RFC3339Nano)))
+	}
+
+	if !l.authenticated.IsZero() {
+		fields = append(fields, monitor.F("authenticated_at", l.authenticated.Format(time.RFC3339Nano)))
+	}
+
+	log.Info("Connection closed", fields...)
+}
+
+// countingConn counts the bytes read from and written to a connection into
+// its lifecycle.
+type countingConn struct {
+	net.Conn
+	lifecycle *lifecycle
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.lifecycle.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.lifecycle.bytesOut.Add(int64(n))
+	return n, err
+}
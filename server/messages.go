@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"encoding/json"
+	"errors"
+	"time"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+)
+
+// messageSend is the body of a message.send request, which sends a message
+// like a message frame does but answers with its id. With ReplyTo set it is
+// a reply, quoting the start of the message replied to if Quote is set.
+type messageSend struct {
+	To      string               `json:"to"`
+	Message string               `json:"message"`
+	ReplyTo *database.MessageRef `json:"reply_to,omitempty"`
+	Quote   bool                 `json:"quote,omitempty"`
+}
+
+type messageEdit struct {
+	To      string `json:"to"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+type messageDelete struct {
+	To string `json:"to"`
+	ID string `json:"id"`
+}
+
+type historyRequest struct {
+	Before    string `json:"before,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Revisions bool   `json:"revisions,omitempty"`
+}
+
+// editEvent tells a recipient that a message it got was edited or, with
+// Deleted set, retracted.
+type editEvent struct {
+	ID      string `json:"id"`
+	From    string `json:"from"`
+	Message string `json:"message,omitempty"`
+	Edited  int64  `json:"edited"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+func init() {
+	registerControl("message.send", sendMessage)
+	registerControl("message.edit", editMessage)
+	registerControl("message.delete", deleteMessage)
+	registerControl("history.get", getHistory)
+}
+
+// outbound is who a message is delivered for: the sending chat and, when it
+// was sent from an authenticated device, the identity and device whose other
+// devices get a copy.
+type outbound struct {
+	chatId   string
+	identity string
+	device   string
+	log      *monitor.Monitor
+}
+
+// clientOutbound returns the connection as the sender of its messages.
+func clientOutbound(client Client) outbound {
+	identity, device := client.state.boundDevice()
+	return outbound{chatId: client.chatId, identity: identity, device: device, log: client.log}
+}
+
+// deliverMessage posts a validated message, or a reply when reply is not
+// nil, to its recipient's chat and copies it to the sender's other devices.
+// It returns the message id, which the sender needs to edit or delete it
+// later.
+func deliverMessage(ctx context.Context, from outbound, m protocol.Message, reply *database.Reply) (string, error) {
+	if !database.CheckChatExists(m.To) {
+		return "", withCode(errcodes.ChatNotFound, errors.New("chat does not exist"))
+	}
+
+	// Without the conversation's timer the message could outlive it, so it
+	// is not stored at all.
+	ttl, err := database.ConversationTTL(from.chatId, m.To)
+
+	var id string
+
+	if err == nil && reply != nil {
+		id, err = database.PostReply(ctx, m.String(), from.chatId, m.To, ttl, *reply)
+	} else if err == nil {
+		id, err = database.PostMessage(ctx, m.String(), from.chatId, m.To, ttl)
+	}
+
+	if err != nil {
+		from.log.Error(err.Error())
+		return "", withCode(errcodes.DeliveryFailed, errors.New("message could not be delivered"))
+	}
+
+	syncOutbound(ctx, from, syncEvent{To: m.To, Message: m.Message, ID: id}, ttl)
+
+	return id, nil
+}
+
+// sendMessage sends a message from the connection's chat.
+func sendMessage(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request messageSend
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	m := protocol.Message{Message: request.Message, From: client.chatId, To: request.To}
+
+	if err := validateMessage(m, client.maxMessageSize); err != nil {
+		return nil, messageError(err)
+	}
+
+	var reply *database.Reply
+
+	if request.ReplyTo != nil {
+		var err error
+
+		if reply, err = replyTo(client, request.To, *request.ReplyTo, request.Quote); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := deliverMessage(ctx, clientOutbound(client), m, reply)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"id": id}, nil
+}
+
+// editMessage replaces the text of a message the connection sent, within
+// the edit window, and tells the recipient.
+func editMessage(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request messageEdit
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateMessage(protocol.Message{Message: request.Message, To: request.To}, client.maxMessageSize); err != nil {
+		return nil, messageError(err)
+	}
+
+	edited, err := database.EditMessage(request.To, request.ID, client.chatId, request.Message, client.editWindow, time.Now())
+	if err != nil {
+		return nil, editError(err)
+	}
+
+	notifyEdit(ctx, client, request.To, editEvent{ID: request.ID, From: client.chatId, Message: request.Message, Edited: edited})
+
+	return map[string]interface{}{"id": request.ID, "edited": edited}, nil
+}
+
+// deleteMessage retracts a message the connection sent, within the edit
+// window, and tells the recipient.
+func deleteMessage(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request messageDelete
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateChatId(request.To); err != nil {
+		return nil, withCode(errcodes.InvalidRecipient, err)
+	}
+
+	now := time.Now()
+
+	if err := database.DeleteMessage(request.To, request.ID, client.chatId, client.editWindow, now); err != nil {
+		return nil, editError(err)
+	}
+
+	notifyEdit(ctx, client, request.To, editEvent{ID: request.ID, From: client.chatId, Edited: now.UnixMilli(), Deleted: true})
+
+	return map[string]string{"id": request.ID}, nil
+}
+
+// getHistory returns the messages delivered to the connection's chat, newest
+// first, in their latest version.
+func getHistory(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request historyRequest
+
+	if len(body) > 0 {
+		if err := decodeBody(body, &request); err != nil {
+			return nil, err
+		}
+	}
+
+	history, err := database.History(client.chatId, request.Before, request.Limit, request.Revisions)
+	if errors.Is(err, database.ErrPrivacyMode) {
+		return nil, withCode(errcodes.PrivacyRestricted, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("history could not be loaded"))
+	}
+	return map[string]interface{}{"messages": history}, nil
+}
+
+// notifyEdit posts an edit or deletion to the recipient of the message, with
+// the conversation's time to live.
+func notifyEdit(ctx context.Context, client Client, to string, event editEvent) {
+	op := "message.edit"
+	if event.Deleted {
+		op = "message.delete"
+	}
+
+	ttl, err := database.ConversationTTL(client.chatId, to)
+	if err == nil {
+		_, err = database.PostEvent(ctx, op, event, to, ttl)
+	}
+
+	if err != nil {
+		client.log.Error(err.Error())
+	}
+}
+
+// messageError tags a validateMessage failure with its code.
+func messageError(err error) error {
+	if errors.Is(err, ErrInvalidChatId) {
+		return withCode(errcodes.InvalidRecipient, err)
+	}
+	return withCode(errcodes.InvalidMessage, err)
+}
+
+// editError maps the failures of an edit or deletion to their codes.
+func editError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrMessageNotFound), errors.Is(err, database.ErrMessageDeleted):
+		return withCode(errcodes.MessageNotFound, err)
+	case errors.Is(err, database.ErrNotSender), errors.Is(err, database.ErrEditWindow):
+		return withCode(errcodes.EditNotAllowed, err)
+	case errors.Is(err, database.ErrPrivacyMode):
+		return withCode(errcodes.PrivacyRestricted, err)
+	default:
+		return withCode(errcodes.DeliveryFailed, errors.New("message could not be changed"))
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// maxPresenceWatch is the most identities one presence.subscribe or
+// presence.privacy request may name.
+const maxPresenceWatch = 100
+
+var ErrTooManyIdentities = errors.New("too many identities")
+
+type presenceSet struct {
+	State string `json:"state"`
+}
+
+type presenceGet struct {
+	Identity string `json:"identity"`
+}
+
+type presenceWatch struct {
+	Identities []string `json:"identities"`
+}
+
+type presencePrivacy struct {
+	Visibility string   `json:"visibility"`
+	Allowed    []string `json:"allowed,omitempty"`
+}
+
+func init() {
+	registerControl("presence.set", setPresence)
+	registerControl("presence.get", getPresence)
+	registerControl("presence.subscribe", subscribePresence)
+	registerControl("presence.unsubscribe", unsubscribePresence)
+	registerControl("presence.privacy", setPresencePrivacy)
+}
+
+// validateIdentities checks a list of identities named in a presence request.
+func validateIdentities(identities []string) error {
+	if len(identities) > maxPresenceWatch {
+		return withCode(errcodes.InvalidRequest, fmt.Errorf("%w: %d, limit is %d", ErrTooManyIdentities, len(identities), maxPresenceWatch))
+	}
+
+	for _, identity := range identities {
+		if err := validateIdentity(identity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPresence sets the presence state of the connection's identity and
+// tells whoever watches it. From then on the connection keeps the identity
+// online until it closes.
+func setPresence(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request presenceSet
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	identity := client.state.boundIdentity()
+	if identity == "" {
+		return nil, withCode(errcodes.InvalidRequest, ErrNoIdentity)
+	}
+
+	if !database.ValidPresence(request.State) {
+		return nil, withCode(errcodes.InvalidRequest, database.ErrInvalidPresence)
+	}
+
+	if err := database.SetPresence(identity, client.connID, request.State); err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("presence could not be set"))
+	}
+
+	client.state.setPresent(identity)
+
+	saveSession(client)
+
+	notifyPresence(ctx, client, identity)
+
+	presence, err := database.GetPresence(identity, identity)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("presence could not be loaded"))
+	}
+	return presence, nil
+}
+
+// getPresence returns an identity's presence as the connection's identity
+// may see it.
+func getPresence(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request presenceGet
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateIdentity(request.Identity); err != nil {
+		return nil, err
+	}
+
+	presence, err := database.GetPresence(request.Identity, client.state.boundIdentity())
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("presence could not be loaded"))
+	}
+	return presence, nil
+}
+
+// subscribePresence has presence changes of the given identities pushed to
+// the connection's chat as "presence" events, and returns their presence now.
+func subscribePresence(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request presenceWatch
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateIdentities(request.Identities); err != nil {
+		return nil, err
+	}
+
+	viewer := client.state.boundIdentity()
+	presences := make([]database.Presence, 0, len(request.Identities))
+
+	for _, identity := range request.Identities {
+		if err := database.WatchPresence(identity, client.chatId, viewer); err != nil {
+			return nil, withCode(errcodes.DeliveryFailed, errors.New("presence could not be subscribed to"))
+		}
+
+		presence, err := database.GetPresence(identity, viewer)
+		if err != nil {
+			return nil, withCode(errcodes.DeliveryFailed, errors.New("presence could not be loaded"))
+		}
+		presences = append(presences, presence)
+	}
+
+	return map[string]interface{}{"presence": presences}, nil
+}
+
+// unsubscribePresence stops presence changes of the given identities being
+// pushed to the connection.
+func unsubscribePresence(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request presenceWatch
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateIdentities(request.Identities); err != nil {
+		return nil, err
+	}
+
+	for _, identity := range request.Identities {
+		if err := database.UnwatchPresence(identity, client.chatId); err != nil {
+			return nil, withCode(errcodes.DeliveryFailed, errors.New("presence could not be unsubscribed from"))
+		}
+	}
+	return map[string]interface{}{"identities": request.Identities}, nil
+}
+
+// setPresencePrivacy sets who may see the presence of the connection's
+// identity, and pushes the change to watchers, for whom it may now be hidden.
+func setPresencePrivacy(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request presencePrivacy
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	identity := client.state.boundIdentity()
+	if identity == "" {
+		return nil, withCode(errcodes.InvalidRequest, ErrNoIdentity)
+	}
+
+	if err := validateIdentities(request.Allowed); err != nil {
+		return nil, err
+	}
+
+	err := database.SetPresenceVisibility(identity, request.Visibility, request.Allowed)
+
+	if errors.Is(err, database.ErrInvalidPresence) {
+		return nil, withCode(errcodes.InvalidRequest, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("presence privacy could not be set"))
+	}
+
+	notifyPresence(ctx, client, identity)
+
+	return request, nil
+}
+
+// touchPresence keeps the identity the connection announced online. It is
+// called on every heartbeat.
+func touchPresence(client Client) {
+	identity := client.state.presentIdentity()
+	if identity == "" {
+		return
+	}
+
+	if err := database.TouchPresence(identity, client.connID); err != nil {
+		client.log.Error("Refreshing presence failed", monitor.F(monitor.KeyError, err))
+	}
+}
+
+// leavePresence takes the connection offline when it closes, telling
+// watchers if it was the identity's last one.
+func leavePresence(ctx context.Context, client Client) {
+	identity := client.state.presentIdentity()
+	if identity == "" {
+		return
+	}
+
+	offline, err := database.LeavePresence(identity, client.connID)
+	if err != nil {
+		client.log.Error("Leaving presence failed", monitor.F(monitor.KeyError, err))
+		return
+	}
+
+	if offline {
+		notifyPresence(ctx, client, identity)
+	}
+}
+
+// notifyPresence pushes an identity's presence to its watchers, logging
+// failures: the change itself was stored.
+func notifyPresence(ctx context.Context, client Client, identity string) {
+	if err := database.NotifyPresence(ctx, identity); err != nil {
+		client.log.Error("Notifying presence failed", monitor.F(monitor.KeyError, err))
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"encoding/json"
+	"errors"
+)
+
+// readMark is the body of a read.mark request: the conversation with Chat
+// has been read up to and including the message ID.
+type readMark struct {
+	Chat string `json:"chat"`
+	ID   string `json:"id"`
+}
+
+type conversationList struct {
+	Before int64 `json:"before,omitempty"`
+	Limit  int   `json:"limit,omitempty"`
+}
+
+// readEvent tells the identity's other devices how far a conversation has
+// been read.
+type readEvent struct {
+	Device string `json:"device"`
+	Chat   string `json:"chat"`
+	Read   string `json:"read"`
+	Unread int    `json:"unread"`
+}
+
+func init() {
+	registerControl("read.mark", markRead)
+	registerControl("conversation.list", listConversations)
+}
+
+// markRead moves the connection's read marker in a conversation forward.
+// Unlike acknowledgements, which only say a message reached the socket, the
+// marker says the user saw it.
+func markRead(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request readMark
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateChatId(request.Chat); err != nil {
+		return nil, withCode(errcodes.InvalidRecipient, err)
+	}
+
+	if !streamIDPattern.MatchString(request.ID) {
+		return nil, withCode(errcodes.InvalidRequest, ErrInvalidMessageRef)
+	}
+
+	read, unread, err := database.MarkRead(client.chatId, request.Chat, request.ID)
+	if errors.Is(err, database.ErrPrivacyMode) {
+		return nil, withCode(errcodes.PrivacyRestricted, err)
+	}
+
+	if err != nil {
+		client.log.Error("Marking read failed", monitor.F(monitor.KeyError, err))
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("read marker could not be stored"))
+	}
+
+	syncRead(ctx, client, readEvent{Chat: request.Chat, Read: read, Unread: unread})
+
+	return map[string]interface{}{"chat": request.Chat, "read": read, "unread": unread}, nil
+}
+
+// listConversations returns the connection's conversations, the most
+// recently active first, with their latest message and unread count.
+func listConversations(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request conversationList
+
+	if len(body) > 0 {
+		if err := decodeBody(body, &request); err != nil {
+			return nil, err
+		}
+	}
+
+	conversations, err := database.Conversations(client.chatId, request.Before, request.Limit)
+	if errors.Is(err, database.ErrPrivacyMode) {
+		return nil, withCode(errcodes.PrivacyRestricted, err)
+	}
+
+	if err != nil {
+		client.log.Error("Listing conversations failed", monitor.F(monitor.KeyError, err))
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("conversations could not be loaded"))
+	}
+	return map[string]interface{}{"conversations": conversations}, nil
+}
+
+// syncRead tells the other devices of the connection's identity about a
+// moved read marker, so they can clear their unread badges. Nothing is sent
+// for connections that did not authenticate as a device.
+func syncRead(ctx context.Context, client Client, event readEvent) {
+	identity, device := client.state.boundDevice()
+	if device == "" {
+		return
+	}
+
+	event.Device = device
+
+	if _, err := database.PostEventToIdentity(ctx, "read", event, identity, 0); err != nil {
+		client.log.Error("Syncing read marker failed", monitor.F(monitor.KeyError, err))
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"encoding/json"
+	"errors"
+	"time"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+)
+
+// scheduleSend is the body of a message.schedule request. At is when the
+// message is to be delivered, in unix milliseconds.
+type scheduleSend struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+	At      int64  `json:"at"`
+}
+
+type scheduleCancel struct {
+	ID string `json:"id"`
+}
+
+// scheduledEvent tells the sender of a scheduled message that it was
+// delivered, with the id it was given, or that it could not be.
+type scheduledEvent struct {
+	ID        string `json:"id"`
+	To        string `json:"to"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func init() {
+	registerControl("message.schedule", scheduleMessage)
+	registerControl("scheduled.list", listScheduled)
+	registerControl("scheduled.cancel", cancelScheduled)
+}
+
+// scheduleMessage stores a message from the connection's chat to be
+// delivered later.
+func scheduleMessage(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request scheduleSend
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	m := protocol.Message{Message: request.Message, From: client.chatId, To: request.To}
+
+	if err := validateMessage(m, client.maxMessageSize); err != nil {
+		return nil, messageError(err)
+	}
+
+	if !database.CheckChatExists(m.To) {
+		return nil, withCode(errcodes.ChatNotFound, errors.New("chat does not exist"))
+	}
+
+	identity, device := client.state.boundDevice()
+	draft := database.ScheduledMessage{From: client.chatId, To: m.To, Message: m.Message, Identity: identity, Device: device}
+
+	scheduled, err := database.ScheduleMessage(draft, time.UnixMilli(request.At), time.Now())
+
+	switch {
+	case errors.Is(err, database.ErrInvalidSchedule), errors.Is(err, database.ErrTooManyScheduled):
+		return nil, withCode(errcodes.InvalidRequest, err)
+	case errors.Is(err, database.ErrPrivacyMode):
+		return nil, withCode(errcodes.PrivacyRestricted, err)
+	case err != nil:
+		client.log.Error("Scheduling message failed", monitor.F(monitor.KeyError, err))
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("message could not be scheduled"))
+	}
+	return scheduled, nil
+}
+
+// listScheduled returns the connection's scheduled messages that were not
+// delivered yet.
+func listScheduled(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	scheduled, err := database.ScheduledMessages(client.chatId)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("scheduled messages could not be loaded"))
+	}
+	return map[string]interface{}{"messages": scheduled}, nil
+}
+
+// cancelScheduled cancels one of the connection's scheduled messages.
+func cancelScheduled(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request scheduleCancel
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	err := database.CancelScheduled(client.chatId, request.ID)
+
+	switch {
+	case errors.Is(err, database.ErrScheduledNotFound):
+		return nil, withCode(errcodes.MessageNotFound, err)
+	case err != nil:
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("scheduled message could not be canceled"))
+	}
+	return map[string]string{"id": request.ID}, nil
+}
+
+// deliverScheduled posts a scheduled message that is due the way a message
+// frame is posted, copies included, and tells the sender how it went. A
+// recipient that no longer exists is reported to the sender rather than
+// retried.
+func deliverScheduled(ctx context.Context, scheduled database.ScheduledMessage) error {
+	m := protocol.Message{Message: scheduled.Message, From: scheduled.From, To: scheduled.To}
+	event := scheduledEvent{ID: scheduled.ID, To: scheduled.To}
+	from := outbound{chatId: scheduled.From, identity: scheduled.Identity, device: scheduled.Device, log: monitorLogger}
+
+	id, err := deliverMessage(ctx, from, m, nil)
+
+	var coded codedError
+	if errors.As(err, &coded) && coded.code == errcodes.ChatNotFound {
+		event.Error = errcodes.Format(errcodes.ChatNotFound, "", err.Error())
+		notifyScheduled(ctx, scheduled.From, "scheduled.failed", event)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	event.MessageID = id
+	notifyScheduled(ctx, scheduled.From, "scheduled.sent", event)
+	return nil
+}
+
+// failScheduled tells the sender of a scheduled message that it was given
+// up on after failing to be delivered too many times.
+func failScheduled(ctx context.Context, scheduled database.ScheduledMessage) {
+	event := scheduledEvent{ID: scheduled.ID, To: scheduled.To}
+	event.Error = errcodes.Format(errcodes.DeliveryFailed, "", "message could not be delivered")
+
+	notifyScheduled(ctx, scheduled.From, "scheduled.failed", event)
+}
+
+// notifyScheduled posts the outcome of a scheduled message to its sender, if
+// the sender's chat is still there.
+func notifyScheduled(ctx context.Context, chatId string, op string, event scheduledEvent) {
+	if !database.CheckChatExists(chatId) {
+		return
+	}
+
+	if _, err := database.PostEvent(ctx, op, event, chatId, 0); err != nil {
+		monitorLogger.Error("Notifying scheduled message failed", monitor.F(monitor.KeyError, err))
+	}
+}
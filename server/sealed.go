@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const DEFAULTDELIVERYTOKENTTL = time.Hour
+
+// tokenRequest is the body of a sealed.token request. TTL is in seconds and
+// may only shorten the server's maximum.
+type tokenRequest struct {
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+type sealedSend struct {
+	Token    string `json:"token"`
+	Envelope []byte `json:"envelope"`
+}
+
+type tokenRevoke struct {
+	Token string `json:"token"`
+}
+
+// sealedEvent is how a sealed envelope reaches its recipient. Unlike
+// envelopeEvent it has no sender: whoever it is is only named inside the
+// encrypted envelope.
+type sealedEvent struct {
+	Envelope []byte `json:"envelope"`
+}
+
+func init() {
+	registerControl("sealed.token", issueDeliveryToken)
+	registerControl("sealed.send", sendSealed)
+	registerControl("sealed.revoke", revokeDeliveryToken)
+}
+
+// tokenTTL returns the lifetime of a new delivery token: the requested one,
+// capped at the maximum.
+func tokenTTL(requested time.Duration, maximum time.Duration) time.Duration {
+	if maximum <= 0 {
+		maximum = DEFAULTDELIVERYTOKENTTL
+	}
+
+	if requested <= 0 || requested > maximum {
+		return maximum
+	}
+	return requested
+}
+
+// issueDeliveryToken gives the client a token it can hand to its contacts,
+// inside encrypted messages, so they can deliver to it anonymously.
+func issueDeliveryToken(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request tokenRequest
+
+	if len(body) > 0 {
+		if err := decodeBody(body, &request); err != nil {
+			return nil, err
+		}
+	}
+
+	ttl := tokenTTL(time.Duration(request.TTL)*time.Second, client.deliveryTokenTTL)
+
+	token, err := database.IssueDeliveryToken(client.chatId, ttl)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("token could not be issued"))
+	}
+
+	return map[string]interface{}{"token": token, "expires": time.Now().Add(ttl).Unix()}, nil
+}
+
+// sendSealed delivers an envelope to whichever chat the token was issued to.
+// Nothing about the sender is stored with it or logged alongside the
+// recipient, so the server cannot tell who wrote to whom.
+func sendSealed(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request sealedSend
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateEnvelopeSize(request.Envelope, client.maxMessageSize); err != nil {
+		return nil, err
+	}
+
+	recipient, err := database.RedeemDeliveryToken(request.Token)
+
+	if errors.Is(err, database.ErrUnknownToken) {
+		return nil, withCode(errcodes.InvalidToken, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("envelope could not be delivered"))
+	}
+
+	// Charge the recipient as well as the sender, so a leaked token cannot
+	// be used to flood the chat from many connections.
+	if err := client.limiter.Allow(len(request.Envelope), "token:"+request.Token); err != nil {
+		return nil, withCode(errcodes.Throttled, err)
+	}
+
+	if !database.CheckChatExists(recipient) {
+		return nil, withCode(errcodes.ChatNotFound, errors.New("chat does not exist"))
+	}
+
+	// The sender is unknown, so only the recipient's own timer applies.
+	ttl, err := database.ConversationTTL("", recipient)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("envelope could not be delivered"))
+	}
+
+	// Failures are logged with the connection id found in the context, which
+	// next to the recipient's chat id would say who wrote to whom.
+	id, err := database.PostEvent(context.Background(), "sealed", sealedEvent{Envelope: request.Envelope}, recipient, ttl)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("envelope could not be delivered"))
+	}
+	return map[string]string{"id": id}, nil
+}
+
+// revokeDeliveryToken deletes one of the client's delivery tokens before it
+// expires.
+func revokeDeliveryToken(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request tokenRevoke
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	err := database.RevokeDeliveryToken(request.Token, client.chatId)
+
+	if errors.Is(err, database.ErrUnknownToken) {
+		return nil, withCode(errcodes.InvalidToken, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("token could not be revoked"))
+	}
+	return nil, nil
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTokenTTL checks that requested token lifetimes are capped at the
+// maximum and that leaving it out gets the maximum.
+func TestTokenTTL(t *testing.T) {
+	if got := tokenTTL(time.Minute, time.Hour); got != time.Minute {
+		t.Errorf("Expected %v, got %v", time.Minute, got)
+	}
+
+	if got := tokenTTL(2*time.Hour, time.Hour); got != time.Hour {
+		t.Errorf("Expected %v, got %v", time.Hour, got)
+	}
+
+	if got := tokenTTL(0, 0); got != DEFAULTDELIVERYTOKENTTL {
+		t.Errorf("Expected %v, got %v", DEFAULTDELIVERYTOKENTTL, got)
+	}
+}
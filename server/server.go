@@ -2,13 +2,21 @@ package server
 
 import (
 	"context"
+	"darkchat/access"
 	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/health"
+	"darkchat/metrics"
 	"darkchat/monitor"
 	"darkchat/pinger"
+	"darkchat/ratelimit"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -29,11 +37,76 @@ type ConnectionBuilder struct {
 	ConnectionType string
 	Address        string
 	Port           string
+	RateLimit      ratelimit.Config
+
+	// SignalRateLimit limits ephemeral signals, such as typing indicators,
+	// separately from messages. The zero value leaves them unlimited.
+	SignalRateLimit ratelimit.Config
+
+	// MaxConnections and MaxConnectionsPerIP cap the number of concurrent
+	// connections. Zero means unlimited.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// HandshakeTimeout is how long a new connection may stay silent before it
+	// is dropped. Zero uses DEFAULTHANDSHAKETIMEOUT.
+	HandshakeTimeout time.Duration
+
+	// MaxFrameSize bounds the payload of a single frame and MaxMessageSize
+	// the text of a single message, both in bytes. Zero uses the defaults.
+	MaxFrameSize   int
+	MaxMessageSize int
+
+	// Allow and Deny are IP addresses or CIDRs added to the shared access
+	// lists at startup.
+	Allow []string
+	Deny  []string
+
+	// Traffic pads frames, jitters heartbeats and sends cover frames. The
+	// zero value leaves traffic as it is.
+	Traffic TrafficShaping
+
+	// DeliveryTokenTTL is the longest a sealed sender delivery token lives.
+	// Zero uses DEFAULTDELIVERYTOKENTTL.
+	DeliveryTokenTTL time.Duration
+
+	// SessionGrace is how long the chat of a dropped connection with a
+	// session is kept for it to be resumed. Zero uses
+	// database.DEFAULTSESSIONGRACE.
+	SessionGrace time.Duration
+
+	// EditWindow is how long after sending a message its sender may edit or
+	// delete it. Zero uses database.DEFAULTEDITWINDOW.
+	EditWindow time.Duration
 }
 
 type Client struct {
-	chatId     string
-	connection net.Conn
+	chatId           string
+	connID           string
+	connection       net.Conn
+	lifecycle        *lifecycle
+	limiter          *ratelimit.Limiter
+	signalLimiter    *ratelimit.Limiter
+	admission        *admission
+	handshakeTimeout time.Duration
+	maxFrameSize     int
+	maxMessageSize   int
+	errorReports     map[errcodes.Code]int
+	traffic          TrafficShaping
+	deliveryTokenTTL time.Duration
+	sessionGrace     time.Duration
+	editWindow       time.Duration
+	state            *connState
+	log              *monitor.Monitor
+
+	// writes is held while a frame is written to the connection, which the
+	// reader, the stream, heartbeats, signals and cover traffic all do from
+	// their own goroutines.
+	writes *sync.Mutex
+
+	// signalQueue holds the signals waiting to be written to the
+	// connection.
+	signalQueue chan *database.Event
 }
 
 // Addressbuilder constructs and returns a string representing the full network address
@@ -47,8 +120,8 @@ func (c ConnectionBuilder) Addressbuilder() string {
 // ConnectionBuilder, and accepts incoming connections. Each connection is
 // handled in a separate goroutine by calling handleClientConnection. If an
 // error occurs while accepting a connection, the error is logged and the
-// function continues. The function does not return until an error occurs while
-// listening.
+// function continues after a short backoff. The function returns once the
+// context is canceled, after closing the listener.
 func ServerStart(ctx context.Context, builder ConnectionBuilder) {
 
 	server, err := net.Listen(builder.ConnectionType, builder.Addressbuilder())
@@ -58,10 +131,69 @@ func ServerStart(ctx context.Context, builder ConnectionBuilder) {
 		os.Exit(1)
 	}
 
-	monitorLogger.Info(fmt.Sprintf("Listening on %s", builder.Addressbuilder()))
+	monitorLogger.Info("Listening", monitor.F("address", builder.Addressbuilder()))
 
 	defer server.Close()
 
+	database.CheckConnection(ctx)
+
+	if builder.Traffic.PadBuckets, err = sortPadBuckets(builder.Traffic.PadBuckets); err != nil {
+		monitorLogger.Fatal("Invalid traffic shaping", monitor.F(monitor.KeyError, err))
+	}
+
+	if err := seedAccessLists(builder.Allow, builder.Deny); err != nil {
+		monitorLogger.Fatal("Seeding access lists failed", monitor.F(monitor.KeyError, err))
+	}
+
+	accessList := new(access.List)
+
+	// Without the shared lists the node would let in addresses that are
+	// denied or banned, so it does not start at all.
+	if err := loadAccessList(accessList); err != nil {
+		monitorLogger.Fatal("Loading access lists failed", monitor.F(monitor.KeyError, err))
+	}
+
+	go refreshAccessList(ctx, accessList, DEFAULTACCESSREFRESH)
+
+	go database.ReapExpired(ctx, database.DEFAULTREAPINTERVAL)
+
+	go database.SweepSessions(ctx, database.DEFAULTSESSIONSWEEP, builder.SessionGrace)
+
+	go database.DeliverScheduled(ctx, database.DEFAULTSCHEDULEINTERVAL, deliverScheduled, failScheduled)
+
+	go database.SubscribeSignals(ctx, signals.deliver)
+
+	go database.SubscribeTakeovers(ctx, attachedSessions.release)
+
+	go func() {
+		<-ctx.Done()
+		health.SetListening(false)
+		server.Close()
+	}()
+
+	health.SetListening(true)
+
+	limiter := ratelimit.New(builder.RateLimit)
+	signalLimiter := ratelimit.New(builder.SignalRateLimit)
+	slots := newAdmission(builder.MaxConnections, builder.MaxConnectionsPerIP)
+
+	handshakeTimeout := builder.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = DEFAULTHANDSHAKETIMEOUT
+	}
+
+	sessionGrace := builder.SessionGrace
+	if sessionGrace <= 0 {
+		sessionGrace = database.DEFAULTSESSIONGRACE
+	}
+
+	editWindow := builder.EditWindow
+	if editWindow <= 0 {
+		editWindow = database.DEFAULTEDITWINDOW
+	}
+
+	var backoff time.Duration
+
 	select {
 	case <-ctx.Done():
 		return
@@ -69,16 +201,64 @@ func ServerStart(ctx context.Context, builder ConnectionBuilder) {
 		for {
 			conn, err := server.Accept()
 			if err != nil {
-				monitorLogger.Error(err.Error())
+				if ctx.Err() != nil {
+					monitorLogger.Info("Listener closed, shutting down")
+					return
+				}
+
+				backoff = acceptBackoff(backoff)
+				monitorLogger.Error("Accept failed", monitor.F(monitor.KeyError, err), monitor.F("retry_in", backoff))
+				time.Sleep(backoff)
 				continue
 			}
+			backoff = 0
+
+			metrics.Accepts.Inc()
+
+			connID := uuid.NewString()
+			connLifecycle := newLifecycle(connID)
 
 			client := Client{
-				connection: conn,
-				chatId:     uuid.NewString(),
+				connection:       countingConn{Conn: conn, lifecycle: connLifecycle},
+				connID:           connID,
+				lifecycle:        connLifecycle,
+				chatId:           uuid.NewString(),
+				limiter:          limiter,
+				signalLimiter:    signalLimiter,
+				admission:        slots,
+				handshakeTimeout: handshakeTimeout,
+				maxFrameSize:     builder.MaxFrameSize,
+				maxMessageSize:   builder.MaxMessageSize,
+				errorReports:     make(map[errcodes.Code]int),
+				traffic:          builder.Traffic,
+				deliveryTokenTTL: builder.DeliveryTokenTTL,
+				sessionGrace:     sessionGrace,
+				editWindow:       editWindow,
+				state:            &connState{},
+				writes:           new(sync.Mutex),
+				signalQueue:      make(chan *database.Event, signalQueueSize),
 			}
+			client.log = monitorLogger.With(client.fields()...)
 
-			monitorLogger.Info(fmt.Sprintf("Accepted connection from %s", conn.RemoteAddr().String()))
+			if err := accessList.Check(client.ip()); err != nil {
+				client.log.Warning("Refused connection", monitor.F(monitor.KeyError, err))
+				refuseClient(client, errcodes.AccessDenied, err)
+				continue
+			}
+
+			if limiter.Banned(client.ipKey()) {
+				client.log.Warning("Refused banned connection")
+				refuseClient(client, errcodes.Banned, ratelimit.ErrBanned)
+				continue
+			}
+
+			if err := slots.acquire(client.ip()); err != nil {
+				client.log.Warning("Refused connection", monitor.F(monitor.KeyError, err))
+				refuseClient(client, errcodes.ServerFull, err)
+				continue
+			}
+
+			client.log.Info("Accepted connection")
 
 			go handleClientConnection(client)
 
@@ -92,124 +272,449 @@ func ServerStart(ctx context.Context, builder ConnectionBuilder) {
 // chat stream are sent to the client. The function handles connection cleanup and error logging.
 
 func handleClientConnection(client Client) {
-	ctx, cancel := context.WithCancel(context.Background())
-	var streamingChanel = make(chan protocol.Payload, 20)
-	var clientStreamSubChannel = make(chan string, 1)
-	clientStreamSubChannel <- client.chatId
+	ctx, cancel := context.WithCancel(monitor.WithConnID(context.Background(), client.connID))
+
+	metrics.ActiveConnections.Inc()
 
 	defer func() {
+		metrics.ActiveConnections.Dec()
 		cancel()
 		client.connection.Close()
-		close(clientStreamSubChannel)
+		client.admission.release(client.ip())
 
-		err := database.DeleteClientChat(client.chatId)
+		if len(client.errorReports) > 0 {
+			client.log.Info("Client reported errors", monitor.F("reports", summarizeErrorReports(client.errorReports)))
+		}
 
-		if err != nil {
-			monitorLogger.Error(err.Error())
+		// The connection's context is canceled by now, going offline is
+		// still worth telling watchers about.
+		leavePresence(monitor.WithConnID(context.Background(), client.connID), client)
+
+		if identity, _ := client.state.boundDevice(); identity != "" {
+			signals.remove(database.IdentityChat(identity), client.connID)
 		}
 
+		if stream := client.state.releaseDevice(); stream != nil {
+			stream.stop()
+		}
+
+		signals.remove(client.chatId, client.connID)
+
+		releaseChat(client)
+
+		client.lifecycle.record(auditLogger.With(client.fields()...))
 	}()
 
 	dbErr := database.RegisterClientChat(client.chatId)
 
 	if dbErr != nil {
-		monitorLogger.Error(dbErr.Error())
+		client.log.Error(dbErr.Error())
+		client.lifecycle.disconnect("registration failed")
 		return
 	}
+	client.lifecycle.markRegistered()
+
+	signals.add(client.chatId, client)
+
+	go writeSignals(ctx, client)
+
 	resetTimer := make(chan time.Duration, 1)
 	resetTimer <- time.Second
 
-	go pinger.Ping(ctx, client.connection, resetTimer)
+	heartbeats := pinger.NewTracker(lockedWriter{w: client.connection, mu: client.writes}, func() {
+		client.lifecycle.framesOut.Add(1)
+	})
 
-	if err := extendDeadline(client.connection, DEFAULTPINGINTERVAL, RWEXTENTION); err != nil {
+	go pinger.PingWithJitter(ctx, heartbeats, resetTimer, client.traffic.HeartbeatJitter)
+
+	// Until the client sends its first frame it only gets the handshake
+	// timeout, so connections that never speak do not hold a slot for a full
+	// ping interval.
+	if err := extendDeadline(client.connection, DEFAULTPINGINTERVAL, WEXTENTION); err != nil {
+		client.lifecycle.disconnect("deadline error")
+		return
+	}
+
+	if err := extendDeadline(client.connection, client.handshakeTimeout, REXTENTION); err != nil {
+		client.lifecycle.disconnect("deadline error")
 		return
 	}
 
-	go database.StreamChat(ctx, streamingChanel, clientStreamSubChannel, client.chatId)
+	stream := startStreaming(ctx, client)
 
-	go func() {
-		for message := range streamingChanel {
-			err := writeToClient(client, message, protocol.MessageType)
-			if err != nil {
-				monitorLogger.Error(err.Error())
+	go sendCoverTraffic(ctx, client, client.traffic.CoverRate)
+
+	handshaken := false
+	reader := newFrameReader(client.connection, client.maxFrameSize)
+
+	for {
+
+		skipped, err := reader.next()
+
+		if err != nil && !errors.Is(err, ErrFrameTooLarge) {
+			client.log.Error(err.Error())
+			client.lifecycle.disconnect(disconnectReason(err, handshaken))
+			return
+		}
+
+		if err != nil {
+			client.log.Warning("Oversized frame", monitor.F(monitor.KeyError, err))
+			if clientErr := writeError(client, errcodes.FrameTooLarge, err); clientErr != nil || !skipped {
+				client.lifecycle.disconnect("frame too large")
+				return
 			}
+			continue
 		}
-	}()
 
-	for {
+		control, isControl, err := reader.control()
+
+		var message protocol.Payload
 
-		message, err := protocol.Decode(client.connection)
+		if err == nil && !isControl {
+			message, err = protocol.Decode(reader)
+		}
 
 		if err != nil {
-			monitorLogger.Error(err.Error())
+			client.log.Error(err.Error())
+
+			// The stream cannot be trusted after a decode error, so tell the
+			// client why before hanging up.
+			if !isConnectionError(err) {
+				writeError(client, errcodes.MalformedFrame, err)
+			}
+			client.lifecycle.disconnect(disconnectReason(err, handshaken))
 			return
 		}
 		resetTimer <- 0
 
+		client.lifecycle.framesIn.Add(1)
+
+		if isControl {
+			metrics.FramesIn.WithLabelValues(frameTypeName(ControlFrame)).Inc()
+		} else {
+			metrics.FramesIn.WithLabelValues(payloadTypeName(message)).Inc()
+		}
+
+		if !handshaken {
+			handshaken = true
+			if err := extendDeadline(client.connection, DEFAULTPINGINTERVAL, REXTENTION); err != nil {
+				client.lifecycle.disconnect("deadline error")
+				return
+			}
+		}
+
 		if err := extendDeadline(client.connection, DEFAULTPINGINTERVAL, WEXTENTION); err != nil {
+			client.lifecycle.disconnect("deadline error")
 			return
 		}
 
+		if isControl && isResume(control) {
+			if err := answerResume(ctx, &client, &stream, control); err != nil {
+				if err == ratelimit.ErrBanned {
+					client.lifecycle.disconnect("banned for exceeding rate limits")
+				} else {
+					client.lifecycle.disconnect("write error")
+				}
+				return
+			}
+			continue
+		}
+
+		if isControl {
+			if err := handleControl(ctx, client, control); err != nil {
+				if err == ratelimit.ErrBanned {
+					client.lifecycle.disconnect("banned for exceeding rate limits")
+				} else {
+					client.lifecycle.disconnect("write error")
+				}
+				return
+			}
+			continue
+		}
+
 		switch message.(type) {
 		case *protocol.Beat:
+			heartbeats.Ack()
 			extendDeadline(client.connection, DEFAULTPINGINTERVAL, RWEXTENTION)
+			touchPresence(client)
+			renewSession(client)
 
 		case *protocol.Message:
+			if dropped, closed := throttle(client, len(message.Byte())); closed {
+				return
+			} else if dropped {
+				continue
+			}
+
 			var m protocol.Message
 
 			err = json.Unmarshal(message.Byte(), &m)
 
 			if err != nil {
-				monitorLogger.Error(err.Error())
-				return
+				client.log.Error(err.Error())
+				if clientErr := writeError(client, errcodes.MalformedFrame, err); clientErr != nil {
+					client.lifecycle.disconnect("write error")
+					return
+				}
+				continue
 			}
 
-			if !database.CheckChatExists(m.To) {
-				err := protocol.Error_("chat does not exist")
-				if clientErr := writeToClient(client, &err, protocol.Error); clientErr != nil {
-					monitorLogger.Error(clientErr.Error())
+			// The sender is the connection, whatever the frame claims, so
+			// error reports are only ever relayed back to it.
+			m.From = client.chatId
+
+			if err := validateMessage(m, client.maxMessageSize); err != nil {
+				code := errcodes.InvalidMessage
+				if errors.Is(err, ErrInvalidChatId) {
+					code = errcodes.InvalidRecipient
+				}
+
+				if clientErr := writeError(client, code, err); clientErr != nil {
+					client.lifecycle.disconnect("write error")
 					return
 				}
 				continue
 			}
 
-			database.PostToChat(m.String(), m.To)
-		case *protocol.Error_:
-			var e protocol.Error_
-
-			err = json.Unmarshal(e.Byte(), &e)
+			if _, err := deliverMessage(ctx, clientOutbound(client), m, nil); err != nil {
+				var coded codedError
+				errors.As(err, &coded)
 
-			if err != nil {
-				monitorLogger.Error(err.Error())
+				if clientErr := writeError(client, coded.code, coded.err); clientErr != nil {
+					client.lifecycle.disconnect("write error")
+					return
+				}
+			}
+		case *protocol.Error_:
+			// Relayed reports cost a read and a write on the peer's stream,
+			// so they are charged like messages.
+			if dropped, closed := throttle(client, len(message.Byte())); closed {
 				return
+			} else if dropped {
+				continue
 			}
-			monitorLogger.Error(e.String())
+
+			handleClientError(ctx, client, errcodes.Parse(message.String()))
 			continue
 		}
 
 	}
 }
 
-// writeToClient writes the given message to the client connection, with the
-// given message type, and resets the connection deadline to the default ping
-// interval. It returns an error if there was an error writing to the client or
-// extending the deadline.
-func writeToClient(client Client, message protocol.Payload, messageType uint8) error {
-	_, err := protocol.Encode(
-		client.connection,
-		message,
-		messageType,
+// allow charges a message of the given size against the connection, the chat
+// identity and the source IP of the client. It returns ratelimit.ErrThrottled
+// if any of them is over its limit, or ratelimit.ErrBanned if the client has
+// been throttled often enough to be disconnected.
+func (c Client) allow(size int) error {
+	return c.limiter.Allow(
+		size,
+		fmt.Sprintf("conn:%s", c.connection.RemoteAddr().String()),
+		fmt.Sprintf("chat:%s", c.chatId),
+		c.ipKey(),
 	)
+}
+
+// throttle charges a frame of the given size with allow. A frame over the
+// limits is dropped and the client told why, and a banned client is
+// disconnected. It reports whether the frame was dropped and whether the
+// connection was closed.
+func throttle(client Client, size int) (bool, bool) {
+	err := client.allow(size)
+	if err == nil {
+		return false, false
+	}
+
+	client.log.Warning("Throttled", monitor.F(monitor.KeyError, err))
+
+	code := errcodes.Throttled
+	if err == ratelimit.ErrBanned {
+		code = errcodes.Banned
+	}
+
+	if clientErr := writeError(client, code, err); clientErr != nil {
+		client.lifecycle.disconnect("write error")
+		return true, true
+	}
+
+	if err == ratelimit.ErrBanned {
+		client.lifecycle.disconnect("banned for exceeding rate limits")
+		return true, true
+	}
+	return true, false
+}
+
+// ip returns the source IP of the client without the port.
+func (c Client) ip() string {
+	host, _, err := net.SplitHostPort(c.connection.RemoteAddr().String())
 	if err != nil {
+		return c.connection.RemoteAddr().String()
+	}
+	return host
+}
+
+// ipKey returns the rate limiting key for the source IP of the client.
+func (c Client) ipKey() string {
+	return fmt.Sprintf("ip:%s", c.ip())
+}
+
+// refuseClient sends a final error frame explaining why the connection is
+// being refused and closes it.
+func refuseClient(client Client, code errcodes.Code, reason error) {
+	defer client.connection.Close()
+
+	metrics.Rejects.WithLabelValues(code.String()).Inc()
+
+	writeError(client, code, reason)
+
+	client.lifecycle.disconnect("refused: " + reason.Error())
+	client.lifecycle.record(auditLogger.With(client.fields()...))
+}
+
+// fields returns the log fields identifying the client's connection.
+func (c Client) fields() []monitor.Field {
+	return []monitor.Field{
+		monitor.F(monitor.KeyConnID, c.connID),
+		monitor.F(monitor.KeyChatID, c.chatId),
+		monitor.F(monitor.KeyRemoteAddr, c.connection.RemoteAddr().String()),
+	}
+}
+
+// disconnectReason describes why reading from the client failed.
+func disconnectReason(err error, handshaken bool) string {
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout() && !handshaken:
+		return "handshake timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "heartbeat timeout"
+	case errors.Is(err, io.EOF):
+		return "client disconnected"
+	case isConnectionError(err):
+		return "connection error"
+	default:
+		return "malformed frame"
+	}
+}
+
+// writeError sends err to the client as an error frame tagged with the given
+// code. Failures to write are logged and returned so the caller can drop the
+// connection.
+func writeError(client Client, code errcodes.Code, err error) error {
+	e := protocol.Error_(errcodes.Format(code, "", err.Error()))
+	if clientErr := writeToClient(client, &e, protocol.Error); clientErr != nil {
+		client.log.Error(clientErr.Error())
+		return clientErr
+	}
+	return nil
+}
+
+// isConnectionError reports whether err means the connection itself is gone
+// or timed out, in which case there is nobody left to send an error frame to.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
+
+// writeToClient writes the given message to the client connection, with the
+// given message type, and resets the read deadline to the default ping
+// interval. It returns an error if there was an error writing to the client
+// or extending the deadline.
+func writeToClient(client Client, message protocol.Payload, messageType uint8) error {
+	if err := sendFrame(client, message, messageType); err != nil {
 		return err
 	}
 
+	if delivery, ok := message.(*database.Delivery); ok {
+		if posted, ok := delivery.Posted(); ok {
+			metrics.DeliveryLatency.Observe(time.Since(posted).Seconds())
+		}
+	}
+
 	if internalError := extendDeadline(client.connection, DEFAULTPINGINTERVAL, REXTENTION); internalError != nil {
 		return internalError
 	}
 	return nil
 }
 
+// sendFrame writes the given message to the client connection, with the
+// given message type, holding the connection's write lock so frames from
+// different goroutines never interleave. Frames other than heartbeats are
+// padded when the client's traffic shaping has pad buckets. Unlike
+// writeToClient it leaves the read deadline alone.
+func sendFrame(client Client, message protocol.Payload, messageType uint8) error {
+	if len(client.traffic.PadBuckets) > 0 && messageType != protocol.HeartBeat {
+		message = paddedPayload{Payload: message, buckets: client.traffic.PadBuckets}
+	}
+
+	client.writes.Lock()
+	defer client.writes.Unlock()
+
+	var err error
+
+	if messageType == ControlFrame {
+		err = writeFrame(client.connection, messageType, message.Byte())
+	} else {
+		_, err = protocol.Encode(
+			client.connection,
+			message,
+			messageType,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	metrics.FramesOut.WithLabelValues(frameTypeName(messageType)).Inc()
+	client.lifecycle.framesOut.Add(1)
+
+	return nil
+}
+
+// lockedWriter writes to w while holding mu, for writers outside the server,
+// such as the pinger, that write whole frames in a single call.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
+
+// frameTypeName returns the metrics label for a protocol frame type.
+func frameTypeName(messageType uint8) string {
+	switch messageType {
+	case protocol.HeartBeat:
+		return "beat"
+	case protocol.MessageType:
+		return "message"
+	case protocol.Error:
+		return "error"
+	case ControlFrame:
+		return "control"
+	}
+	return "unknown"
+}
+
+// payloadTypeName returns the metrics label for a decoded payload.
+func payloadTypeName(payload protocol.Payload) string {
+	switch payload.(type) {
+	case *protocol.Beat:
+		return "beat"
+	case *protocol.Message:
+		return "message"
+	case *protocol.Error_:
+		return "error"
+	}
+	return "unknown"
+}
+
 // extendDeadline sets the deadline for the given connection to the current time plus the given duration.
 // If an error occurs while setting the deadline, the error is logged and returned.
 // Otherwise, the function returns nil.
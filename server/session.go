@@ -0,0 +1,379 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/metrics"
+	"darkchat/monitor"
+	"darkchat/ratelimit"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+)
+
+type resumeRequest struct {
+	Token string `json:"token"`
+}
+
+// sessionInfo is the body of the responses to session.start and
+// session.resume.
+type sessionInfo struct {
+	ChatID string `json:"chat_id"`
+	Token  string `json:"token"`
+	Grace  int64  `json:"grace"`
+}
+
+func init() {
+	// session.resume moves the connection onto another chat, which a
+	// handler cannot do, it is served by answerResume.
+	registerControl("session.start", startSession)
+}
+
+// sessionRegistry holds the local connections with a session, by connection
+// id, so the one a session is taken over from can be closed whichever node
+// the takeover happened on.
+type sessionRegistry struct {
+	mu      sync.Mutex
+	clients map[string]Client
+}
+
+var attachedSessions = &sessionRegistry{clients: make(map[string]Client)}
+
+func (r *sessionRegistry) add(client Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clients[client.connID] = client
+}
+
+func (r *sessionRegistry) remove(connID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.clients, connID)
+}
+
+// release closes the local connection owner, if there is one, after its
+// session was resumed by another connection. The chat is no longer its own,
+// so closing it leaves the chat alone.
+func (r *sessionRegistry) release(owner string) {
+	r.mu.Lock()
+	client, ok := r.clients[owner]
+	delete(r.clients, owner)
+	r.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	client.log.Info("Session taken over")
+	writeError(client, errcodes.SessionTakenOver, database.ErrSessionTakenOver)
+	client.lifecycle.disconnect("session taken over")
+	client.connection.Close()
+}
+
+// streaming is the goroutine pair moving a chat's messages from Redis to the
+// client.
+type streaming struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startStreaming reads the client's chat and writes what it reads to the
+// client. Messages and events are acknowledged once written, so anything in
+// flight when the connection drops is replayed if the session is resumed.
+func startStreaming(ctx context.Context, client Client) *streaming {
+	return streamTo(ctx, client, client.chatId, []string{client.chatId}, nil)
+}
+
+// streamTo reads the given streams with the consumer group of reader and
+// writes what it reads to the client. Payloads for which skip returns true
+// are acknowledged without being written.
+func streamTo(ctx context.Context, client Client, reader string, subscriptions []string, skip func(protocol.Payload) bool) *streaming {
+	streamCtx, cancel := context.WithCancel(ctx)
+
+	channel := make(chan protocol.Payload, 20)
+	subscribe := make(chan string, len(subscriptions))
+
+	for _, subscription := range subscriptions {
+		subscribe <- subscription
+	}
+
+	s := &streaming{ctx: streamCtx, cancel: cancel, done: make(chan struct{})}
+
+	go database.StreamChat(streamCtx, channel, subscribe, reader)
+
+	go func() {
+		defer close(s.done)
+
+		for message := range channel {
+			metrics.OutboundQueue.Dec()
+
+			if skip == nil || !skip(message) {
+				messageType := protocol.MessageType
+
+				switch message.(type) {
+				case *protocol.Error_:
+					messageType = protocol.Error
+				case *database.Event:
+					messageType = ControlFrame
+				}
+
+				err := writeToClient(client, message, messageType)
+				if err != nil {
+					client.log.Error(err.Error())
+					continue
+				}
+			}
+
+			if err := database.Acknowledge(context.Background(), reader, message); err != nil {
+				client.log.Error(err.Error())
+			}
+		}
+	}()
+
+	return s
+}
+
+// stop ends the streaming and waits for the writer to finish.
+func (s *streaming) stop() {
+	s.cancel()
+	<-s.done
+}
+
+// stopped reports whether the streaming was ended by stop or its connection
+// closing, rather than by its consumer group going away.
+func (s *streaming) stopped() bool {
+	return s.ctx.Err() != nil
+}
+
+// startSession makes the connection resumable and returns the token to
+// resume it with. Asking again returns the same token.
+func startSession(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	token := client.state.sessionToken()
+
+	if token == "" {
+		var err error
+
+		token, err = database.CreateSession(client.chatId, client.connID)
+		if err != nil {
+			return nil, withCode(errcodes.DeliveryFailed, errors.New("session could not be started"))
+		}
+		client.state.setSession(token)
+		attachedSessions.add(client)
+
+		saveSession(client)
+	}
+
+	return sessionInfo{ChatID: client.chatId, Token: token, Grace: int64(client.sessionGrace / time.Second)}, nil
+}
+
+// sessionState returns what a connection taking over the client's session
+// needs to restore.
+func sessionState(client Client) database.Session {
+	_, device := client.state.boundDevice()
+
+	return database.Session{
+		ChatID:   client.chatId,
+		Identity: client.state.boundIdentity(),
+		Device:   device,
+		Present:  client.state.presentIdentity(),
+	}
+}
+
+// saveSession records the client's state in its session, if it has one.
+// Failures are logged, the state is saved again when the connection drops.
+func saveSession(client Client) {
+	token := client.state.sessionToken()
+	if token == "" {
+		return
+	}
+
+	err := database.SaveSession(token, client.connID, sessionState(client))
+	if err != nil && !errors.Is(err, database.ErrSessionTakenOver) {
+		client.log.Error("Saving session failed", monitor.F(monitor.KeyError, err))
+	}
+}
+
+// renewSession extends the lease of the client's session, if it has one, on
+// each heartbeat. Failures are logged, a session that lost its lease is
+// detached and still resumable for the grace period.
+func renewSession(client Client) {
+	token := client.state.sessionToken()
+	if token == "" {
+		return
+	}
+
+	err := database.RenewSession(token, client.connID)
+	if err != nil && !errors.Is(err, database.ErrSessionTakenOver) {
+		client.log.Error("Renewing session failed", monitor.F(monitor.KeyError, err))
+	}
+}
+
+// resumeSession moves the connection onto the chat of a session: what the
+// connection had of its own is released, streaming restarts on the old chat,
+// replaying whatever was not acknowledged, and the identity, device and
+// presence bound to it are restored. A session whose old connection is still
+// attached, or not noticed to be gone yet, is taken over from it.
+func resumeSession(ctx context.Context, client *Client, stream **streaming, body json.RawMessage) (interface{}, error) {
+	var resume resumeRequest
+
+	if err := decodeBody(body, &resume); err != nil {
+		return nil, err
+	}
+
+	if resume.Token == client.state.sessionToken() {
+		return sessionInfo{ChatID: client.chatId, Token: resume.Token, Grace: int64(client.sessionGrace / time.Second)}, nil
+	}
+
+	session, previous, err := database.ResumeSession(resume.Token, client.connID)
+
+	switch {
+	case errors.Is(err, database.ErrUnknownSession):
+		return nil, withCode(errcodes.SessionExpired, err)
+	case err != nil:
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("session could not be resumed"))
+	}
+
+	if previous != "" {
+		if err := database.PublishTakeover(ctx, previous); err != nil {
+			client.log.Error("Taking over session failed", monitor.F(monitor.KeyError, err))
+		}
+	}
+
+	(*stream).stop()
+
+	leaveChat(ctx, *client)
+
+	client.chatId = session.ChatID
+	client.state.restore(resume.Token, session.Identity)
+	client.log = monitorLogger.With(client.fields()...)
+	client.log.Info("Resumed session")
+
+	*stream = startStreaming(ctx, *client)
+
+	signals.add(client.chatId, *client)
+	attachedSessions.add(*client)
+
+	restoreSession(ctx, *client, session)
+
+	return sessionInfo{ChatID: client.chatId, Token: resume.Token, Grace: int64(client.sessionGrace / time.Second)}, nil
+}
+
+// leaveChat gives up the chat the connection had before resuming a session,
+// along with its device, presence and session, as closing the connection
+// would.
+func leaveChat(ctx context.Context, client Client) {
+	leavePresence(ctx, client)
+
+	if identity, _ := client.state.boundDevice(); identity != "" {
+		signals.remove(database.IdentityChat(identity), client.connID)
+	}
+
+	if stream := client.state.releaseDevice(); stream != nil {
+		stream.stop()
+	}
+
+	signals.remove(client.chatId, client.connID)
+
+	if token := client.state.sessionToken(); token != "" {
+		attachedSessions.remove(client.connID)
+		database.EndSession(token)
+	}
+
+	deleteChat(client)
+}
+
+// restoreSession binds the device and presence of a resumed session to the
+// connection again. A device revoked in the meantime stays unbound.
+func restoreSession(ctx context.Context, client Client, session database.Session) {
+	if session.Identity != "" && session.Device != "" {
+		if err := bindDevice(ctx, client, session.Identity, session.Device); err != nil {
+			client.log.Warning("Restoring device failed", monitor.F("device", session.Device), monitor.F(monitor.KeyError, err))
+		}
+	}
+
+	if session.Present != "" {
+		if err := database.TouchPresence(session.Present, client.connID); err != nil {
+			client.log.Error("Restoring presence failed", monitor.F(monitor.KeyError, err))
+		} else {
+			client.state.setPresent(session.Present)
+			notifyPresence(ctx, client, session.Present)
+		}
+	}
+
+	saveSession(client)
+}
+
+// answerResume serves a session.resume request, charged against the message
+// limits like other control requests. Like handleControl it only returns an
+// error when the response could not be written or the client got banned.
+func answerResume(ctx context.Context, client *Client, stream **streaming, payload []byte) error {
+	var request controlRequest
+
+	json.Unmarshal(payload, &request)
+
+	if err := client.allowControl(request.Op, len(payload)); err != nil {
+		code := errcodes.Throttled
+		if err == ratelimit.ErrBanned {
+			code = errcodes.Banned
+		}
+
+		if writeErr := respond(*client, &controlResponse{Op: request.Op, Ref: request.Ref}, nil, withCode(code, err)); writeErr != nil {
+			return writeErr
+		}
+		if err == ratelimit.ErrBanned {
+			return err
+		}
+		return nil
+	}
+
+	body, err := resumeSession(ctx, client, stream, request.Body)
+
+	return respond(*client, &controlResponse{Op: request.Op, Ref: request.Ref}, body, err)
+}
+
+// isResume reports whether a control payload is a session.resume request.
+func isResume(payload []byte) bool {
+	var request controlRequest
+
+	return json.Unmarshal(payload, &request) == nil && request.Op == "session.resume"
+}
+
+// releaseChat cleans up the client's chat when the connection closes. A chat
+// with a session is kept for the grace period so it can be resumed, anything
+// else is deleted straight away. A chat whose session was taken over belongs
+// to another connection and is left as it is.
+func releaseChat(client Client) {
+	if token := client.state.sessionToken(); token != "" {
+		attachedSessions.remove(client.connID)
+
+		err := database.DetachSession(token, client.connID, sessionState(client), client.sessionGrace)
+		if err == nil || errors.Is(err, database.ErrSessionTakenOver) {
+			return
+		}
+
+		client.log.Error("Detaching session failed", monitor.F(monitor.KeyError, err))
+		database.EndSession(token)
+	}
+
+	deleteChat(client)
+}
+
+// deleteChat deletes the client's chat and unbinds the identity bound to it.
+func deleteChat(client Client) {
+	if err := database.DeleteClientChat(client.chatId); err != nil {
+		client.log.Error(err.Error())
+	}
+
+	if identity := client.state.boundIdentity(); identity != "" {
+		if err := database.UnbindIdentity(identity, client.chatId); err != nil && err != database.ErrNotBound {
+			client.log.Error(err.Error())
+		}
+	}
+}
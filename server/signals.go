@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"darkchat/monitor"
+	"darkchat/ratelimit"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+const (
+	DEFAULTSIGNALRATE  = 5
+	DEFAULTSIGNALBURST = 20
+
+	// maxSignalBody is the largest body a signal may carry, in bytes.
+	maxSignalBody = 1024
+
+	// signalQueueSize is how many signals may wait to be written to one
+	// connection. Beyond that they are dropped, so a slow client never holds
+	// up delivery to the others.
+	signalQueueSize = 16
+)
+
+var (
+	ErrInvalidSignalKind = errors.New("signal kind must be 1 to 32 lowercase letters, digits, dots, dashes or underscores")
+	ErrSignalTooLarge    = errors.New("signal body too large")
+)
+
+// signalKindPattern matches the kinds of signal clients may send: the
+// typing.start and typing.stop indicators and whatever else clients agree
+// on between themselves.
+var signalKindPattern = regexp.MustCompile(`^[a-z][a-z0-9._-]{0,31}$`)
+
+// DefaultSignalRateLimit returns the limits applied to signals when none are
+// configured. Throttled signals are dropped, they never get a client banned.
+func DefaultSignalRateLimit() ratelimit.Config {
+	return ratelimit.Config{MessageRate: DEFAULTSIGNALRATE, MessageBurst: DEFAULTSIGNALBURST}
+}
+
+// signalSend is the body of a signal.send request, addressed to a chat or to
+// every device of an identity.
+type signalSend struct {
+	To         string          `json:"to,omitempty"`
+	ToIdentity string          `json:"to_identity,omitempty"`
+	Kind       string          `json:"kind"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+func init() {
+	registerControl("signal.send", sendSignal)
+	selfLimited["signal.send"] = true
+}
+
+// signalHub routes signals published by any node to the connections of this
+// node they are addressed to: chats by their id, device connections by the
+// IdentityChat of their identity.
+type signalHub struct {
+	mu      sync.RWMutex
+	clients map[string]map[string]Client
+}
+
+var signals = &signalHub{clients: make(map[string]map[string]Client)}
+
+// add routes the signals for target to the client.
+func (h *signalHub) add(target string, client Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients[target] == nil {
+		h.clients[target] = make(map[string]Client)
+	}
+	h.clients[target][client.connID] = client
+}
+
+// remove stops routing the signals for target to the connection.
+func (h *signalHub) remove(target string, connID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients[target], connID)
+
+	if len(h.clients[target]) == 0 {
+		delete(h.clients, target)
+	}
+}
+
+// deliver queues a signal, as a "signal" event, for the local connections it
+// is addressed to, if any. It never waits on a connection: a signal that does
+// not fit in a connection's queue is dropped, like it would have been had the
+// client not been connected.
+func (h *signalHub) deliver(signal database.Signal) {
+	h.mu.RLock()
+
+	clients := make([]Client, 0, len(h.clients[signal.To]))
+	for _, client := range h.clients[signal.To] {
+		clients = append(clients, client)
+	}
+
+	h.mu.RUnlock()
+
+	if len(clients) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(signal)
+	if err != nil {
+		return
+	}
+
+	event := &database.Event{Op: "signal", Body: body}
+
+	for _, client := range clients {
+		select {
+		case client.signalQueue <- event:
+		default:
+			client.log.Debug("Dropped signal, queue full")
+		}
+	}
+}
+
+// writeSignals writes the signals queued for the client until the context is
+// canceled. Like cover frames they leave the read deadline alone, what others
+// send does not keep the client's connection alive. Failed writes are dropped.
+func writeSignals(ctx context.Context, client Client) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-client.signalQueue:
+			if err := sendFrame(client, event, ControlFrame); err != nil {
+				client.log.Debug("Dropped signal", monitor.F(monitor.KeyError, err))
+			}
+		}
+	}
+}
+
+// validateSignal checks the recipient, kind and size of a signal.
+func validateSignal(request signalSend) error {
+	switch {
+	case request.ToIdentity != "" && request.To != "":
+		return withCode(errcodes.InvalidRecipient, ErrTwoRecipients)
+	case request.ToIdentity != "":
+		if err := validateIdentity(request.ToIdentity); err != nil {
+			return withCode(errcodes.InvalidRecipient, err)
+		}
+	default:
+		if err := validateChatId(request.To); err != nil {
+			return withCode(errcodes.InvalidRecipient, err)
+		}
+	}
+
+	if !signalKindPattern.MatchString(request.Kind) {
+		return withCode(errcodes.InvalidRequest, ErrInvalidSignalKind)
+	}
+
+	if len(request.Body) > maxSignalBody {
+		return withCode(errcodes.InvalidMessage, fmt.Errorf("%w: %d bytes, limit is %d", ErrSignalTooLarge, len(request.Body), maxSignalBody))
+	}
+	return nil
+}
+
+// sendSignal relays an ephemeral signal to whoever it is addressed to, if
+// they are connected. It is charged against the signal limits rather than
+// the message limits, so typing indicators do not eat into what a client may
+// send. Nothing about it is stored or logged.
+func sendSignal(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	if err := client.signalLimiter.Allow(len(body), fmt.Sprintf("signal:%s", client.connID)); err != nil {
+		return nil, withCode(errcodes.Throttled, err)
+	}
+
+	var request signalSend
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateSignal(request); err != nil {
+		return nil, err
+	}
+
+	signal := database.Signal{To: request.To, From: client.chatId, Kind: request.Kind, Body: request.Body}
+
+	if request.ToIdentity != "" {
+		signal.To = database.IdentityChat(request.ToIdentity)
+	}
+
+	if identity, _ := client.state.boundDevice(); identity != "" {
+		signal.FromIdentity = identity
+	}
+
+	if _, err := database.PublishSignal(ctx, signal); err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("signal could not be sent"))
+	}
+	return nil, nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TestValidateSignal checks the recipient, kind and size rules for signals.
+func TestValidateSignal(t *testing.T) {
+	to := uuid.NewString()
+
+	if err := validateSignal(signalSend{To: to, Kind: "typing.start"}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := validateSignal(signalSend{ToIdentity: identityOf([]byte("key")), Kind: "x-reaction"}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := validateSignal(signalSend{To: to, Kind: "Typing Start"}); !errors.Is(err, ErrInvalidSignalKind) {
+		t.Errorf("Expected %v, got %v", ErrInvalidSignalKind, err)
+	}
+
+	body := json.RawMessage(`"` + strings.Repeat("a", maxSignalBody) + `"`)
+	if err := validateSignal(signalSend{To: to, Kind: "typing.start", Body: body}); !errors.Is(err, ErrSignalTooLarge) {
+		t.Errorf("Expected %v, got %v", ErrSignalTooLarge, err)
+	}
+
+	if err := validateSignal(signalSend{To: "nobody", Kind: "typing.start"}); !errors.Is(err, ErrInvalidChatId) {
+		t.Errorf("Expected %v, got %v", ErrInvalidChatId, err)
+	}
+}
+
+// TestSignalHub routes a signal to a local connection and checks it arrives
+// as a signal event, and that nothing is written once the connection is
+// removed.
+func TestSignalHub(t *testing.T) {
+	server, client := net.Pipe()
+
+	defer server.Close()
+	defer client.Close()
+
+	hub := &signalHub{clients: make(map[string]map[string]Client)}
+	chatId := uuid.NewString()
+
+	conn := Client{connID: "c1", connection: server, lifecycle: newLifecycle("c1"), log: monitorLogger, writes: new(sync.Mutex), signalQueue: make(chan *database.Event, signalQueueSize)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go writeSignals(ctx, conn)
+
+	hub.add(chatId, conn)
+
+	go hub.deliver(database.Signal{To: chatId, From: "sender", Kind: "typing.start"})
+
+	reader := newFrameReader(client, DEFAULTMAXFRAMESIZE)
+
+	if _, err := reader.next(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	payload, isControl, err := reader.control()
+	if err != nil || !isControl {
+		t.Fatalf("Expected a control frame, got %v", err)
+	}
+
+	var event database.Event
+	json.Unmarshal(payload, &event)
+
+	var signal database.Signal
+	json.Unmarshal(event.Body, &signal)
+
+	if event.Op != "signal" || signal.Kind != "typing.start" || signal.From != "sender" {
+		t.Errorf("Unexpected event %s", payload)
+	}
+
+	hub.remove(chatId, "c1")
+
+	if len(hub.clients) != 0 {
+		t.Errorf("Expected no routes left, got %v", hub.clients)
+	}
+}
+
+// TestSignalQueueFull checks that delivering to a connection that does not
+// keep up drops signals instead of waiting.
+func TestSignalQueueFull(t *testing.T) {
+	hub := &signalHub{clients: make(map[string]map[string]Client)}
+	chatId := uuid.NewString()
+
+	conn := Client{connID: "c1", log: monitorLogger, signalQueue: make(chan *database.Event, signalQueueSize)}
+	hub.add(chatId, conn)
+
+	done := make(chan struct{})
+
+	go func() {
+		for i := 0; i < signalQueueSize*2; i++ {
+			hub.deliver(database.Signal{To: chatId, From: "sender", Kind: "typing.start"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected delivery not to block on a full queue")
+	}
+
+	if len(conn.signalQueue) != signalQueueSize {
+		t.Errorf("Expected %d queued signals, got %d", signalQueueSize, len(conn.signalQueue))
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxEmoji is the longest reaction accepted, in bytes, enough for emoji
+// sequences with skin tones and joiners.
+const maxEmoji = 32
+
+var (
+	ErrInvalidMessageRef = errors.New("invalid message reference")
+	ErrInvalidEmoji      = errors.New("reaction must be a short emoji without spaces")
+)
+
+// streamIDPattern matches the ids Redis assigns to stream entries.
+var streamIDPattern = regexp.MustCompile(`^\d{1,20}-\d{1,20}$`)
+
+type threadRequest struct {
+	Root   database.MessageRef `json:"root"`
+	Before string              `json:"before,omitempty"`
+	Limit  int                 `json:"limit,omitempty"`
+}
+
+type reactionRequest struct {
+	Message database.MessageRef `json:"message"`
+	Emoji   string              `json:"emoji"`
+}
+
+type reactionGet struct {
+	Message database.MessageRef `json:"message"`
+}
+
+// reactionEvent tells both sides of a message that its reactions changed.
+type reactionEvent struct {
+	Message   database.MessageRef      `json:"message"`
+	Reactions []database.ReactionCount `json:"reactions"`
+}
+
+func init() {
+	registerControl("thread.get", getThread)
+	registerControl("reaction.add", addReaction)
+	registerControl("reaction.remove", removeReaction)
+	registerControl("reaction.get", getReactions)
+}
+
+// validateRef checks that a message reference names a chat and a stream id.
+func validateRef(ref database.MessageRef) error {
+	if err := validateChatId(ref.Chat); err != nil {
+		return withCode(errcodes.InvalidRequest, ErrInvalidMessageRef)
+	}
+
+	if !streamIDPattern.MatchString(ref.ID) {
+		return withCode(errcodes.InvalidRequest, ErrInvalidMessageRef)
+	}
+	return nil
+}
+
+// validateEmoji checks a reaction: a short run of printable characters
+// without spaces or the separator used to store it.
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmoji || !utf8.ValidString(emoji) || strings.Contains(emoji, "|") {
+		return withCode(errcodes.InvalidRequest, ErrInvalidEmoji)
+	}
+
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return withCode(errcodes.InvalidRequest, ErrInvalidEmoji)
+		}
+	}
+	return nil
+}
+
+// loadParty loads a referenced message the client took part in. Messages it
+// did not take part in are reported as not found, so their existence is not
+// given away.
+func loadParty(client Client, ref database.MessageRef) (database.Referenced, error) {
+	if err := validateRef(ref); err != nil {
+		return database.Referenced{}, err
+	}
+
+	message, err := database.LoadReference(ref)
+
+	if errors.Is(err, database.ErrMessageNotFound) {
+		return message, withCode(errcodes.MessageNotFound, err)
+	}
+
+	if errors.Is(err, database.ErrPrivacyMode) {
+		return message, withCode(errcodes.PrivacyRestricted, err)
+	}
+
+	if err != nil {
+		return message, withCode(errcodes.DeliveryFailed, errors.New("message could not be loaded"))
+	}
+
+	if !message.Party(client.chatId) {
+		return message, withCode(errcodes.MessageNotFound, database.ErrMessageNotFound)
+	}
+	return message, nil
+}
+
+// replyTo builds the reply to a message for a message sent to the chat to.
+// The message replied to must be from the same conversation.
+func replyTo(client Client, to string, ref database.MessageRef, quote bool) (*database.Reply, error) {
+	message, err := loadParty(client, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Other(client.chatId) != to {
+		return nil, withCode(errcodes.InvalidRequest, database.ErrNotParty)
+	}
+
+	return &database.Reply{To: ref, Thread: message.Thread, Quote: quote}, nil
+}
+
+// getThread returns the messages of a thread the client took part in.
+func getThread(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request threadRequest
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateRef(request.Root); err != nil {
+		return nil, err
+	}
+
+	thread, err := database.Thread(request.Root, client.chatId, request.Before, request.Limit)
+	if errors.Is(err, database.ErrPrivacyMode) {
+		return nil, withCode(errcodes.PrivacyRestricted, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("thread could not be loaded"))
+	}
+	return map[string]interface{}{"root": request.Root, "messages": thread}, nil
+}
+
+func addReaction(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	return react(ctx, client, body, false)
+}
+
+func removeReaction(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	return react(ctx, client, body, true)
+}
+
+// react adds or takes back a reaction of the client to a message it took
+// part in, and pushes the new counts to the other side as a "reaction"
+// event.
+func react(ctx context.Context, client Client, body json.RawMessage, remove bool) (interface{}, error) {
+	var request reactionRequest
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if err := validateEmoji(request.Emoji); err != nil {
+		return nil, err
+	}
+
+	message, err := loadParty(client, request.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	reactions, err := database.React(message, client.chatId, request.Emoji, remove)
+
+	if errors.Is(err, database.ErrTooManyReactions) {
+		return nil, withCode(errcodes.InvalidRequest, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("reaction could not be stored"))
+	}
+
+	if other := message.Other(client.chatId); other != "" {
+		event := reactionEvent{Message: request.Message, Reactions: database.CountReactions(reactions, other)}
+
+		ttl, err := database.ConversationTTL(client.chatId, other)
+		if err == nil {
+			_, err = database.PostEvent(ctx, "reaction", event, other, ttl)
+		}
+
+		if err != nil {
+			client.log.Error(err.Error())
+		}
+	}
+
+	return reactionEvent{Message: request.Message, Reactions: database.CountReactions(reactions, client.chatId)}, nil
+}
+
+// getReactions returns the reactions to a message the client took part in.
+func getReactions(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request reactionGet
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	if _, err := loadParty(client, request.Message); err != nil {
+		return nil, err
+	}
+
+	reactions, err := database.Reactions(request.Message)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("reactions could not be loaded"))
+	}
+
+	return reactionEvent{Message: request.Message, Reactions: database.CountReactions(reactions, client.chatId)}, nil
+}
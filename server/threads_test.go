@@ -0,0 +1,46 @@
+package server
+
+import (
+	"darkchat/database"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestValidateRef checks that message references need a chat id and a
+// stream id.
+func TestValidateRef(t *testing.T) {
+	chat := uuid.NewString()
+
+	if err := validateRef(database.MessageRef{Chat: chat, ID: "1700000000000-0"}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	for _, ref := range []database.MessageRef{
+		{Chat: chat, ID: ""},
+		{Chat: chat, ID: "1700000000000"},
+		{Chat: chat, ID: "+"},
+		{Chat: "nobody", ID: "1-0"},
+	} {
+		if err := validateRef(ref); !errors.Is(err, ErrInvalidMessageRef) {
+			t.Errorf("Expected %v for %+v, got %v", ErrInvalidMessageRef, ref, err)
+		}
+	}
+}
+
+// TestValidateEmoji checks which reactions are accepted.
+func TestValidateEmoji(t *testing.T) {
+	for _, emoji := range []string{"👍", "👍🏽", "👨‍👩‍👧", "+1"} {
+		if err := validateEmoji(emoji); err != nil {
+			t.Errorf("Expected no error for %q, got %v", emoji, err)
+		}
+	}
+
+	for _, emoji := range []string{"", "a b", "x|y", "\n", "\xff", strings.Repeat("👍", 9)} {
+		if err := validateEmoji(emoji); !errors.Is(err, ErrInvalidEmoji) {
+			t.Errorf("Expected %v for %q, got %v", ErrInvalidEmoji, emoji, err)
+		}
+	}
+}
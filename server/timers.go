@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"darkchat/database"
+	"darkchat/errcodes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// timerRequest is the body of timer.set and timer.get. With is the chat the
+// timer applies to messages sent to, or empty for messages received. Identity
+// applies the timer to messages received by the identity the connection
+// authenticated as a device of, rather than by its chat. TTL is in seconds,
+// zero turns the timer off.
+type timerRequest struct {
+	With     string `json:"with,omitempty"`
+	Identity bool   `json:"identity,omitempty"`
+	TTL      int64  `json:"ttl"`
+}
+
+func init() {
+	registerControl("timer.set", setTimer)
+	registerControl("timer.get", getTimer)
+}
+
+// setTimer sets the disappearing message timer of one of the client's
+// conversations, or of everything it receives.
+func setTimer(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request timerRequest
+
+	if err := decodeBody(body, &request); err != nil {
+		return nil, err
+	}
+
+	ttl, err := timerTTL(request.TTL)
+	if err != nil {
+		return nil, withCode(errcodes.InvalidRequest, err)
+	}
+
+	owner, err := timerOwner(client, request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.SetTimer(owner, request.With, ttl)
+
+	if errors.Is(err, database.ErrInvalidTTL) {
+		return nil, withCode(errcodes.InvalidRequest, err)
+	}
+
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("timer could not be set"))
+	}
+	return nil, nil
+}
+
+// getTimer returns the time to live, in seconds, that messages from the
+// client to a chat get once both sides' timers are taken into account, or
+// that messages to the client get when no chat is given.
+func getTimer(ctx context.Context, client Client, body json.RawMessage) (interface{}, error) {
+	var request timerRequest
+
+	if len(body) > 0 {
+		if err := decodeBody(body, &request); err != nil {
+			return nil, err
+		}
+	}
+
+	owner, err := timerOwner(client, request)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to := owner, request.With
+
+	if to == "" {
+		from, to = "", owner
+	}
+
+	ttl, err := database.ConversationTTL(from, to)
+	if err != nil {
+		return nil, withCode(errcodes.DeliveryFailed, errors.New("timer could not be read"))
+	}
+	return timerRequest{With: request.With, Identity: request.Identity, TTL: int64(ttl / time.Second)}, nil
+}
+
+// timerTTL converts a timer in seconds to a duration, refusing values beyond
+// database.MaxTTL before they can overflow.
+func timerTTL(seconds int64) (time.Duration, error) {
+	if seconds < 0 || seconds > int64(database.MaxTTL/time.Second) {
+		return 0, fmt.Errorf("%w: %ds, limit is %s", database.ErrInvalidTTL, seconds, database.MaxTTL)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// timerOwner returns whose timers a request reads or sets: the connection's
+// chat, or its identity's inbox when the request asks for it. Identity
+// timers only cover what the identity receives.
+func timerOwner(client Client, request timerRequest) (string, error) {
+	if request.With != "" {
+		if err := validateChatId(request.With); err != nil {
+			return "", withCode(errcodes.InvalidRecipient, err)
+		}
+	}
+
+	if !request.Identity {
+		return client.chatId, nil
+	}
+
+	identity, _ := client.state.boundDevice()
+	if identity == "" {
+		return "", withCode(errcodes.InvalidRequest, ErrNoDevice)
+	}
+
+	if request.With != "" {
+		return "", withCode(errcodes.InvalidRequest, errors.New("identity timers apply to received messages only"))
+	}
+	return database.IdentityChat(identity), nil
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"darkchat/database"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestTimerTTL checks that timers are converted from seconds and that values
+// beyond the limit are refused rather than overflowing.
+func TestTimerTTL(t *testing.T) {
+	limit := int64(database.MaxTTL / time.Second)
+
+	for seconds, expected := range map[int64]time.Duration{0: 0, 60: time.Minute, limit: database.MaxTTL} {
+		ttl, err := timerTTL(seconds)
+		if err != nil || ttl != expected {
+			t.Errorf("Expected %v for %d, got %v, %v", expected, seconds, ttl, err)
+		}
+	}
+
+	for _, seconds := range []int64{-1, limit + 1, math.MaxInt64 / int64(time.Second) * 2, math.MaxInt64} {
+		if _, err := timerTTL(seconds); !errors.Is(err, database.ErrInvalidTTL) {
+			t.Errorf("Expected %v for %d, got %v", database.ErrInvalidTTL, seconds, err)
+		}
+	}
+}
+
+// TestTimerOwner checks that identity timers need a device and apply to the
+// identity's inbox only.
+func TestTimerOwner(t *testing.T) {
+	client := Client{chatId: "chat", state: &connState{}}
+
+	if owner, err := timerOwner(client, timerRequest{}); err != nil || owner != "chat" {
+		t.Errorf("Expected %v, got %v, %v", "chat", owner, err)
+	}
+
+	if _, err := timerOwner(client, timerRequest{Identity: true}); !errors.Is(err, ErrNoDevice) {
+		t.Errorf("Expected %v, got %v", ErrNoDevice, err)
+	}
+}
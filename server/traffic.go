@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"darkchat/metrics"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+)
+
+const (
+	DEFAULTHEARTBEATJITTER = 0.5
+	DEFAULTCOVERRATE       = 0.1
+)
+
+// DEFAULTPADBUCKETS are the payload sizes frames are padded up to when
+// traffic shaping is on.
+var DEFAULTPADBUCKETS = []int{256, 1024, 4096, 16384}
+
+// TrafficShaping hides message sizes and activity from someone watching the
+// connection. The zero value turns every part of it off.
+type TrafficShaping struct {
+	// PadBuckets are the sizes that message and error frame payloads are
+	// padded up to. They must be positive and are sorted when the server
+	// starts. Payloads larger than the largest bucket are padded to a
+	// multiple of it.
+	PadBuckets []int
+
+	// HeartbeatJitter randomises each heartbeat interval by up to this
+	// fraction of it in either direction.
+	HeartbeatJitter float64
+
+	// CoverRate is the average number of cover frames sent per second on
+	// each connection. Cover frames are sent at random, exponentially
+	// distributed, intervals.
+	CoverRate float64
+}
+
+// ErrInvalidPadBucket is returned for pad buckets that are not positive.
+var ErrInvalidPadBucket = errors.New("pad buckets must be positive")
+
+// sortPadBuckets returns the pad buckets in increasing order, as padSize
+// expects them, without duplicates. Buckets that are not positive would
+// leave padSize dividing by zero or padding to negative sizes, so they are
+// refused.
+func sortPadBuckets(buckets []int) ([]int, error) {
+	sorted := make([]int, 0, len(buckets))
+
+	for _, bucket := range buckets {
+		if bucket <= 0 {
+			return nil, fmt.Errorf("%w: got %d", ErrInvalidPadBucket, bucket)
+		}
+		sorted = append(sorted, bucket)
+	}
+
+	slices.Sort(sorted)
+	return slices.Compact(sorted), nil
+}
+
+// paddedPayload appends spaces to the encoding of a payload. Message payloads
+// are JSON, which allows trailing whitespace, and errcodes.Parse ignores
+// trailing spaces in error frames, so padded frames decode as before.
+type paddedPayload struct {
+	protocol.Payload
+	buckets []int
+}
+
+// Byte returns the payload padded to its bucket.
+func (p paddedPayload) Byte() []byte {
+	b := p.Payload.Byte()
+
+	return append(b, bytes.Repeat([]byte(" "), padSize(len(b), p.buckets)-len(b))...)
+}
+
+// padSize returns the size a payload of n bytes is padded to.
+func padSize(n int, buckets []int) int {
+	if len(buckets) == 0 {
+		return n
+	}
+
+	for _, bucket := range buckets {
+		if n <= bucket {
+			return bucket
+		}
+	}
+
+	largest := buckets[len(buckets)-1]
+
+	return (n + largest - 1) / largest * largest
+}
+
+// coverFrame is a message frame with no text, which real messages can never
+// be, so clients can recognise and drop it. Padded, it is indistinguishable
+// on the wire from a short message.
+func coverFrame() protocol.Payload {
+	return &protocol.Message{}
+}
+
+// sendCoverTraffic writes cover frames to the client at random intervals
+// averaging rate per second until the context is cancelled or a write
+// fails. Cover frames leave the read deadline alone, it is only for what the
+// client sends.
+func sendCoverTraffic(ctx context.Context, client Client, rate float64) {
+	if rate <= 0 {
+		return
+	}
+
+	for {
+		wait := time.Duration(rand.ExpFloat64() / rate * float64(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := sendFrame(client, coverFrame(), protocol.MessageType); err != nil {
+			return
+		}
+		metrics.CoverFrames.Inc()
+	}
+}
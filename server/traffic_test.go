@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	protocol "github.com/Gibson-Gichuru/darkchat-protocol"
+)
+
+// TestPadSize checks that sizes are rounded up to the next bucket and to a
+// multiple of the largest bucket beyond it.
+func TestPadSize(t *testing.T) {
+	buckets := []int{256, 1024}
+
+	cases := map[int]int{0: 256, 100: 256, 256: 256, 257: 1024, 1024: 1024, 1025: 2048, 3000: 3072}
+
+	for n, expected := range cases {
+		if got := padSize(n, buckets); got != expected {
+			t.Errorf("Expected %d to pad to %d, got %d", n, expected, got)
+		}
+	}
+
+	if got := padSize(100, nil); got != 100 {
+		t.Errorf("Expected no padding without buckets, got %d", got)
+	}
+}
+
+// TestSortPadBuckets checks that pad buckets are sorted and that buckets
+// that are not positive are refused.
+func TestSortPadBuckets(t *testing.T) {
+	buckets, err := sortPadBuckets([]int{4096, 256, 1024, 256})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !slices.Equal(buckets, []int{256, 1024, 4096}) {
+		t.Errorf("Expected %v, got %v", []int{256, 1024, 4096}, buckets)
+	}
+
+	for _, invalid := range [][]int{{0}, {256, -1}, {-256}} {
+		if _, err := sortPadBuckets(invalid); !errors.Is(err, ErrInvalidPadBucket) {
+			t.Errorf("Expected %v for %v, got %v", ErrInvalidPadBucket, invalid, err)
+		}
+	}
+
+	if buckets, err := sortPadBuckets(nil); err != nil || len(buckets) != 0 {
+		t.Errorf("Expected no buckets, got %v (%v)", buckets, err)
+	}
+}
+
+// TestPaddedPayload checks that a padded message has the bucket size and
+// still decodes to the original message.
+func TestPaddedPayload(t *testing.T) {
+	message := &protocol.Message{Message: "hello", From: "a", To: "b"}
+
+	b := paddedPayload{Payload: message, buckets: []int{256}}.Byte()
+
+	if len(b) != 256 {
+		t.Errorf("Expected 256 bytes, got %d", len(b))
+	}
+
+	var decoded protocol.Message
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Expected padded JSON to decode, got %v", err)
+	}
+
+	if decoded != *message {
+		t.Errorf("Expected %v, got %v", *message, decoded)
+	}
+}